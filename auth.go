@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// may read devices, commands, schemas and the live feeds
+	RoleReadOnly = "read-only"
+	// may send commands to piles too
+	RoleOperator = "operator"
+	// may also close connections and manage the outbox
+	RoleAdmin = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+const (
+	AuthNone   = "none"
+	AuthApiKey = "apiKey"
+	AuthJwt    = "jwt"
+
+	callerKey = "caller"
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing api key or bearer token")
+	ErrInvalidApiKey   = errors.New("invalid api key")
+)
+
+// anonymous is the caller of every request while authentication is off.
+var anonymous = &Caller{Name: "anonymous", Role: RoleAdmin, Auth: AuthNone}
+
+// Caller is the identity behind a request. Devices scopes it to these pile
+// ids, an empty list allows every pile.
+type Caller struct {
+	Name    string   `json:"name"`
+	Role    string   `json:"role"`
+	Devices []string `json:"devices,omitempty"`
+	Auth    string   `json:"auth"`
+}
+
+// Allows reports whether the caller's role is role or a higher one.
+func (c *Caller) Allows(role string) bool {
+	return roleLevels[c.Role] >= roleLevels[role]
+}
+
+func (c *Caller) CanAccess(id string) bool {
+	if len(c.Devices) == 0 {
+		return true
+	}
+	for _, d := range c.Devices {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope narrows the pile ids a caller asked for to its own; no ids means all
+// of them. ok is false if an id is out of scope.
+func (c *Caller) Scope(ids []string) (scoped []string, ok bool) {
+	if len(ids) == 0 {
+		return c.Devices, true
+	}
+	for _, id := range ids {
+		if !c.CanAccess(id) {
+			return nil, false
+		}
+	}
+	return ids, true
+}
+
+// ApiKey is an entry of the api key file.
+type ApiKey struct {
+	Name    string   `json:"name"`
+	Key     string   `json:"key"`
+	Role    string   `json:"role"`
+	Devices []string `json:"devices,omitempty"`
+}
+
+// jwtClaims are the claims of a bearer token: the subject names the caller,
+// role and devices are like those of an api key.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Role    string   `json:"role"`
+	Devices []string `json:"devices,omitempty"`
+}
+
+// Authenticator identifies callers by api key, looked up by its hash, or by
+// a JWT signed with one of the keys of a local JWKS file.
+type Authenticator struct {
+	Issuer   string
+	Audience string
+
+	keys map[[32]byte]*Caller
+	jwks map[string]crypto.PublicKey
+}
+
+var auth *Authenticator
+
+func NewAuthenticator(apiKeysFile string, jwksFile string, issuer string, audience string) (*Authenticator, error) {
+	a := &Authenticator{
+		Issuer:   issuer,
+		Audience: audience,
+		keys:     make(map[[32]byte]*Caller),
+	}
+	if apiKeysFile != "" {
+		if err := a.loadApiKeys(apiKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if jwksFile != "" {
+		jwks, err := LoadJwks(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = jwks
+	}
+	log.WithFields(log.Fields{
+		"api_keys": len(a.keys),
+		"jwks":     len(a.jwks),
+	}).Info("api authentication enabled")
+	return a, nil
+}
+
+func (a *Authenticator) loadApiKeys(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var list []*ApiKey
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	for _, k := range list {
+		if k.Name == "" || k.Key == "" {
+			return errors.New("api key without name or key")
+		}
+		if _, ok := roleLevels[k.Role]; !ok {
+			return fmt.Errorf("api key %s has unknown role %q", k.Name, k.Role)
+		}
+		a.keys[sha256.Sum256([]byte(k.Key))] = &Caller{
+			Name:    k.Name,
+			Role:    k.Role,
+			Devices: k.Devices,
+			Auth:    AuthApiKey,
+		}
+	}
+	return nil
+}
+
+// Authenticate identifies the caller from the value of the Authorization
+// header, "Bearer <jwt>", or from an api key. A bearer token that is not a
+// JWT is taken as an api key.
+func (a *Authenticator) Authenticate(authorization string, apiKey string) (*Caller, error) {
+	if token, ok := cutPrefixFold(authorization, "Bearer "); ok {
+		if strings.Count(token, ".") == 2 {
+			return a.verifyJwt(token)
+		}
+		apiKey = token
+	}
+	if apiKey == "" {
+		return nil, ErrUnauthenticated
+	}
+	if c, ok := a.keys[sha256.Sum256([]byte(apiKey))]; ok {
+		return c, nil
+	}
+	return nil, ErrInvalidApiKey
+}
+
+func (a *Authenticator) verifyJwt(token string) (*Caller, error) {
+	if len(a.jwks) == 0 {
+		return nil, errors.New("bearer tokens are not accepted")
+	}
+	claims := &jwtClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := a.jwks[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if !jwtMethodFits(t.Method, key) {
+			return nil, fmt.Errorf("algorithm %s does not fit key %q", t.Method.Alg(), kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("invalid token: no expiry")
+	}
+	if a.Issuer != "" && !claims.VerifyIssuer(a.Issuer, true) {
+		return nil, errors.New("invalid token: wrong issuer")
+	}
+	if a.Audience != "" && !claims.VerifyAudience(a.Audience, true) {
+		return nil, errors.New("invalid token: wrong audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid token: no subject")
+	}
+	if _, ok := roleLevels[claims.Role]; !ok {
+		return nil, fmt.Errorf("invalid token: unknown role %q", claims.Role)
+	}
+	return &Caller{
+		Name:    claims.Subject,
+		Role:    claims.Role,
+		Devices: claims.Devices,
+		Auth:    AuthJwt,
+	}, nil
+}
+
+// jwtMethodFits keeps a token from picking an algorithm its key was not made
+// for.
+func jwtMethodFits(m jwt.SigningMethod, key crypto.PublicKey) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch m.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		_, ok := m.(*jwt.SigningMethodECDSA)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := m.(*jwt.SigningMethodEd25519)
+		return ok
+	}
+	return false
+}
+
+func cutPrefixFold(s string, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return strings.TrimSpace(s[len(prefix):]), true
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJwks reads the public keys of a JWKS file by key id. RSA, EC (P-256,
+// P-384, P-521) and Ed25519 keys are supported, keys for encryption are
+// skipped.
+func LoadJwks(file string) (map[string]crypto.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// tokenQueryRoutes are the routes taking the access_token query parameter:
+// browsers can not set headers on EventSource and WebSocket requests.
+var tokenQueryRoutes = map[string]bool{
+	"/events":         true,
+	"/ws/devices/:id": true,
+}
+
+// Authenticate identifies the caller of the http api, on the live feeds by
+// the access_token query parameter too.
+func Authenticate(c *gin.Context) {
+	if auth == nil {
+		c.Set(callerKey, anonymous)
+		return
+	}
+	authorization := c.GetHeader("Authorization")
+	if authorization == "" && tokenQueryRoutes[c.FullPath()] && c.Query("access_token") != "" {
+		authorization = "Bearer " + c.Query("access_token")
+	}
+	caller, err := auth.Authenticate(authorization, c.GetHeader("X-API-Key"))
+	if err != nil {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(401, gin.H{"message": err.Error()})
+		return
+	}
+	c.Set(callerKey, caller)
+}
+
+// AccessLogFormatter is gin's request log line with the access_token query
+// parameter redacted.
+func AccessLogFormatter(p gin.LogFormatterParams) string {
+	path := p.Request.URL.Path
+	if q := p.Request.URL.Query(); len(q) > 0 {
+		if q.Has("access_token") {
+			q.Set("access_token", "redacted")
+		}
+		path += "?" + q.Encode()
+	}
+	if p.Latency > time.Minute {
+		p.Latency = p.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		p.TimeStamp.Format("2006/01/02 - 15:04:05"), p.StatusCode, p.Latency, p.ClientIP, p.Method, path, p.ErrorMessage)
+}
+
+func callerOf(c *gin.Context) *Caller {
+	if v, ok := c.Get(callerKey); ok {
+		return v.(*Caller)
+	}
+	return anonymous
+}
+
+// RequireRole lets requests through only for callers with at least role.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !callerOf(c).Allows(role) {
+			c.AbortWithStatusJSON(403, gin.H{"message": "requires role " + role})
+		}
+	}
+}
+
+// AuthorizeDevice checks the pile a request is about, taken from the path or
+// else from the id of the command in the body, is in the caller's scope.
+func AuthorizeDevice(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		id = CommandDeviceId(peekBody(c))
+	}
+	if !callerOf(c).CanAccess(id) {
+		c.AbortWithStatusJSON(403, gin.H{"message": "no access to device " + id})
+	}
+}
+
+// peekBody reads the body of a request, leaving it to be read again.
+func peekBody(c *gin.Context) []byte {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// AuditEntry records a command and who sent it. Status is the http status
+// of the answer, or the grpc status code.
+type AuditEntry struct {
+	Time          time.Time       `json:"time"`
+	Caller        string          `json:"caller"`
+	Role          string          `json:"role"`
+	Auth          string          `json:"auth"`
+	RemoteAddress string          `json:"remoteAddress"`
+	Api           string          `json:"api"`
+	Command       string          `json:"command"`
+	DeviceId      string          `json:"deviceId,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Status        string          `json:"status"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// AuditLog appends an entry per line as json to a file. Without one, the
+// entries go to the log.
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var auditLog = &AuditLog{}
+
+func OpenAuditLog(file string) (*AuditLog, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f}, nil
+}
+
+func (l *AuditLog) Record(e *AuditEntry) {
+	if l.f == nil {
+		log.WithFields(log.Fields{
+			"caller":    e.Caller,
+			"role":      e.Role,
+			"auth":      e.Auth,
+			"address":   e.RemoteAddress,
+			"api":       e.Api,
+			"id":        e.DeviceId,
+			"status":    e.Status,
+			"error":     e.Error,
+			"operation": e.Command,
+		}).Info("command audited")
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		log.Errorf("error writing audit log: %v", err)
+	}
+}
+
+func (l *AuditLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// AuditCommand records a command sent over the http api once it has been
+// answered, refused ones included.
+func AuditCommand(c *gin.Context) {
+	body := peekBody(c)
+	id := c.Param("id")
+	if id == "" {
+		id = CommandDeviceId(body)
+	}
+	caller := callerOf(c)
+	c.Next()
+	e := &AuditEntry{
+		Time:          time.Now(),
+		Caller:        caller.Name,
+		Role:          caller.Role,
+		Auth:          caller.Auth,
+		RemoteAddress: c.ClientIP(),
+		Api:           "http",
+		Command:       c.Request.Method + " " + c.Request.URL.Path,
+		DeviceId:      id,
+		Status:        fmt.Sprint(c.Writer.Status()),
+		Error:         c.Errors.String(),
+	}
+	if json.Valid(body) {
+		e.Payload = body
+	}
+	auditLog.Record(e)
+}
+
+type callerContextKey struct{}
+
+func withCaller(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, c)
+}
+
+func callerFrom(ctx context.Context) *Caller {
+	if c, ok := ctx.Value(callerContextKey{}).(*Caller); ok {
+		return c
+	}
+	return anonymous
+}
+
+// messagingCaller sends the commands arriving over the messaging server,
+// which is trusted like the network it runs in.
+var messagingCaller = &Caller{Name: "messaging", Role: RoleAdmin, Auth: AuthNone}
+
+func auditMessagingCommand(frameType string, payload []byte, status string, errMsg string) {
+	e := &AuditEntry{
+		Time:     time.Now(),
+		Caller:   messagingCaller.Name,
+		Role:     messagingCaller.Role,
+		Auth:     messagingCaller.Auth,
+		Api:      "messaging",
+		Command:  "cmd." + frameType,
+		DeviceId: CommandDeviceId(payload),
+		Status:   status,
+		Error:    errMsg,
+	}
+	if json.Valid(payload) {
+		e.Payload = payload
+	}
+	auditLog.Record(e)
+}
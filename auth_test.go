@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestApiAuthorization(t *testing.T) {
+	dir := t.TempDir()
+	keys := `[
+		{"name":"dashboard","key":"ro-key","role":"read-only"},
+		{"name":"site-a","key":"op-key","role":"operator","devices":["32010600213533"]}
+	]`
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := `{"keys":[{"kid":"k1","kty":"OKP","crv":"Ed25519","x":"` + base64.RawURLEncoding.EncodeToString(pub) + `"}]}`
+	_ = os.WriteFile(filepath.Join(dir, "keys.json"), []byte(keys), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "jwks.json"), []byte(jwks), 0600)
+	a, err := NewAuthenticator(filepath.Join(dir, "keys.json"), filepath.Join(dir, "jwks.json"), "", "ykc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := OpenAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, auditLog = a, l
+	defer func() {
+		_ = l.Close()
+		auth, auditLog = nil, &AuditLog{}
+	}()
+
+	token := func(role string, aud string) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, &jwtClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "ops@example.com",
+				Audience:  jwt.ClaimStrings{aud},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			Role: role,
+		})
+		tok.Header["kid"] = "k1"
+		s, _ := tok.SignedString(priv)
+		return "Bearer " + s
+	}
+
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	do := func(method string, path string, authorization string, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	//the piles are not connected, an authorized command fails to be sent
+	reboot := `{"id":"%s","control":1}`
+	for _, tc := range []struct {
+		method, path, authorization, body string
+		code                              int
+	}{
+		{"GET", "/devices", "", "", 401},
+		{"GET", "/devices", "Bearer nope", "", 401},
+		{"GET", "/devices", "Bearer ro-key", "", 200},
+		{"POST", "/proxy/92", "Bearer ro-key", strings.Replace(reboot, "%s", "32010600213533", 1), 403},
+		{"POST", "/proxy/92", "Bearer op-key", strings.Replace(reboot, "%s", "32010600213534", 1), 403},
+		{"POST", "/proxy/92", "Bearer op-key", strings.Replace(reboot, "%s", "32010600213533", 1), 500},
+		{"GET", "/devices/32010600213534", "Bearer op-key", "", 403},
+		{"DELETE", "/devices/32010600213533/connection", "Bearer op-key", "", 403},
+		{"DELETE", "/devices/32010600213533/connection", token(RoleAdmin, "ykc"), "", 404},
+		{"DELETE", "/devices/32010600213533/connection", token(RoleAdmin, "other"), "", 401},
+		{"GET", "/events?id=32010600213534", "Bearer op-key", "", 403},
+		//the token is taken from the query on the live feeds only
+		{"GET", "/events?id=32010600213534&access_token=op-key", "", "", 403},
+		{"GET", "/devices?access_token=ro-key", "", "", 401},
+	} {
+		if code := do(tc.method, tc.path, tc.authorization, tc.body); code != tc.code {
+			t.Errorf("%s %s with %q answered %d, want %d", tc.method, tc.path, tc.authorization, code, tc.code)
+		}
+	}
+
+	f, _ := os.Open(filepath.Join(dir, "audit.log"))
+	defer f.Close()
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("unexpected audit log %+v", entries)
+	}
+	if e := entries[2]; e.Caller != "site-a" || e.Auth != AuthApiKey || e.DeviceId != "32010600213533" || e.Status != "500" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+	if e := entries[4]; e.Caller != "ops@example.com" || e.Role != RoleAdmin || e.Auth != AuthJwt || e.Status != "404" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+}
+
+func TestAccessLogRedactsToken(t *testing.T) {
+	line := AccessLogFormatter(gin.LogFormatterParams{
+		Request:    httptest.NewRequest("GET", "/events?id=32010600213533&access_token=secret", nil),
+		StatusCode: 200,
+		Method:     "GET",
+	})
+	if strings.Contains(line, "secret") || !strings.Contains(line, "access_token=redacted") || !strings.Contains(line, "id=32010600213533") {
+		t.Fatalf("unexpected log line %s", line)
+	}
+}
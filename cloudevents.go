@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+
+	cloudEventsSpecVersion = "1.0"
+)
+
+// CloudEvent is the structured mode envelope of a device message.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// BinaryEventPublisher is implemented by forwarders whose protocol binding
+// carries CloudEvents attributes as headers, next to the bare message.
+type BinaryEventPublisher interface {
+	PublishEvent(mid string, message []byte, attrs map[string]string) error
+}
+
+// CloudEventsForwarder wraps every message into a CloudEvent when it is
+// received, before it reaches an outbox, so a retried message keeps its id.
+// In binary mode the attributes are handed to forwarders supporting it as
+// headers, the others get the structured envelope.
+type CloudEventsForwarder struct {
+	Forwarder MessageForwarder
+	Mode      string
+	Source    string
+}
+
+// DefaultCloudEventsSource identifies this gateway instance.
+func DefaultCloudEventsSource() string {
+	return "ykc-proxy-server/" + hostname()
+}
+
+func (h *CloudEventsForwarder) Connect() error {
+	return nil
+}
+
+func (h *CloudEventsForwarder) attributes(mid string, message []byte) map[string]string {
+	attrs := map[string]string{
+		"specversion":     cloudEventsSpecVersion,
+		"id":              NewId(),
+		"source":          h.Source,
+		"type":            NATS_PUBLISH_SUBJECT_PREFIX + "." + mid,
+		"time":            time.Now().UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+	}
+	if id := MessageDeviceId(message); id != "" {
+		attrs["subject"] = id
+	}
+	return attrs
+}
+
+func (h *CloudEventsForwarder) Publish(mid string, message []byte) error {
+	attrs := h.attributes(mid, message)
+	if h.Mode == CloudEventsBinary {
+		return publishEvent(h.Forwarder, mid, message, attrs)
+	}
+	return publishStructuredEvent(h.Forwarder, mid, message, attrs)
+}
+
+// publishEvent hands an event to f in binary mode if f supports it, as a
+// structured envelope otherwise.
+func publishEvent(f MessageForwarder, mid string, message []byte, attrs map[string]string) error {
+	if p, ok := f.(BinaryEventPublisher); ok {
+		return p.PublishEvent(mid, message, attrs)
+	}
+	return publishStructuredEvent(f, mid, message, attrs)
+}
+
+func publishStructuredEvent(f MessageForwarder, mid string, message []byte, attrs map[string]string) error {
+	b, err := json.Marshal(&CloudEvent{
+		SpecVersion:     attrs["specversion"],
+		Id:              attrs["id"],
+		Source:          attrs["source"],
+		Type:            attrs["type"],
+		Subject:         attrs["subject"],
+		Time:            attrs["time"],
+		DataContentType: attrs["datacontenttype"],
+		Data:            message,
+	})
+	if err != nil {
+		return err
+	}
+	return f.Publish(mid, b)
+}
+
+func (h *CloudEventsForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	return h.Forwarder.Subscribe(topic, handler)
+}
+
+func (h *CloudEventsForwarder) PublishDeviceStatus(id string, online bool) error {
+	if p, ok := h.Forwarder.(DeviceStatusPublisher); ok {
+		return p.PublishDeviceStatus(id, online)
+	}
+	return nil
+}
+
+func (h *CloudEventsForwarder) Close() error {
+	return h.Forwarder.Close()
+}
+
+// MessageData returns the device message of a structured CloudEvent, or the
+// message itself if it is not one.
+func MessageData(message []byte) []byte {
+	var v struct {
+		SpecVersion string          `json:"specversion"`
+		Data        json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(message, &v); err != nil || v.SpecVersion == "" {
+		return message
+	}
+	return v.Data
+}
+
+// IsCloudEvent reports whether a message is a structured CloudEvent.
+func IsCloudEvent(message []byte) bool {
+	if !bytes.Contains(message, []byte(`"specversion"`)) {
+		return false
+	}
+	var v struct {
+		SpecVersion string `json:"specversion"`
+	}
+	return json.Unmarshal(message, &v) == nil && v.SpecVersion != ""
+}
+
+// cloudEventsHeaders maps the attributes of a binary mode event to headers
+// named prefix+attribute, except the content type, which goes to
+// contentType. Without attributes it only marks structured events as such.
+func cloudEventsHeaders(message []byte, attrs map[string]string, prefix string, contentType string) map[string]string {
+	headers := make(map[string]string, len(attrs))
+	if attrs == nil && IsCloudEvent(message) {
+		headers[contentType] = "application/cloudevents+json"
+	}
+	for k, v := range attrs {
+		if k == "datacontenttype" {
+			headers[contentType] = v
+			continue
+		}
+		headers[prefix+k] = v
+	}
+	return headers
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCloudEventsStructured(t *testing.T) {
+	f := &flakyForwarder{}
+	ce := &CloudEventsForwarder{Forwarder: f, Mode: CloudEventsStructured, Source: "ykc-proxy-server/test"}
+	if err := ce.Publish("3b", []byte(`{"id":"32010600213533","tradeSeq":"01"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var e CloudEvent
+	if err := json.Unmarshal(f.messages[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.SpecVersion != "1.0" || e.Type != "charge.proxy.ykc.3b" || e.Subject != "32010600213533" ||
+		e.Source != "ykc-proxy-server/test" || e.Id == "" || e.Time == "" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	// forwarders still find the pile and trade sequence inside the envelope
+	if id := MessageDeviceId(f.messages[0]); id != "32010600213533" {
+		t.Errorf("got pile id %q from event", id)
+	}
+	if id := MessageDedupId("3b", f.messages[0]); id != "3b.01" {
+		t.Errorf("got dedup id %q from event", id)
+	}
+}
+
+func TestCloudEventsBinaryThroughOutbox(t *testing.T) {
+	var got http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer s.Close()
+	h := &HTTPForwarder{Endpoints: []string{s.URL}}
+	if err := h.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	o, err := NewOutbox(t.TempDir(), h, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ce := &CloudEventsForwarder{Forwarder: o, Mode: CloudEventsBinary, Source: "ykc-proxy-server/test"}
+	if err := ce.Publish("13", []byte(`{"id":"32010600213533"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stored := o.Pending("")[0].Attributes["id"]
+	step(o)
+	if got.Get("ce-id") != stored || got.Get("ce-type") != "charge.proxy.ykc.13" || got.Get("ce-subject") != "32010600213533" {
+		t.Errorf("unexpected headers %v", got)
+	}
+	if got.Get("Content-Type") != "application/json" {
+		t.Errorf("got content type %s", got.Get("Content-Type"))
+	}
+
+	// a forwarder without binary support gets the structured envelope
+	f := &flakyForwarder{}
+	o, _ = NewOutbox(t.TempDir(), f, 0, 0, 0)
+	ce.Forwarder = o
+	_ = ce.Publish("13", []byte(`{"id":"32010600213533"}`))
+	step(o)
+	if !IsCloudEvent(f.messages[0]) {
+		t.Errorf("expected structured event, got %s", f.messages[0])
+	}
+}
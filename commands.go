@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrUnsupportedCommand = errors.New("unsupported command")
+
+// downlinkCommand describes how a downlink frame is decoded from json and
+// sent to the pile, and which uplink frame (if any) answers it.
+type downlinkCommand struct {
+	Reply string
+	Send  func(payload []byte, src *CommandSource) error
+}
+
+var downlinkCommands map[string]downlinkCommand
+
+// the table is filled in init since the senders refer back to it through the
+// command queue
+func init() {
+	downlinkCommands = map[string]downlinkCommand{
+		"02": {Send: func(payload []byte, src *CommandSource) error {
+			var req VerificationResponseMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return ResponseToVerification(&req, src)
+		}},
+		"06": {Send: func(payload []byte, src *CommandSource) error {
+			var req BillingModelVerificationResponseMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return ResponseToBillingModelVerification(&req, src)
+		}},
+		"0a": {Send: func(payload []byte, src *CommandSource) error {
+			var req BillingModelResponseMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendBillingModelResponseMessage(&req, src)
+		}},
+		"34": {Reply: "33", Send: func(payload []byte, src *CommandSource) error {
+			var req RemoteBootstrapRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendRemoteBootstrapRequest(&req, src)
+		}},
+		"36": {Reply: "35", Send: func(payload []byte, src *CommandSource) error {
+			var req RemoteShutdownRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendRemoteShutdownRequest(&req, src)
+		}},
+		"40": {Send: func(payload []byte, src *CommandSource) error {
+			var req TransactionRecordConfirmedMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendTransactionRecordConfirmed(&req, src)
+		}},
+		"58": {Reply: "57", Send: func(payload []byte, src *CommandSource) error {
+			var req SetBillingModelRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendSetBillingModelRequestMessage(&req, src)
+		}},
+		"92": {Reply: "91", Send: func(payload []byte, src *CommandSource) error {
+			var req RemoteRebootRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendRemoteRebootRequest(&req, src)
+		}},
+		"52": {Reply: "51", Send: func(payload []byte, src *CommandSource) error {
+			var req SetWorkingParamsRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendSetWorkingParamsRequest(&req, src)
+		}},
+		"56": {Reply: "55", Send: func(payload []byte, src *CommandSource) error {
+			var req NtpRequestMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return SendNtpRequest(&req, src)
+		}},
+		"81": {Send: func(payload []byte, src *CommandSource) error {
+			var req DeviceLoginResponseMessage
+			if err := decodeCommand(payload, &req, &req.Header); err != nil {
+				return err
+			}
+			return ResponseToDeviceLogin(&req, src)
+		}},
+		//Huaping piles answer with the same command
+		"83": {Reply: "83", Send: func(payload []byte, src *CommandSource) error {
+			var req RemoteStartRequestMessage
+			if err := json.Unmarshal(payload, &req); err != nil {
+				return err
+			}
+			return SendRemoteStartRequest(&req, src)
+		}},
+		"84": {Reply: "84", Send: func(payload []byte, src *CommandSource) error {
+			var req RemoteStopRequestMessage
+			if err := json.Unmarshal(payload, &req); err != nil {
+				return err
+			}
+			return SendRemoteStopRequest(&req, src)
+		}},
+	}
+}
+
+// decodeCommand unmarshals a json command body and makes sure it carries a
+// header, since every Pack* function dereferences it.
+func decodeCommand(payload []byte, req interface{}, header **Header) error {
+	if err := json.Unmarshal(payload, req); err != nil {
+		return err
+	}
+	if *header == nil {
+		*header = &Header{}
+	}
+	return nil
+}
+
+// DispatchCommand sends a json encoded downlink command of the given frame
+// type to the pile it is addressed to, the frame is put down to src.
+func DispatchCommand(frameType string, payload []byte, src *CommandSource) error {
+	cmd, ok := downlinkCommands[frameType]
+	if !ok {
+		return ErrUnsupportedCommand
+	}
+	return cmd.Send(payload, src)
+}
+
+// CommandDeviceId returns the pile id a json encoded downlink command is
+// addressed to.
+func CommandDeviceId(payload []byte) string {
+	var v struct {
+		Id string `json:"id"`
+	}
+	_ = json.Unmarshal(payload, &v)
+	return v.Id
+}
+
+// CommandResult is the answer to a command sent as a request over the
+// messaging server.
+type CommandResult struct {
+	Status string         `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Reply  interface{}    `json:"reply,omitempty"`
+	Queued *QueuedCommand `json:"command,omitempty"`
+}
+
+const (
+	ResultSent    = "sent"
+	ResultReplied = "replied"
+	ResultTimeout = "timeout"
+	ResultFailed  = "failed"
+	ResultQueued  = "queued"
+)
+
+// replyWaiters holds, per pile and reply frame type, the requests waiting
+// for the pile's answer, oldest first.
+var replyWaiters = struct {
+	sync.Mutex
+	m map[string][]chan interface{}
+}{m: make(map[string][]chan interface{})}
+
+// AwaitReply registers for the next reply of the given frame type from a
+// pile. The returned function must be called once the reply is no longer
+// waited for.
+func AwaitReply(deviceId string, replyFrameType string) (<-chan interface{}, func()) {
+	key := deviceId + "/" + replyFrameType
+	ch := make(chan interface{}, 1)
+	replyWaiters.Lock()
+	replyWaiters.m[key] = append(replyWaiters.m[key], ch)
+	replyWaiters.Unlock()
+	return ch, func() {
+		replyWaiters.Lock()
+		defer replyWaiters.Unlock()
+		waiters := replyWaiters.m[key]
+		for i, w := range waiters {
+			if w == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(replyWaiters.m, key)
+		} else {
+			replyWaiters.m[key] = waiters
+		}
+	}
+}
+
+// notifyReply hands a reply to the oldest request waiting for it.
+func notifyReply(deviceId string, replyFrameType string, reply interface{}) {
+	key := deviceId + "/" + replyFrameType
+	replyWaiters.Lock()
+	defer replyWaiters.Unlock()
+	waiters := replyWaiters.m[key]
+	if len(waiters) == 0 {
+		return
+	}
+	waiters[0] <- reply
+	if len(waiters) == 1 {
+		delete(replyWaiters.m, key)
+	} else {
+		replyWaiters.m[key] = waiters[1:]
+	}
+}
+
+// ExecuteCommand sends a command and waits up to timeout for the pile's
+// reply, if the command has one. With the command queue enabled the command
+// is only queued.
+func ExecuteCommand(frameType string, payload []byte, timeout time.Duration, src *CommandSource) *CommandResult {
+	cmd, ok := downlinkCommands[frameType]
+	if !ok {
+		return &CommandResult{Status: ResultFailed, Error: ErrUnsupportedCommand.Error()}
+	}
+	if commandQueue != nil {
+		c, err := commandQueue.Enqueue(frameType, payload, 0, src)
+		if err != nil {
+			return &CommandResult{Status: ResultFailed, Error: err.Error()}
+		}
+		return &CommandResult{Status: ResultQueued, Queued: c}
+	}
+	if cmd.Reply == "" {
+		if err := cmd.Send(payload, src); err != nil {
+			return &CommandResult{Status: ResultFailed, Error: err.Error()}
+		}
+		return &CommandResult{Status: ResultSent}
+	}
+
+	reply, cancel := AwaitReply(CommandDeviceId(payload), cmd.Reply)
+	defer cancel()
+	if err := cmd.Send(payload, src); err != nil {
+		return &CommandResult{Status: ResultFailed, Error: err.Error()}
+	}
+	select {
+	case r := <-reply:
+		return &CommandResult{Status: ResultReplied, Reply: r}
+	case <-time.After(timeout):
+		return &CommandResult{Status: ResultTimeout, Error: "no reply from device"}
+	}
+}
+
+// RequestSubscriber is implemented by forwarders whose messaging server
+// supports request/reply; the handler's result is sent back to the
+// requester.
+type RequestSubscriber interface {
+	SubscribeRequests(topic string, handler func(message []byte) []byte) error
+}
+
+// SubscribeCommands subscribes the forwarder to the topic cmd.<frameType> of
+// every downlink command, so the backend can send commands through the
+// messaging server instead of the http api. Commands go through the command
+// queue if it is enabled. Forwarders supporting request/reply answer with
+// the CommandResult, waiting up to replyTimeout for the pile. Forwarders
+// that can not subscribe are left alone.
+func SubscribeCommands(f MessageForwarder, replyTimeout time.Duration) error {
+	for frameType := range downlinkCommands {
+		frameType := frameType
+		if rs, ok := f.(RequestSubscriber); ok {
+			err := rs.SubscribeRequests("cmd."+frameType, func(message []byte) []byte {
+				var r *CommandResult
+				if m, err := commandMessage(frameType, message); err != nil {
+					r = &CommandResult{Status: ResultFailed, Error: err.Error()}
+				} else {
+					message = m
+					r = ExecuteCommand(frameType, message, replyTimeout, messagingSource)
+				}
+				auditMessagingCommand(frameType, message, r.Status, r.Error)
+				if r.Error != "" {
+					log.WithFields(log.Fields{
+						"frame_type": frameType,
+						"id":         CommandDeviceId(message),
+						"status":     r.Status,
+					}).Errorf("error handling command: %s", r.Error)
+				}
+				b, _ := json.Marshal(r)
+				return b
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := f.Subscribe("cmd."+frameType, func(message []byte) {
+			payload, err := commandMessage(frameType, message)
+			if err == nil && commandQueue != nil {
+				_, err = commandQueue.Enqueue(frameType, payload, 0, messagingSource)
+			} else if err == nil {
+				err = DispatchCommand(frameType, payload, messagingSource)
+			}
+			if err != nil {
+				auditMessagingCommand(frameType, message, ResultFailed, err.Error())
+			} else {
+				auditMessagingCommand(frameType, payload, "accepted", "")
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"frame_type": frameType,
+					"id":         CommandDeviceId(message),
+				}).Errorf("error handling command: %v", err)
+			}
+		})
+		if errors.Is(err, ErrSubscribeUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandMessage decodes a command taken from the messaging server, which
+// may be protobuf encoded, and checks it against the schema of its frame
+// type.
+func commandMessage(frameType string, message []byte) ([]byte, error) {
+	message, err := DecodeMessage(frameType, message)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := LookupCommandSchema(frameType); ok {
+		if errs := s.Validate(message); len(errs) > 0 {
+			return nil, errors.New("invalid command: " + strings.Join(errs, "; "))
+		}
+	}
+	return message, nil
+}
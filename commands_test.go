@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecuteCommandWaitsForReply(t *testing.T) {
+	id := "32010600213533"
+	server, device := net.Pipe()
+	defer server.Close()
+	StoreClient(id, server)
+	defer clients.Delete(id)
+
+	// answer the remote start once it reaches the pile
+	go func() {
+		buf := make([]byte, 256)
+		_, _ = device.Read(buf)
+		ResolveCommand(id, "33", &RemoteBootstrapResponseMessage{Id: id, GunId: "01", Result: true})
+		_, _ = io.Copy(io.Discard, device)
+	}()
+
+	r := ExecuteCommand("34", []byte(`{"id":"`+id+`","gunId":"01"}`), time.Second, nil)
+	if r.Status != ResultReplied {
+		t.Fatalf("expected replied, got %s (%s)", r.Status, r.Error)
+	}
+	if reply, ok := r.Reply.(*RemoteBootstrapResponseMessage); !ok || !reply.Result {
+		t.Errorf("unexpected reply %#v", r.Reply)
+	}
+	if len(replyWaiters.m) != 0 {
+		t.Errorf("waiters left behind: %v", replyWaiters.m)
+	}
+}
+
+func TestExecuteCommandTimesOut(t *testing.T) {
+	id := "32010600213534"
+	server, device := net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, device) }()
+	StoreClient(id, server)
+	defer clients.Delete(id)
+
+	r := ExecuteCommand("92", []byte(`{"id":"`+id+`","control":1}`), 10*time.Millisecond, nil)
+	if r.Status != ResultTimeout {
+		t.Fatalf("expected timeout, got %s", r.Status)
+	}
+	// a late reply must not block
+	ResolveCommand(id, "91", nil)
+
+	if r := ExecuteCommand("92", []byte(`{"id":"00000000000000"}`), time.Second, nil); r.Status != ResultFailed {
+		t.Errorf("expected offline pile to fail, got %s", r.Status)
+	}
+	if r := ExecuteCommand("ff", []byte(`{}`), time.Second, nil); r.Status != ResultFailed {
+		t.Errorf("expected unsupported command to fail, got %s", r.Status)
+	}
+}
+
+func TestRemoteStartPort(t *testing.T) {
+	imei := "861435073900843"
+	server, device := net.Pipe()
+	defer server.Close()
+	StoreClient(imei, server)
+	defer clients.Delete(imei)
+
+	opt := &Options{CommandReplyTimeout: time.Second}
+	frame := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 256)
+		n, _ := device.Read(buf)
+		frame <- buf[:n]
+		//the pile answers: port 1, order number 7, started
+		go func() { _ = drain(opt, server, nil) }()
+		_, _ = device.Write(PackHuapingFrame(RemoteStart, imei, []byte{0x01, 0x07, 0x00, 0x00, 0x00, 0x00}))
+		_, _ = io.Copy(io.Discard, device)
+	}()
+
+	s, _ := NewServer(opt)
+	r := s.newHttpRouter()
+	w := httptest.NewRecorder()
+	body := `{"orderNumber":7,"paymentMode":3,"chargingMode":5,"chargingParam":1000,"balance":100}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/"+imei+"/ports/1/start", strings.NewReader(body)))
+	var res struct {
+		Status string                  `json:"status"`
+		Reply  PortCommandReplyMessage `json:"reply"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != 200 || res.Status != ResultReplied || res.Reply.OrderNumber != 7 || res.Reply.Port != 1 || res.Reply.Result != 0 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	want := []byte{0x5a, 0xa5, 0x16, 0x00, 0x83, 0x00}
+	want = append(want, imei...)
+	want = append(want, 0x01, 0x07, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x05,
+		0xe8, 0x03, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00)
+	want = append(want, 0x05)
+	if got := <-frame; !bytes.Equal(got, want) {
+		t.Fatalf("unexpected frame % x", got)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/"+imei+"/ports/1/stop", strings.NewReader(`{}`)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "orderNumber: is required") {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/861435073900999/ports/1/stop", strings.NewReader(`{"orderNumber":7}`)))
+	if w.Code != 404 {
+		t.Fatalf("offline pile answered with %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHuapingFrameLength(t *testing.T) {
+	//frames taken by piles in the field: the login reply the proxy sends and
+	//a remote start sent before the IMEI was added to the frame
+	for _, tc := range []struct {
+		name  string
+		got   []byte
+		field string
+	}{
+		{"81", PackHuapingFrame(DeviceLogin, "", HexToBytes("0000000000000000f0")), "5aa50c0081000000000000000000f07d"},
+		{"83", PackHuapingFrame(RemoteStart, "", HexToBytes("0201000000010000000001e803000064000000")), "5aa5160083000201000000010000000001e803000064000000ed"},
+	} {
+		if field := HexToBytes(tc.field); !bytes.Equal(tc.got, field) {
+			t.Errorf("%s: got % x, want % x", tc.name, tc.got, field)
+		}
+	}
+
+	//the remote start sent today carries the IMEI, which the length leaves
+	//out and the checksum counts
+	field := append(HexToBytes("5aa516008300"), "861435073900843"...)
+	field = append(field, HexToBytes("0101010501030000000005e80300006400000006")...)
+	got := PackRemoteStartRequestMessage(&RemoteStartRequestMessage{Id: "861435073900843", Port: 1,
+		OrderNumber: 0x01050101, PaymentMode: 3, ChargingMode: 5, ChargingParam: 1000, Balance: 100})
+	if !bytes.Equal(got, field) {
+		t.Fatalf("got % x, want % x", got, field)
+	}
+	stop := PackRemoteStopRequestMessage(&RemoteStopRequestMessage{Id: "861435073900843", Port: 1, OrderNumber: 0x01050101})
+	field = append(HexToBytes("5aa508008400"), "861435073900843"...)
+	field = append(field, HexToBytes("0101010501a2")...)
+	if !bytes.Equal(stop, field) {
+		t.Fatalf("got % x, want % x", stop, field)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+
+	PROTO_FILE = "ykc/" + SCHEMA_VERSION + "/ykc.proto"
+)
+
+const (
+	PROTO_SERVICE = "Gateway"
+
+	protoEventMessage = "Event"
+)
+
+var (
+	protoOnce sync.Once
+	protoFile *descriptorpb.FileDescriptorProto
+	protoDesc protoreflect.FileDescriptor
+	protoErr  error
+)
+
+// protoDescriptors builds the protobuf messages from the message structs,
+// numbering the fields by their proto tags, and the gRPC service around
+// them: one method per downlink command returning <Rpc>Result, and Subscribe
+// streaming the uplink messages as Event.
+func protoDescriptors() (*descriptorpb.FileDescriptorProto, protoreflect.FileDescriptor, error) {
+	protoOnce.Do(func() {
+		fd := &descriptorpb.FileDescriptorProto{
+			Name:    proto.String(PROTO_FILE),
+			Package: proto.String(PROTO_PACKAGE),
+			Syntax:  proto.String("proto3"),
+		}
+		seen := make(map[reflect.Type]bool)
+		var add func(t reflect.Type)
+		add = func(t reflect.Type) {
+			if seen[t] {
+				return
+			}
+			seen[t] = true
+			md := &descriptorpb.DescriptorProto{Name: proto.String(t.Name())}
+			for _, f := range schemaFields(t) {
+				if f.Proto == 0 && protoErr == nil {
+					protoErr = fmt.Errorf("field %s of %s has no proto tag", f.Name, t.Name())
+				}
+				fdp := protoField(f.Name, f.Proto, nil)
+				ft := f.Type
+				if ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8 {
+					fdp.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					add(ft)
+					fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+					fdp.TypeName = proto.String(protoTypeName(ft.Name()))
+				} else {
+					fdp.Type = protoType(ft).Enum()
+				}
+				md.Field = append(md.Field, fdp)
+			}
+			fd.MessageType = append(fd.MessageType, md)
+		}
+		for i := range messageSchemas {
+			add(messageSchemas[i].Type)
+		}
+
+		str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+		service := &descriptorpb.ServiceDescriptorProto{Name: proto.String(PROTO_SERVICE)}
+		for _, s := range messageSchemas {
+			if s.Rpc == "" {
+				continue
+			}
+			result := &descriptorpb.DescriptorProto{
+				Name: proto.String(s.Rpc + "Result"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					protoField("status", 1, &str),
+					protoField("error", 2, &str),
+				},
+			}
+			if r, ok := LookupMessageSchema(downlinkCommands[s.FrameType].Reply); ok {
+				reply := protoField("reply", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum())
+				reply.TypeName = proto.String(protoTypeName(r.Type.Name()))
+				result.Field = append(result.Field, reply)
+			}
+			fd.MessageType = append(fd.MessageType, result)
+			service.Method = append(service.Method, &descriptorpb.MethodDescriptorProto{
+				Name:       proto.String(s.Rpc),
+				InputType:  proto.String(protoTypeName(s.Type.Name())),
+				OutputType: proto.String(protoTypeName(result.GetName())),
+			})
+		}
+
+		subscribe := &descriptorpb.DescriptorProto{
+			Name: proto.String("SubscribeRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				protoField("ids", 1, &str),
+				protoField("frameTypes", 2, &str),
+			},
+		}
+		for _, f := range subscribe.Field {
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		}
+		event := &descriptorpb.DescriptorProto{
+			Name: proto.String(protoEventMessage),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				protoField("frameType", 1, &str),
+				protoField("id", 2, &str),
+				protoField("time", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()),
+			},
+			OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("message")}},
+		}
+		inEvent := make(map[reflect.Type]bool)
+		for _, s := range messageSchemas {
+			if s.Downlink || inEvent[s.Type] {
+				continue
+			}
+			inEvent[s.Type] = true
+			f := protoField(protoOneofName(s.Type.Name()), s.Event, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum())
+			f.TypeName = proto.String(protoTypeName(s.Type.Name()))
+			f.OneofIndex = proto.Int32(0)
+			event.Field = append(event.Field, f)
+		}
+		sort.Slice(event.Field, func(i, j int) bool {
+			return event.Field[i].GetNumber() < event.Field[j].GetNumber()
+		})
+		fd.MessageType = append(fd.MessageType, subscribe, event)
+		service.Method = append(service.Method, &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String("Subscribe"),
+			InputType:       proto.String(protoTypeName(subscribe.GetName())),
+			OutputType:      proto.String(protoTypeName(event.GetName())),
+			ServerStreaming: proto.Bool(true),
+		})
+		fd.Service = append(fd.Service, service)
+
+		if protoErr != nil {
+			return
+		}
+		file, err := protodesc.NewFile(fd, nil)
+		if err != nil {
+			protoErr = err
+			return
+		}
+		protoFile = fd
+		protoDesc = file
+	})
+	return protoFile, protoDesc, protoErr
+}
+
+// protoField returns a singular field; the type is left to the caller if t
+// is nil.
+func protoField(jsonName string, number int, t *descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(protoName(jsonName)),
+		JsonName: proto.String(jsonName),
+		Number:   proto.Int32(int32(number)),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:     t,
+	}
+}
+
+func protoTypeName(name string) string {
+	return "." + PROTO_PACKAGE + "." + name
+}
+
+// protoOneofName names the Event field of a message, e.g. transactionRecord
+// for TransactionRecordMessage.
+func protoOneofName(typeName string) string {
+	name := strings.TrimSuffix(typeName, "Message")
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// protoMessage returns the protobuf message forwarded for a frame type.
+func protoMessage(mid string) (protoreflect.MessageDescriptor, error) {
+	ms, ok := LookupMessageSchema(mid)
+	return protoSchemaMessage(mid, ms, ok)
+}
+
+// protoCommand returns the protobuf message of the command of a frame type.
+func protoCommand(mid string) (protoreflect.MessageDescriptor, error) {
+	ms, ok := LookupCommandSchema(mid)
+	return protoSchemaMessage(mid, ms, ok)
+}
+
+func protoSchemaMessage(mid string, ms *MessageSchema, ok bool) (protoreflect.MessageDescriptor, error) {
+	_, fd, err := protoDescriptors()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no protobuf message for frame type %s", mid)
+	}
+	return fd.Messages().ByName(protoreflect.Name(ms.Type.Name())), nil
+}
+
+func protoType(t reflect.Type) descriptorpb.FieldDescriptorProto_Type {
+	switch t.Kind() {
+	case reflect.String:
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING
+	case reflect.Bool:
+		return descriptorpb.FieldDescriptorProto_TYPE_BOOL
+	case reflect.Slice:
+		return descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	case reflect.Float32, reflect.Float64:
+		return descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return descriptorpb.FieldDescriptorProto_TYPE_INT32
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return descriptorpb.FieldDescriptorProto_TYPE_UINT32
+	case reflect.Uint, reflect.Uint64:
+		return descriptorpb.FieldDescriptorProto_TYPE_UINT64
+	default:
+		return descriptorpb.FieldDescriptorProto_TYPE_INT64
+	}
+}
+
+// ProtoDefinition renders the protobuf messages and the gRPC service as
+// .proto file.
+func ProtoDefinition() (string, error) {
+	fd, _, err := protoDescriptors()
+	if err != nil {
+		return "", err
+	}
+	comments := map[string]string{
+		"SubscribeRequest": "selects the events of Subscribe, empty lists select all",
+		protoEventMessage:  "uplink message as streamed by Subscribe, time in unix milliseconds",
+		PROTO_SERVICE:      "sends commands to piles and streams their messages",
+		"Subscribe":        "streams the uplink messages of the selected piles and frame types",
+	}
+	for _, s := range messageSchemas {
+		if c, ok := comments[s.Type.Name()]; ok {
+			comments[s.Type.Name()] = c + " and " + s.FrameType
+		} else {
+			comments[s.Type.Name()] = fmt.Sprintf("%s message, frame type %s", s.direction(), s.FrameType)
+		}
+		if s.Rpc != "" {
+			comments[s.Rpc] = "sends frame type " + s.FrameType
+			comments[s.Rpc+"Result"] = "result of " + s.Rpc + ", status is one of sent, replied, timeout, failed or queued"
+			if r := downlinkCommands[s.FrameType].Reply; r != "" {
+				comments[s.Rpc] += " and waits for the reply " + r
+			}
+		}
+	}
+	comment := func(b *strings.Builder, indent string, name string) {
+		if c, ok := comments[name]; ok {
+			b.WriteString(indent + "// " + c + "\n")
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("// Code generated by ykc-proxy-server from its message types. DO NOT EDIT.\n\n")
+	b.WriteString("syntax = \"proto3\";\n\n")
+	b.WriteString("package " + PROTO_PACKAGE + ";\n")
+	for _, md := range fd.MessageType {
+		b.WriteString("\n")
+		comment(&b, "", md.GetName())
+		b.WriteString("message " + md.GetName() + " {\n")
+		inOneof := false
+		for _, f := range md.Field {
+			indent := "  "
+			if f.OneofIndex != nil {
+				if !inOneof {
+					b.WriteString("  oneof " + md.OneofDecl[f.GetOneofIndex()].GetName() + " {\n")
+					inOneof = true
+				}
+				indent = "    "
+			}
+			b.WriteString(indent)
+			if f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED {
+				b.WriteString("repeated ")
+			}
+			if f.GetType() == descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+				b.WriteString(strings.TrimPrefix(f.GetTypeName(), "."+PROTO_PACKAGE+"."))
+			} else {
+				b.WriteString(strings.ToLower(strings.TrimPrefix(f.GetType().String(), "TYPE_")))
+			}
+			fmt.Fprintf(&b, " %s = %d", f.GetName(), f.GetNumber())
+			if f.GetJsonName() != lowerCamel(f.GetName()) {
+				fmt.Fprintf(&b, " [json_name = %q]", f.GetJsonName())
+			}
+			b.WriteString(";\n")
+		}
+		if inOneof {
+			b.WriteString("  }\n")
+		}
+		b.WriteString("}\n")
+	}
+	for _, sd := range fd.Service {
+		b.WriteString("\n")
+		comment(&b, "", sd.GetName())
+		b.WriteString("service " + sd.GetName() + " {\n")
+		for _, m := range sd.Method {
+			comment(&b, "  ", m.GetName())
+			out := strings.TrimPrefix(m.GetOutputType(), "."+PROTO_PACKAGE+".")
+			if m.GetServerStreaming() {
+				out = "stream " + out
+			}
+			fmt.Fprintf(&b, "  rpc %s(%s) returns (%s);\n", m.GetName(), strings.TrimPrefix(m.GetInputType(), "."+PROTO_PACKAGE+"."), out)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String(), nil
+}
+
+// lowerCamel is the json name protoc derives from a field name.
+func lowerCamel(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = []rune(strings.ToUpper(string(r)))[0]
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ProtoContentType is the content type of a protobuf encoded message.
+func ProtoContentType(mid string) string {
+	s, ok := LookupMessageSchema(mid)
+	if !ok {
+		return "application/protobuf"
+	}
+	return "application/protobuf; proto=" + PROTO_PACKAGE + "." + s.Type.Name()
+}
+
+// EncodeMessage converts a json message to the wire encoding and returns its
+// content type, empty for json. Structured CloudEvents stay json, their data
+// is carried as data_base64.
+func EncodeMessage(encoding string, mid string, message []byte) ([]byte, string, error) {
+	if encoding != EncodingProtobuf {
+		return message, "", nil
+	}
+	if !IsCloudEvent(message) {
+		b, err := encodeProtobuf(mid, message)
+		return b, ProtoContentType(mid), err
+	}
+	var e map[string]json.RawMessage
+	if err := json.Unmarshal(message, &e); err != nil {
+		return nil, "", err
+	}
+	b, err := encodeProtobuf(mid, e["data"])
+	if err != nil {
+		return nil, "", err
+	}
+	delete(e, "data")
+	e["data_base64"], _ = json.Marshal(base64.StdEncoding.EncodeToString(b))
+	e["datacontenttype"], _ = json.Marshal(ProtoContentType(mid))
+	b, err = json.Marshal(e)
+	return b, "", err
+}
+
+func encodeProtobuf(mid string, message []byte) ([]byte, error) {
+	md, err := protoMessage(mid)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(message, m); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+// DecodeMessage turns a protobuf encoded command back into json. Messages
+// that already are json are returned as they are.
+func DecodeMessage(mid string, message []byte) ([]byte, error) {
+	if b := bytes.TrimSpace(message); len(b) > 0 && b[0] == '{' {
+		return message, nil
+	}
+	md, err := protoCommand(mid)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(message, m); err != nil {
+		return nil, errors.New("neither json nor protobuf: " + err.Error())
+	}
+	// protojson would quote 64 bit integers, which encoding/json does not read
+	return json.Marshal(protoMap(m))
+}
+
+func protoMap(m protoreflect.Message) map[string]interface{} {
+	out := make(map[string]interface{})
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.IsList() {
+			l := v.List()
+			items := make([]interface{}, l.Len())
+			for i := range items {
+				items[i] = protoValue(fd, l.Get(i))
+			}
+			out[fd.JSONName()] = items
+		} else {
+			out[fd.JSONName()] = protoValue(fd, v)
+		}
+		return true
+	})
+	return out
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	if fd.Kind() == protoreflect.MessageKind {
+		return protoMap(v.Message())
+	}
+	return v.Interface()
+}
+
+// wireMessage returns what a forwarder puts on the wire for a json message:
+// the message in the wire encoding, and headers carrying the CloudEvents
+// attributes (see cloudEventsHeaders) and the content type.
+func wireMessage(encoding string, mid string, message []byte, attrs map[string]string, prefix string, contentType string) ([]byte, map[string]string, error) {
+	headers := cloudEventsHeaders(message, attrs, prefix, contentType)
+	b, ct, err := EncodeMessage(encoding, mid, message)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ct != "" {
+		headers[contentType] = ct
+	}
+	return b, headers, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DirectionUplink   = "uplink"
+	DirectionDownlink = "downlink"
+
+	// size of the buffer of a live subscriber; events for a subscriber that
+	// falls further behind are dropped
+	eventBuffer = 64
+
+	eventKeepAlive    = 15 * time.Second
+	eventWriteTimeout = 10 * time.Second
+)
+
+// Event is a message sent by or to a pile, as handed to live subscribers.
+// Raw is the frame as hex bytes, if there is one.
+type Event struct {
+	Direction string          `json:"direction"`
+	FrameType string          `json:"frameType"`
+	Id        string          `json:"id"`
+	Time      int64           `json:"time"`
+	Message   json.RawMessage `json:"message"`
+	Raw       []string        `json:"raw,omitempty"`
+}
+
+// EventFilter selects events by pile id, frame type and direction, an empty
+// value matches everything.
+type EventFilter struct {
+	Ids        []string
+	FrameTypes []string
+	Direction  string
+}
+
+func (f EventFilter) matches(e *Event) bool {
+	return matchesAny(f.Ids, e.Id) && matchesAny(f.FrameTypes, e.FrameType) &&
+		(f.Direction == "" || f.Direction == e.Direction)
+}
+
+func matchesAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, s := range values {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventSubscription receives the events matching its filter on C.
+type EventSubscription struct {
+	C      chan *Event
+	filter EventFilter
+}
+
+// EventHub fans the traffic of the piles out to live subscribers. Publishing
+// never blocks on a slow subscriber.
+type EventHub struct {
+	mu   sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}
+
+var events = &EventHub{subs: make(map[*EventSubscription]struct{})}
+
+// Subscribe registers for the events matching filter. The returned function
+// ends the subscription.
+func (h *EventHub) Subscribe(filter EventFilter) (*EventSubscription, func()) {
+	s := &EventSubscription{C: make(chan *Event, eventBuffer), filter: filter}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s, func() {
+		h.mu.Lock()
+		delete(h.subs, s)
+		h.mu.Unlock()
+	}
+}
+
+// Active reports whether anybody is listening, so events need not be built
+// for nobody.
+func (h *EventHub) Active() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs) > 0
+}
+
+func (h *EventHub) Publish(e *Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.filter.matches(e) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			log.WithFields(log.Fields{
+				"frame_type": e.FrameType,
+				"id":         e.Id,
+			}).Warn("live subscriber too slow, event dropped")
+		}
+	}
+}
+
+// PublishUplink hands a message received from a pile to the live
+// subscribers. raw is the frame as hex bytes, may be nil.
+func PublishUplink(conn net.Conn, frameType string, msg interface{}, raw []string) {
+	publishTraffic(DirectionUplink, conn, frameType, msg, raw, nil)
+}
+
+// PublishDownlink hands a frame sent to a pile for src to the live
+// subscribers.
+func PublishDownlink(conn net.Conn, frameType string, msg interface{}, frame []byte, src *CommandSource) {
+	if !events.Active() && frameHistory == nil && store == nil {
+		return
+	}
+	if src == nil {
+		src = autoSource
+	}
+	publishTraffic(DirectionDownlink, conn, frameType, msg, BytesToHex(frame), src)
+}
+
+// publishTraffic takes the pile id from the message, or from the connection
+// for frames not carrying one. The frame is kept in the frame history and
+// the store too, a downlink frame put down to src.
+func publishTraffic(direction string, conn net.Conn, frameType string, msg interface{}, raw []string, src *CommandSource) {
+	if !events.Active() && frameHistory == nil && store == nil {
+		return
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	id := MessageDeviceId(b)
+	if id == "" && conn != nil {
+		id = ConnDeviceId(conn)
+	}
+	recordFrame(direction, id, frameType, b, raw, src)
+	storeFrame(direction, id, frameType, b, src)
+	if !events.Active() {
+		return
+	}
+	events.Publish(&Event{
+		Direction: direction,
+		FrameType: frameType,
+		Id:        id,
+		Time:      time.Now().UnixMilli(),
+		Message:   b,
+		Raw:       raw,
+	})
+}
+
+// EventForwarder hands every device message to the live subscribers of
+// events, as uplink, before passing it on to Forwarder, which may be nil if
+// messages are not forwarded anywhere else. The routers publish the traffic
+// of the piles themselves, this is for messages that do not pass them.
+type EventForwarder struct {
+	Forwarder MessageForwarder
+}
+
+func (h *EventForwarder) Connect() error {
+	return nil
+}
+
+func (h *EventForwarder) Publish(mid string, message []byte) error {
+	events.Publish(&Event{
+		Direction: DirectionUplink,
+		FrameType: mid,
+		Id:        MessageDeviceId(message),
+		Time:      time.Now().UnixMilli(),
+		Message:   MessageData(message),
+	})
+	if h.Forwarder == nil {
+		return nil
+	}
+	return h.Forwarder.Publish(mid, message)
+}
+
+func (h *EventForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	if h.Forwarder == nil {
+		return ErrSubscribeUnsupported
+	}
+	return h.Forwarder.Subscribe(topic, handler)
+}
+
+func (h *EventForwarder) PublishDeviceStatus(id string, online bool) error {
+	if p, ok := h.Forwarder.(DeviceStatusPublisher); ok {
+		return p.PublishDeviceStatus(id, online)
+	}
+	return nil
+}
+
+func (h *EventForwarder) Close() error {
+	if h.Forwarder == nil {
+		return nil
+	}
+	return h.Forwarder.Close()
+}
+
+// the feed is read by consoles served from elsewhere, so any origin may
+// connect
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventQuery reads the filter of a live feed from the query: id and frameType
+// may be repeated or comma separated, direction is uplink or downlink. raw
+// tells whether the frames are sent as hex too. Callers scoped to some piles
+// only get theirs. A bad query is answered and ok is false.
+func eventQuery(c *gin.Context) (filter EventFilter, raw bool, ok bool) {
+	filter = EventFilter{
+		Ids:        queryList(c, "id"),
+		FrameTypes: queryList(c, "frameType"),
+		Direction:  c.Query("direction"),
+	}
+	if filter.Direction != "" && filter.Direction != DirectionUplink && filter.Direction != DirectionDownlink {
+		c.JSON(400, gin.H{"message": "direction must be uplink or downlink"})
+		return filter, false, false
+	}
+	ids, ok := callerOf(c).Scope(filter.Ids)
+	if !ok {
+		c.JSON(403, gin.H{"message": "no access to some of the devices"})
+		return filter, false, false
+	}
+	filter.Ids = ids
+	return filter, c.Query("raw") == "true", true
+}
+
+func queryList(c *gin.Context, key string) []string {
+	var values []string
+	for _, v := range c.QueryArray(key) {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func liveEvent(e *Event, raw bool) *Event {
+	if raw || e.Raw == nil {
+		return e
+	}
+	v := *e
+	v.Raw = nil
+	return &v
+}
+
+// EventsRouter streams the traffic of the piles as server-sent events, the
+// event type is the direction.
+func (s *Server) EventsRouter(c *gin.Context) {
+	filter, raw, ok := eventQuery(c)
+	if !ok {
+		return
+	}
+	sub, cancel := events.Subscribe(filter)
+	defer cancel()
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-sub.C:
+			c.SSEvent(e.Direction, liveEvent(e, raw))
+			return true
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		case <-s.QuitCh:
+			return false
+		}
+	})
+}
+
+// DeviceEventsWsRouter streams the traffic of one pile over a WebSocket, one
+// json event per message. It takes the query of EventsRouter but for id.
+func (s *Server) DeviceEventsWsRouter(c *gin.Context) {
+	filter, raw, ok := eventQuery(c)
+	if !ok {
+		return
+	}
+	filter.Ids = []string{c.Param("id")}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//the upgrader has answered already
+		return
+	}
+	defer conn.Close()
+	sub, cancel := events.Subscribe(filter)
+	defer cancel()
+
+	//nothing is expected from the client, reading only notices it leaving
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case e := <-sub.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(liveEvent(e, raw)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-s.QuitCh:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(eventWriteTimeout))
+			return
+		}
+	}
+}
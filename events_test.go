@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func waitForSubscriber(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !events.Active() {
+		if time.Now().After(deadline) {
+			t.Fatal("no subscriber")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	s, _ := NewServer(&Options{})
+	srv := httptest.NewServer(s.newHttpRouter())
+	defer srv.Close()
+	defer close(s.QuitCh)
+
+	resp, err := http.Get(srv.URL + "/events?frameType=91&id=32010600213533")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waitForSubscriber(t)
+	PublishUplink(nil, "35", &RemoteShutdownResponseMessage{Id: "32010600213533"}, nil)
+	PublishUplink(nil, "91", &RemoteRebootResponseMessage{Id: "32010600213534", Result: 1}, nil)
+	PublishUplink(nil, "91", &RemoteRebootResponseMessage{Id: "32010600213533", Result: 1}, []string{"68", "0c"})
+
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event:uplink" || !strings.Contains(lines[1], `"id":"32010600213533"`) || strings.Contains(lines[1], "raw") {
+		t.Fatalf("unexpected event %q", lines)
+	}
+}
+
+func TestDeviceEventsWebSocket(t *testing.T) {
+	s, _ := NewServer(&Options{})
+	srv := httptest.NewServer(s.newHttpRouter())
+	defer srv.Close()
+	defer close(s.QuitCh)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/devices/32010600213533?raw=true&direction=downlink"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForSubscriber(t)
+	req := &RemoteRebootRequestMessage{Header: &Header{}, Id: "32010600213533", Control: 1}
+	PublishUplink(nil, "91", &RemoteRebootResponseMessage{Id: "32010600213533", Result: 1}, nil)
+	PublishDownlink(nil, "92", req, PackRemoteRebootRequestMessage(req), nil)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e Event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	var msg RemoteRebootRequestMessage
+	_ = json.Unmarshal(e.Message, &msg)
+	if e.Direction != DirectionDownlink || e.FrameType != "92" || msg.Control != 1 || len(e.Raw) == 0 || e.Raw[0] != "68" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"github.com/go-resty/resty/v2"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/nats-io/nats.go"
-	"math/rand"
 	"strings"
 	"time"
 )
@@ -11,8 +12,14 @@ import log "github.com/sirupsen/logrus"
 
 const (
 	NATS_PUBLISH_SUBJECT_PREFIX = "charge.proxy.ykc"
+	// gateways subscribing to commands share them as one queue group
+	NATS_QUEUE_GROUP = "ykc-proxy-server"
+	// window in which JetStream drops messages with a known message id
+	natsDuplicateWindow = 24 * time.Hour
 )
 
+var ErrSubscribeUnsupported = errors.New("forwarder does not support subscriptions")
+
 type MessageForwarder interface {
 	Connect() error
 	Publish(mid string, message []byte) error
@@ -20,92 +27,228 @@ type MessageForwarder interface {
 	Close() error
 }
 
-type HTTPForwarder struct {
-	Endpoints []string
-}
-
-func (h *HTTPForwarder) Connect() error {
-	panic("implement me")
-}
-
-func (h *HTTPForwarder) Subscribe(topic string, handler func(message []byte)) error {
-	panic("implement me")
-}
-
-func (h *HTTPForwarder) Close() error {
-	panic("implement me")
-}
-
-func (h *HTTPForwarder) Publish(mid string, message []byte) error {
-	//get random endpoint
-	rand.Seed(time.Now().UnixNano())
-	randomIndex := rand.Intn(len(h.Endpoints))
-	e := h.Endpoints[randomIndex]
-	if strings.HasSuffix(e, "/") {
-		e = e[:len(e)-1]
+// NewForwarder creates and connects a forwarder of the given kind: http,
+// nats, jetstream, kafka, rabbitmq or mqtt. Settings other than the servers
+// and credentials are taken from opt.
+func NewForwarder(kind string, servers []string, username string, password string, opt *Options) (MessageForwarder, error) {
+	var f MessageForwarder
+	switch kind {
+	case "http":
+		f = &HTTPForwarder{
+			Endpoints: servers,
+			Headers:   opt.HttpHeaders,
+			Username:  username,
+			Password:  password,
+			Secret:    opt.HttpSecret,
+			Timeout:   opt.HttpTimeout,
+			Retries:   opt.HttpRetries,
+			Encoding:  opt.Encoding,
+		}
+	case "nats", "jetstream":
+		f = &NatsForwarder{
+			Servers:   strings.Join(servers, ","),
+			Username:  username,
+			Password:  password,
+			JetStream: kind == "jetstream" || opt.NatsJetStream,
+			Stream:    opt.NatsStream,
+			Encoding:  opt.Encoding,
+		}
+	case "kafka":
+		f = &KafkaForwarder{
+			Brokers:     servers,
+			Topic:       opt.KafkaTopic,
+			TopicPrefix: NATS_PUBLISH_SUBJECT_PREFIX,
+			Acks:        opt.KafkaAcks,
+			Compression: opt.KafkaCompression,
+			GroupId:     opt.KafkaGroupId,
+			Username:    username,
+			Password:    password,
+			Encoding:    opt.Encoding,
+		}
+	case "rabbitmq":
+		f = &RabbitForwarder{
+			Servers:      servers,
+			Username:     username,
+			Password:     password,
+			Exchange:     opt.RabbitExchange,
+			CommandQueue: opt.RabbitCommandQueue,
+			Encoding:     opt.Encoding,
+		}
+	case "mqtt":
+		f = &MqttForwarder{
+			Servers:  servers,
+			Username: username,
+			Password: password,
+			ClientId: opt.MqttClientId,
+			Qos:      byte(opt.MqttQos),
+			Version:  opt.MqttVersion,
+			Encoding: opt.Encoding,
+		}
+	case "redis":
+		f = &RedisForwarder{
+			Servers:      servers,
+			Username:     username,
+			Password:     password,
+			StreamPrefix: NATS_PUBLISH_SUBJECT_PREFIX,
+			MaxLen:       opt.RedisMaxLen,
+			Group:        opt.RedisGroup,
+			Consumer:     opt.RedisConsumer,
+			Encoding:     opt.Encoding,
+		}
+	default:
+		return nil, fmt.Errorf("unknown messaging server type %q", kind)
 	}
-
-	e = e + "/" + mid
-
-	log.WithFields(log.Fields{
-		"mid":      mid,
-		"endpoint": e,
-	}).Info("forwarding message to http endpoint")
-
-	client := resty.New()
-	var res string
-	client.SetTimeout(3 * time.Second)
-	_, err := client.R().
-		SetHeader("Content-Type", "application/json").
-		SetResult(&res).
-		SetBody(message).
-		Post(e)
-	if err != nil {
-		log.Errorf("error forwarding message: %v", err)
-		return err
+	if err := f.Connect(); err != nil {
+		return nil, err
 	}
-	log.WithFields(log.Fields{
-		"http_response": res,
-	}).Info("response from http forwarder")
-
-	return nil
+	return f, nil
 }
 
-type KafkaForwarder struct {
-	// ...
-}
-type RabbitForwarder struct {
-	// ...
+// MessageDeviceId returns the pile id of a json encoded message, used as
+// partition key or routing key by forwarders. Field names are matched case
+// insensitively, so both "id" and "Id" are found. A CloudEvent is looked
+// into.
+func MessageDeviceId(message []byte) string {
+	var v struct {
+		Id string `json:"id"`
+	}
+	_ = json.Unmarshal(MessageData(message), &v)
+	return v.Id
 }
 
+// NatsForwarder publishes with core nats, or in JetStream mode to the stream
+// Stream, which captures charge.proxy.ykc.* and is created if missing. A
+// JetStream publish returns once the stream has stored the message.
 type NatsForwarder struct {
-	Servers  string
-	Username string
-	Password string
-	nc       *nats.Conn
+	Servers   string
+	Username  string
+	Password  string
+	JetStream bool
+	Stream    string
+	Encoding  string
+	nc        *nats.Conn
+	js        nats.JetStreamContext
 }
 
+// Subscribe listens on charge.proxy.ykc.<topic> in the gateways' queue group.
 func (h *NatsForwarder) Subscribe(topic string, handler func(message []byte)) error {
-	//TODO implement me
-	panic("implement me")
+	subject := NATS_PUBLISH_SUBJECT_PREFIX + "." + topic
+	_, err := h.nc.QueueSubscribe(subject, NATS_QUEUE_GROUP, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+	return err
+}
+
+// SubscribeRequests is Subscribe for request/reply: the handler's result is
+// sent to the reply subject, if the message has one. Each message is handled
+// on its own goroutine since the handler may wait for the pile.
+func (h *NatsForwarder) SubscribeRequests(topic string, handler func(message []byte) []byte) error {
+	subject := NATS_PUBLISH_SUBJECT_PREFIX + "." + topic
+	_, err := h.nc.QueueSubscribe(subject, NATS_QUEUE_GROUP, func(m *nats.Msg) {
+		go func() {
+			result := handler(m.Data)
+			if m.Reply == "" {
+				return
+			}
+			if err := m.Respond(result); err != nil {
+				log.Errorf("error replying to nats request on %s: %v", m.Subject, err)
+			}
+		}()
+	})
+	return err
 }
 
+// Close flushes pending publishes before closing the connection.
 func (h *NatsForwarder) Close() error {
+	err := h.nc.Flush()
 	h.nc.Close()
-	return nil
+	return err
 }
 
 func (h *NatsForwarder) Connect() error {
 	nc, err := nats.Connect(h.Servers, nats.UserInfo(h.Username, h.Password))
 	if err != nil {
-		log.Fatalf("can not connect to nats server, error: %s", err.Error())
+		return err
 	}
 	h.nc = nc
+	if h.JetStream {
+		return h.ensureStream()
+	}
+	return nil
+}
+
+// ensureStream creates the stream unless it exists. Commands are two tokens
+// below the prefix and thus not captured, so requests on them are not
+// answered by the stream.
+func (h *NatsForwarder) ensureStream() error {
+	js, err := h.nc.JetStream()
+	if err != nil {
+		return err
+	}
+	h.js = js
+	_, err = js.StreamInfo(h.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:       h.Stream,
+			Subjects:   []string{NATS_PUBLISH_SUBJECT_PREFIX + ".*"},
+			Storage:    nats.FileStorage,
+			Duplicates: natsDuplicateWindow,
+		})
+		if err == nil {
+			log.WithFields(log.Fields{
+				"stream": h.Stream,
+			}).Info("jetstream stream created")
+		}
+	}
 	return err
 }
 
 func (h *NatsForwarder) Publish(mid string, message []byte) error {
-	subject := NATS_PUBLISH_SUBJECT_PREFIX + "." + mid
-	err := h.nc.Publish(subject, message)
+	return h.PublishEvent(mid, message, nil)
+}
+
+// PublishEvent carries CloudEvents attributes as ce- headers.
+func (h *NatsForwarder) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	body, headers, err := wireMessage(h.Encoding, mid, message, attrs, "ce-", "Content-Type")
+	if err != nil {
+		return err
+	}
+	m := nats.NewMsg(NATS_PUBLISH_SUBJECT_PREFIX + "." + mid)
+	m.Data = body
+	for k, v := range headers {
+		m.Header.Set(k, v)
+	}
+	subject := m.Subject
+	if h.js == nil {
+		return h.nc.PublishMsg(m)
+	}
+	var opts []nats.PubOpt
+	if id := MessageDedupId(mid, message); id != "" {
+		opts = append(opts, nats.MsgId(id))
+	}
+	_, err = h.js.PublishMsg(m, opts...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mid":     mid,
+			"subject": subject,
+		}).Errorf("error publishing message to jetstream: %v", err)
+	}
 	return err
 }
+
+// MessageDedupId returns the id a message is deduplicated by, if the frame
+// type is sent once per charging session: the same transaction record
+// uploaded again by the pile carries the same trade sequence.
+func MessageDedupId(mid string, message []byte) string {
+	if mid != "3b" {
+		return ""
+	}
+	var v struct {
+		TradeSeq string `json:"tradeSeq"`
+	}
+	_ = json.Unmarshal(MessageData(message), &v)
+	if v.TradeSeq == "" {
+		return ""
+	}
+	return mid + "." + v.TradeSeq
+}
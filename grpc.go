@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcServiceDesc describes the Gateway service of the generated protobuf
+// definition (see ProtoDefinition). The messages are dynamic, so there is no
+// generated code to keep in sync with the message structs.
+func (s *Server) grpcServiceDesc() (*grpc.ServiceDesc, error) {
+	_, fd, err := protoDescriptors()
+	if err != nil {
+		return nil, err
+	}
+	sd := fd.Services().ByName(PROTO_SERVICE)
+	desc := &grpc.ServiceDesc{
+		ServiceName: string(sd.FullName()),
+		HandlerType: (*interface{})(nil),
+		Metadata:    PROTO_FILE,
+	}
+	for _, ms := range messageSchemas {
+		if ms.Rpc == "" {
+			continue
+		}
+		md := sd.Methods().ByName(protoreflect.Name(ms.Rpc))
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: ms.Rpc,
+			Handler:    s.grpcCommandHandler(ms.FrameType, md),
+		})
+	}
+	desc.Streams = []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		Handler:       s.grpcSubscribeHandler(sd.Methods().ByName("Subscribe")),
+		ServerStreams: true,
+	}}
+	return desc, nil
+}
+
+// grpcCommandHandler executes a command like the http api does, waiting up
+// to the command reply timeout (or the deadline of the call, if earlier)
+// for the pile's reply.
+func (s *Server) grpcCommandHandler(frameType string, md protoreflect.MethodDescriptor) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	handle := func(ctx context.Context, req interface{}) (interface{}, error) {
+		payload, err := json.Marshal(protoMap(req.(*dynamicpb.Message)))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if ms, ok := LookupCommandSchema(frameType); ok {
+			if errs := ms.Validate(payload); len(errs) > 0 {
+				return nil, status.Error(codes.InvalidArgument, "invalid command: "+strings.Join(errs, "; "))
+			}
+		}
+		timeout := s.Opt.CommandReplyTimeout
+		if d, ok := ctx.Deadline(); ok && time.Until(d) < timeout {
+			timeout = time.Until(d)
+		}
+		r := ExecuteCommand(frameType, payload, timeout, &CommandSource{Api: SourceGrpc, Caller: callerFrom(ctx).Name})
+		if r.Error != "" {
+			log.WithFields(log.Fields{
+				"frame_type": frameType,
+				"id":         CommandDeviceId(payload),
+				"status":     r.Status,
+			}).Errorf("error handling grpc command: %s", r.Error)
+		}
+		return protoCommandResult(md.Output(), r)
+	}
+	fullMethod := "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := dynamicpb.NewMessage(md.Input())
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return handle(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handle)
+	}
+}
+
+func protoCommandResult(md protoreflect.MessageDescriptor, r *CommandResult) (*dynamicpb.Message, error) {
+	res := dynamicpb.NewMessage(md)
+	res.Set(md.Fields().ByName("status"), protoreflect.ValueOfString(r.Status))
+	if r.Error != "" {
+		res.Set(md.Fields().ByName("error"), protoreflect.ValueOfString(r.Error))
+	}
+	if fd := md.Fields().ByName("reply"); fd != nil && r.Reply != nil {
+		b, err := json.Marshal(r.Reply)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		reply := dynamicpb.NewMessage(fd.Message())
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, reply); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		res.Set(fd, protoreflect.ValueOfMessage(reply))
+	}
+	return res, nil
+}
+
+// grpcSubscribeHandler streams the device messages matching the request
+// until the client goes away or the server stops.
+func (s *Server) grpcSubscribeHandler(md protoreflect.MethodDescriptor) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		req := dynamicpb.NewMessage(md.Input())
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		ids, ok := callerFrom(stream.Context()).Scope(protoStrings(req, "ids"))
+		if !ok {
+			return status.Error(codes.PermissionDenied, "no access to some of the devices")
+		}
+		filter := EventFilter{
+			Ids:        ids,
+			FrameTypes: protoStrings(req, "frame_types"),
+			Direction:  DirectionUplink,
+		}
+		sub, cancel := events.Subscribe(filter)
+		defer cancel()
+		for {
+			select {
+			case e := <-sub.C:
+				m, err := protoEvent(md.Output(), e)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"frame_type": e.FrameType,
+						"id":         e.Id,
+					}).Errorf("error encoding grpc event: %v", err)
+					continue
+				}
+				if err := stream.SendMsg(m); err != nil {
+					return err
+				}
+			case <-stream.Context().Done():
+				return nil
+			case <-s.QuitCh:
+				return status.Error(codes.Unavailable, "server is shutting down")
+			}
+		}
+	}
+}
+
+func protoStrings(m *dynamicpb.Message, field protoreflect.Name) []string {
+	l := m.Get(m.Descriptor().Fields().ByName(field)).List()
+	out := make([]string, l.Len())
+	for i := range out {
+		out[i] = l.Get(i).String()
+	}
+	return out
+}
+
+// protoEvent puts a device message into the Event oneof field of its type;
+// messages without one only carry frame type, id and time.
+func protoEvent(md protoreflect.MessageDescriptor, e *Event) (*dynamicpb.Message, error) {
+	m := dynamicpb.NewMessage(md)
+	m.Set(md.Fields().ByName("frame_type"), protoreflect.ValueOfString(e.FrameType))
+	m.Set(md.Fields().ByName("id"), protoreflect.ValueOfString(e.Id))
+	m.Set(md.Fields().ByName("time"), protoreflect.ValueOfInt64(e.Time))
+	ms, ok := LookupMessageSchema(e.FrameType)
+	if !ok || ms.Downlink {
+		return m, nil
+	}
+	fd := md.Fields().ByName(protoreflect.Name(protoName(protoOneofName(ms.Type.Name()))))
+	if fd == nil {
+		return m, nil
+	}
+	msg := dynamicpb.NewMessage(fd.Message())
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(e.Message, msg); err != nil {
+		return nil, err
+	}
+	m.Set(fd, protoreflect.ValueOfMessage(msg))
+	return m, nil
+}
+
+// StartGrpc serves the Gateway service on the configured grpc port, if any.
+func (s *Server) StartGrpc() {
+	o := s.Opt
+	if o.GrpcPort == 0 {
+		return
+	}
+	desc, err := s.grpcServiceDesc()
+	if err != nil {
+		log.Fatalf("Unable to build grpc service: %v", err)
+	}
+	port := o.GrpcPort
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		log.Fatalf("Unable to listen for grpc connections: %v", err)
+	}
+	if port == 0 {
+		o.GrpcPort = l.Addr().(*net.TCPAddr).Port
+	}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcAuthorizeCommand),
+		grpc.StreamInterceptor(grpcAuthorizeSubscribe),
+	)
+	srv.RegisterService(desc, s)
+	s.Mu.Lock()
+	s.grpcServer = srv
+	s.Mu.Unlock()
+	log.Infof("Grpc server listening on %s", hp)
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			log.Fatalf("Unable to serve grpc connections: %v", err)
+		}
+	}()
+}
+
+// grpcCaller authenticates a call from its authorization or x-api-key
+// metadata, like the http api does.
+func grpcCaller(ctx context.Context) (*Caller, error) {
+	if auth == nil {
+		return anonymous, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	c, err := auth.Authenticate(first(md.Get("authorization")), first(md.Get("x-api-key")))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return c, nil
+}
+
+// grpcAuthorizeCommand lets operators send commands to the piles in their
+// scope, and audits every command call.
+func grpcAuthorizeCommand(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	caller, err := grpcCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(protoMap(req.(*dynamicpb.Message)))
+	id := CommandDeviceId(payload)
+	var res interface{}
+	switch {
+	case !caller.Allows(RoleOperator):
+		err = status.Error(codes.PermissionDenied, "requires role "+RoleOperator)
+	case !caller.CanAccess(id):
+		err = status.Error(codes.PermissionDenied, "no access to device "+id)
+	default:
+		res, err = handler(withCaller(ctx, caller), req)
+	}
+	e := &AuditEntry{
+		Time:     time.Now(),
+		Caller:   caller.Name,
+		Role:     caller.Role,
+		Auth:     caller.Auth,
+		Api:      "grpc",
+		Command:  info.FullMethod,
+		DeviceId: id,
+		Payload:  payload,
+		Status:   status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.RemoteAddress = p.Addr.String()
+	}
+	if err != nil {
+		e.Error = status.Convert(err).Message()
+	}
+	auditLog.Record(e)
+	return res, err
+}
+
+// grpcAuthorizeSubscribe lets read-only callers and above subscribe, the
+// caller is handed on in the context of the stream.
+func grpcAuthorizeSubscribe(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	caller, err := grpcCaller(ss.Context())
+	if err != nil {
+		return err
+	}
+	if !caller.Allows(RoleReadOnly) {
+		return status.Error(codes.PermissionDenied, "requires role "+RoleReadOnly)
+	}
+	return handler(srv, &callerStream{ServerStream: ss, ctx: withCaller(ss.Context(), caller)})
+}
+
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *callerStream) Context() context.Context {
+	return s.ctx
+}
+
+// stopGrpc lets running calls finish until ctx is done, then cuts them off.
+func stopGrpc(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestGrpcGateway(t *testing.T) {
+	s, _ := NewServer(&Options{GrpcPort: -1, CommandReplyTimeout: time.Second})
+	s.StartGrpc()
+	defer s.Stop(context.Background())
+
+	conn, err := grpc.Dial(net.JoinHostPort("localhost", strconv.Itoa(s.Opt.GrpcPort)), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, fd, _ := protoDescriptors()
+	msg := func(name string, js string) *dynamicpb.Message {
+		m := dynamicpb.NewMessage(fd.Messages().ByName(protoreflect.Name(name)))
+		if js != "" {
+			if err := protojson.Unmarshal([]byte(js), m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the pile is not connected
+	res := msg("RemoteRebootResult", "")
+	err = conn.Invoke(ctx, "/ykc.v1.Gateway/RemoteReboot", msg("RemoteRebootRequestMessage", `{"id":"32010600213533","control":1}`), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Get(res.Descriptor().Fields().ByName("status")).String(); got != ResultFailed {
+		t.Fatalf("unexpected result %v", res)
+	}
+	err = conn.Invoke(ctx, "/ykc.v1.Gateway/RemoteReboot", msg("RemoteRebootRequestMessage", `{"control":1}`), res)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid command accepted: %v", err)
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/ykc.v1.Gateway/Subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(msg("SubscribeRequest", `{"frameTypes":["91"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.CloseSend()
+	for {
+		events.mu.RLock()
+		n := len(events.subs)
+		events.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f := &EventForwarder{}
+	_ = f.Publish("35", []byte(`{"id":"32010600213533","gunId":"01"}`))
+	_ = f.Publish("91", []byte(`{"id":"32010600213533","result":1}`))
+	e := msg("Event", "")
+	if err := stream.RecvMsg(e); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := protojson.Marshal(e)
+	fields := e.Descriptor().Fields()
+	reply := e.Get(fields.ByName("remote_reboot_response")).Message()
+	if e.Get(fields.ByName("frame_type")).String() != "91" || reply.Get(reply.Descriptor().Fields().ByName("result")).Int() != 1 {
+		t.Fatalf("unexpected event %s", b)
+	}
+}
+
+func TestGrpcStartPort(t *testing.T) {
+	imei := "861435073900844"
+	server, device := net.Pipe()
+	defer server.Close()
+	StoreClient(imei, server)
+	defer clients.Delete(imei)
+
+	s, _ := NewServer(&Options{GrpcPort: -1, CommandReplyTimeout: time.Second})
+	s.StartGrpc()
+	defer s.Stop(context.Background())
+	go func() {
+		buf := make([]byte, 256)
+		_, _ = device.Read(buf)
+		//the pile answers: port 2, order number 9, started
+		go func() { _ = drain(s.Opt, server, nil) }()
+		_, _ = device.Write(PackHuapingFrame(RemoteStart, imei, []byte{0x02, 0x09, 0x00, 0x00, 0x00, 0x00}))
+		_, _ = io.Copy(io.Discard, device)
+	}()
+
+	conn, err := grpc.Dial(net.JoinHostPort("localhost", strconv.Itoa(s.Opt.GrpcPort)), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, fd, _ := protoDescriptors()
+	req := dynamicpb.NewMessage(fd.Messages().ByName("RemoteStartRequestMessage"))
+	if err := protojson.Unmarshal([]byte(`{"id":"`+imei+`","port":2,"orderNumber":9,"chargingMode":5}`), req); err != nil {
+		t.Fatal(err)
+	}
+	res := dynamicpb.NewMessage(fd.Messages().ByName("StartPortResult"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Invoke(ctx, "/ykc.v1.Gateway/StartPort", req, res); err != nil {
+		t.Fatal(err)
+	}
+	fields := res.Descriptor().Fields()
+	reply := res.Get(fields.ByName("reply")).Message()
+	b, _ := protojson.Marshal(res)
+	if res.Get(fields.ByName("status")).String() != ResultReplied || reply.Get(reply.Descriptor().Fields().ByName("order_number")).Uint() != 9 {
+		t.Fatalf("unexpected result %s", b)
+	}
+}
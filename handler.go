@@ -2,7 +2,7 @@ package main
 
 import log "github.com/sirupsen/logrus"
 
-func ResponseToBillingModelVerification(req *BillingModelVerificationResponseMessage) error {
+func ResponseToBillingModelVerification(req *BillingModelVerificationResponseMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
@@ -16,117 +16,261 @@ func ResponseToBillingModelVerification(req *BillingModelVerificationResponseMes
 		"id":       req.Id,
 		"response": BytesToHex(resp),
 	}).Debug("[06] BillingModelVerificationResponse message sent")
+	PublishDownlink(c, "06", req, resp, src)
 	return nil
 }
 
-func ResponseToVerification(req *VerificationResponseMessage) error {
+func ResponseToVerification(req *VerificationResponseMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackVerificationResponseMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":       req.Id,
 		"response": BytesToHex(resp),
 	}).Debug("[02] VerificationResponse message sent")
+	PublishDownlink(c, "02", req, resp, src)
+
+	//a refused pile is disconnected, it logs in again when it is let in
+	if !req.Result {
+		_ = c.Close()
+		return nil
+	}
+	//deliver commands queued while the device was offline
+	if commandQueue != nil {
+		go commandQueue.Flush(req.Id)
+	}
 	return nil
 }
 
-func ResponseToHeartbeat(req *HeartbeatResponseMessage) error {
+// ResponseToDeviceLogin answers the login (81) of a Huaping pile.
+func ResponseToDeviceLogin(req *DeviceLoginResponseMessage, src *CommandSource) error {
+	c, err := GetClient(req.Id)
+	if err != nil {
+		return err
+	}
+	resp := PackDeviceLoginResponseMessage(req)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":       req.Id,
+		"response": BytesToHex(resp),
+	}).Debug("[81] DeviceLoginResponse message sent")
+	PublishDownlink(c, "81", req, resp, src)
+
+	if req.Result == DeviceLoginIllegal {
+		_ = c.Close()
+		return nil
+	}
+	if commandQueue != nil {
+		go commandQueue.Flush(req.Id)
+	}
+	return nil
+}
+
+func ResponseToHeartbeat(req *HeartbeatResponseMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackHeartbeatResponseMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":       req.Id,
 		"response": BytesToHex(resp),
 	}).Debug("[04] HeartbeatResponse message sent")
+	PublishDownlink(c, "04", req, resp, src)
 	return nil
 }
 
-func SendRemoteBootstrapRequest(req *RemoteBootstrapRequestMessage) error {
+func SendRemoteBootstrapRequest(req *RemoteBootstrapRequestMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackRemoteBootstrapRequestMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[34] RemoteBootstrapRequest message sent")
+	PublishDownlink(c, "34", req, resp, src)
 	return nil
 }
 
-func SendRemoteShutdownRequest(req *RemoteShutdownRequestMessage) error {
+func SendRemoteShutdownRequest(req *RemoteShutdownRequestMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackRemoteShutdownRequestMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[36] RemoteShutdownRequest message sent")
+	PublishDownlink(c, "36", req, resp, src)
 	return nil
 }
 
-func SendTransactionRecordConfirmed(req *TransactionRecordConfirmedMessage) error {
+func SendTransactionRecordConfirmed(req *TransactionRecordConfirmedMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackTransactionRecordConfirmedMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[40] TransactionRecordConfirmed message sent")
+	PublishDownlink(c, "40", req, resp, src)
 	return nil
 }
 
-func SendRemoteRebootRequest(req *RemoteRebootRequestMessage) error {
+func SendRemoteRebootRequest(req *RemoteRebootRequestMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackRemoteRebootRequestMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[92] RemoteRebootRequest message sent")
+	PublishDownlink(c, "92", req, resp, src)
+	return nil
+}
+
+func SendSetWorkingParamsRequest(req *SetWorkingParamsRequestMessage, src *CommandSource) error {
+	c, err := GetClient(req.Id)
+	if err != nil {
+		return err
+	}
+	resp := PackSetWorkingParamsRequestMessage(req)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":      req.Id,
+		"request": BytesToHex(resp),
+	}).Debug("[52] SetWorkingParamsRequest message sent")
+	PublishDownlink(c, "52", req, resp, src)
 	return nil
 }
 
-func SendSetBillingModelRequestMessage(req *SetBillingModelRequestMessage) error {
+func SendNtpRequest(req *NtpRequestMessage, src *CommandSource) error {
+	c, err := GetClient(req.Id)
+	if err != nil {
+		return err
+	}
+	resp := PackNtpRequestMessage(req)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":      req.Id,
+		"request": BytesToHex(resp),
+	}).Debug("[56] NtpRequest message sent")
+	PublishDownlink(c, "56", req, resp, src)
+	return nil
+}
+
+func SendSetBillingModelRequestMessage(req *SetBillingModelRequestMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackSetBillingModelRequestMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[58] SetBillingModelRequest message sent")
+	PublishDownlink(c, "58", req, resp, src)
 	return nil
 }
 
-func SendBillingModelResponseMessage(req *BillingModelResponseMessage) error {
+func SendBillingModelResponseMessage(req *BillingModelResponseMessage, src *CommandSource) error {
 	c, err := GetClient(req.Id)
 	if err != nil {
 		return err
 	}
 	resp := PackBillingModelResponseMessage(req)
-	_, _ = c.Write(resp)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"id":      req.Id,
 		"request": BytesToHex(resp),
 	}).Debug("[0a] BillingModelResponse message sent")
+	PublishDownlink(c, "0a", req, resp, src)
+	return nil
+}
+
+func SendRemoteStartRequest(req *RemoteStartRequestMessage, src *CommandSource) error {
+	c, err := GetClient(req.Id)
+	if err != nil {
+		return err
+	}
+	resp := PackRemoteStartRequestMessage(req)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":       req.Id,
+		"port":     req.Port,
+		"response": BytesToHex(resp),
+	}).Debug("[83] RemoteStartRequest message sent")
+	PublishDownlink(c, "83", req, resp, src)
+	return nil
+}
+
+func SendRemoteStopRequest(req *RemoteStopRequestMessage, src *CommandSource) error {
+	c, err := GetClient(req.Id)
+	if err != nil {
+		return err
+	}
+	resp := PackRemoteStopRequestMessage(req)
+	_, err = c.Write(resp)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":       req.Id,
+		"port":     req.Port,
+		"response": BytesToHex(resp),
+	}).Debug("[84] RemoteStopRequest message sent")
+	PublishDownlink(c, "84", req, resp, src)
 	return nil
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// apis a downlink frame can be sent over, auto is the proxy answering
+	// by itself
+	SourceAuto      = "auto"
+	SourceRest      = "rest"
+	SourceGrpc      = "grpc"
+	SourceMessaging = "messaging"
+
+	// the history is cleaned up this often
+	historyCleanupInterval = time.Hour
+	// open history files are closed after this long without a frame
+	historyIdleTimeout = time.Minute
+
+	historyDayLayout   = "2006-01-02"
+	historyFileSuffix  = ".jsonl"
+	defaultFramesLimit = 1000
+	maxFramesLimit     = 10000
+	// a frames query covers at most this many days
+	maxFramesDays = 31
+)
+
+// CommandSource tells who a downlink frame was sent for: the api the
+// command came over and the caller, if known. CommandId is the queued
+// command the frame was sent for, with -commandQueue.
+type CommandSource struct {
+	Api       string `json:"api"`
+	Caller    string `json:"caller,omitempty"`
+	CommandId string `json:"commandId,omitempty"`
+}
+
+var (
+	autoSource      = &CommandSource{Api: SourceAuto}
+	messagingSource = &CommandSource{Api: SourceMessaging}
+)
+
+// restSource puts the frames sent for a command over the http api down to
+// its caller.
+func restSource(c *gin.Context) *CommandSource {
+	return &CommandSource{Api: SourceRest, Caller: callerOf(c).Name}
+}
+
+// FrameRecord is a frame received from or sent to a pile. Raw is the frame
+// as hex, Source who a downlink frame was sent for.
+type FrameRecord struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	FrameType string          `json:"frameType"`
+	Id        string          `json:"id"`
+	Source    *CommandSource  `json:"source,omitempty"`
+	Message   json.RawMessage `json:"message"`
+	Raw       string          `json:"raw,omitempty"`
+}
+
+// FrameFilter selects the frames of a pile between From and To by frame
+// type and direction, empty values match everything.
+type FrameFilter struct {
+	From       time.Time
+	To         time.Time
+	FrameTypes []string
+	Direction  string
+	Limit      int
+}
+
+// FrameHistory keeps every frame of every pile in Dir, a json line per
+// frame in a file per pile, day (UTC) and frame type:
+// Dir/<id>/<2006-01-02>/<frameType>.jsonl. Files are dropped once the day is
+// older than the retention of the frame type, or Retention.
+type FrameHistory struct {
+	Dir            string
+	Retention      time.Duration
+	TypeRetentions map[string]time.Duration
+
+	mu     sync.Mutex
+	files  map[string]*historyFile
+	closed bool
+	quit   chan struct{}
+}
+
+type historyFile struct {
+	f        *os.File
+	lastUsed time.Time
+}
+
+var frameHistory *FrameHistory
+
+// ids end up in paths, so only plain ones are kept
+var historyIdPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+var ErrInvalidHistoryId = errors.New("invalid device id")
+
+func NewFrameHistory(dir string, retention time.Duration, typeRetentions map[string]time.Duration) (*FrameHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &FrameHistory{
+		Dir:            dir,
+		Retention:      retention,
+		TypeRetentions: typeRetentions,
+		files:          make(map[string]*historyFile),
+		quit:           make(chan struct{}),
+	}
+	h.cleanup(time.Now())
+	return h, nil
+}
+
+// ParseRetentions reads retentions per frame type given as type=duration
+// pairs separated by commas, e.g. 82=24h,13=72h.
+func ParseRetentions(s string) (map[string]time.Duration, error) {
+	retentions := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		frameType, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("retention must be type=duration: " + pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		retentions[strings.ToLower(strings.TrimSpace(frameType))] = d
+	}
+	return retentions, nil
+}
+
+func (h *FrameHistory) retention(frameType string) time.Duration {
+	if d, ok := h.TypeRetentions[frameType]; ok {
+		return d
+	}
+	return h.Retention
+}
+
+// Record appends a frame to the history of its pile. Frames of piles that
+// have not told their id are not kept.
+func (h *FrameHistory) Record(r *FrameRecord) {
+	if !historyIdPattern.MatchString(r.Id) || !historyIdPattern.MatchString(r.FrameType) {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	day := r.Time.UTC().Format(historyDayLayout)
+	path := filepath.Join(h.Dir, r.Id, day, strings.ToLower(r.FrameType)+historyFileSuffix)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	//handlers left running after a timed out shutdown open no files again
+	if h.closed {
+		return
+	}
+	hf, ok := h.files[path]
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Errorf("error recording frame: %v", err)
+			return
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Errorf("error recording frame: %v", err)
+			return
+		}
+		hf = &historyFile{f: f}
+		h.files[path] = hf
+	}
+	hf.lastUsed = time.Now()
+	if _, err := hf.f.Write(append(b, '\n')); err != nil {
+		log.Errorf("error recording frame: %v", err)
+	}
+}
+
+// Frames returns the frames of a pile matching filter, oldest first, and at
+// most filter.Limit of them. The range is cut to the last maxFramesDays days
+// before filter.To; days are read one by one until the limit is reached.
+func (h *FrameHistory) Frames(id string, filter FrameFilter) ([]*FrameRecord, error) {
+	if !historyIdPattern.MatchString(id) {
+		return nil, ErrInvalidHistoryId
+	}
+	frames := make([]*FrameRecord, 0)
+	from, to := filter.From.UTC(), filter.To.UTC()
+	if earliest := to.Add(-maxFramesDays * 24 * time.Hour); from.Before(earliest) {
+		from = earliest
+	}
+	for day := from.Truncate(24 * time.Hour); !day.After(to); day = day.Add(24 * time.Hour) {
+		dir := filepath.Join(h.Dir, id, day.Format(historyDayLayout))
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		//the frame types of a day are in separate files, so a day is read
+		//whole before it is sorted in
+		var daily []*FrameRecord
+		for _, e := range entries {
+			frameType := strings.TrimSuffix(e.Name(), historyFileSuffix)
+			if !matchesAny(filter.FrameTypes, frameType) {
+				continue
+			}
+			if err := readFrames(filepath.Join(dir, e.Name()), func(r *FrameRecord) {
+				if !r.Time.Before(from) && !r.Time.After(to) && (filter.Direction == "" || filter.Direction == r.Direction) {
+					daily = append(daily, r)
+				}
+			}); err != nil {
+				return nil, err
+			}
+		}
+		sort.SliceStable(daily, func(i, j int) bool { return daily[i].Time.Before(daily[j].Time) })
+		frames = append(frames, daily...)
+		if filter.Limit > 0 && len(frames) >= filter.Limit {
+			return frames[:filter.Limit], nil
+		}
+	}
+	return frames, nil
+}
+
+func readFrames(path string, f func(r *FrameRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var r FrameRecord
+		//a line cut short by a crash is skipped
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			f(&r)
+		}
+	}
+	return sc.Err()
+}
+
+// Run closes idle files and drops expired days until Close is called.
+func (h *FrameHistory) Run() {
+	idle := time.NewTicker(historyIdleTimeout)
+	defer idle.Stop()
+	cleanup := time.NewTicker(historyCleanupInterval)
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-idle.C:
+			h.closeIdle(time.Now().Add(-historyIdleTimeout))
+		case now := <-cleanup.C:
+			h.cleanup(now)
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func (h *FrameHistory) Close() error {
+	close(h.quit)
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.closeIdle(time.Now().Add(time.Hour))
+	return nil
+}
+
+// closeIdle closes the files last written before t.
+func (h *FrameHistory) closeIdle(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for path, hf := range h.files {
+		if hf.lastUsed.Before(t) {
+			_ = hf.f.Close()
+			delete(h.files, path)
+		}
+	}
+}
+
+// cleanup drops the files of the days that ended longer ago than the
+// retention of their frame type, and the directories left empty.
+func (h *FrameHistory) cleanup(now time.Time) {
+	ids, err := os.ReadDir(h.Dir)
+	if err != nil {
+		log.Errorf("error cleaning up frame history: %v", err)
+		return
+	}
+	removed := 0
+	for _, id := range ids {
+		idDir := filepath.Join(h.Dir, id.Name())
+		days, _ := os.ReadDir(idDir)
+		for _, d := range days {
+			day, err := time.Parse(historyDayLayout, d.Name())
+			if err != nil {
+				continue
+			}
+			dayDir := filepath.Join(idDir, d.Name())
+			files, _ := os.ReadDir(dayDir)
+			for _, f := range files {
+				frameType := strings.TrimSuffix(f.Name(), historyFileSuffix)
+				retention := h.retention(frameType)
+				if retention > 0 && now.Sub(day.Add(24*time.Hour)) > retention {
+					h.remove(filepath.Join(dayDir, f.Name()))
+					removed++
+				}
+			}
+			_ = os.Remove(dayDir) //only if empty
+		}
+		_ = os.Remove(idDir)
+	}
+	if removed > 0 {
+		log.WithFields(log.Fields{
+			"files": removed,
+		}).Info("expired frame history removed")
+	}
+}
+
+func (h *FrameHistory) remove(path string) {
+	h.mu.Lock()
+	if hf, ok := h.files[path]; ok {
+		_ = hf.f.Close()
+		delete(h.files, path)
+	}
+	h.mu.Unlock()
+	if err := os.Remove(path); err != nil {
+		log.Errorf("error removing frame history: %v", err)
+	}
+}
+
+// recordFrame keeps a frame in the history, if there is one. raw is the
+// frame as hex bytes.
+func recordFrame(direction string, id string, frameType string, msg json.RawMessage, raw []string, src *CommandSource) {
+	if frameHistory == nil {
+		return
+	}
+	r := &FrameRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		FrameType: frameType,
+		Id:        id,
+		Message:   msg,
+		Raw:       strings.Join(raw, ""),
+		Source:    src,
+	}
+	frameHistory.Record(r)
+}
+
+// framesQuery reads the filter of GET /devices/:id/frames: from and to as
+// read by timeRangeQuery; type may be repeated or comma separated. A bad
+// query is answered and ok is false.
+func framesQuery(c *gin.Context) (filter FrameFilter, ok bool) {
+	filter = FrameFilter{
+		FrameTypes: queryList(c, "type"),
+		Direction:  c.Query("direction"),
+		Limit:      defaultFramesLimit,
+	}
+	if filter.From, filter.To, ok = timeRangeQuery(c); !ok {
+		return filter, false
+	}
+	if filter.To.Sub(filter.From) > maxFramesDays*24*time.Hour {
+		c.JSON(400, ApiMessage{Message: "invalid request", Errors: []string{fmt.Sprintf("from: must be at most %d days before to", maxFramesDays)}})
+		return filter, false
+	}
+	if v := c.Query("limit"); v != "" {
+		//checked against the document already
+		filter.Limit, _ = strconv.Atoi(v)
+	}
+	return filter, true
+}
+
+// timeRangeQuery reads from and to of a query as RFC 3339 times, by default
+// the last day. A bad query is answered and ok is false.
+func timeRangeQuery(c *gin.Context) (from time.Time, to time.Time, ok bool) {
+	to = time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(400, ApiMessage{Message: "invalid request", Errors: []string{"to: must be an RFC 3339 time"}})
+			return from, to, false
+		}
+		to = t
+	}
+	from = to.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(400, ApiMessage{Message: "invalid request", Errors: []string{"from: must be an RFC 3339 time"}})
+			return from, to, false
+		}
+		from = t
+	}
+	if from.After(to) {
+		c.JSON(400, ApiMessage{Message: "invalid request", Errors: []string{"from: must not be after to"}})
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// ListFramesRouter returns the recorded frames of a pile.
+func ListFramesRouter(c *gin.Context) {
+	filter, ok := framesQuery(c)
+	if !ok {
+		return
+	}
+	frames, err := frameHistory.Frames(c.Param("id"), filter)
+	if errors.Is(err, ErrInvalidHistoryId) {
+		c.JSON(400, ApiMessage{Message: "invalid request", Errors: []string{"id: " + err.Error()}})
+		return
+	}
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	c.JSON(200, frames)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameHistory(t *testing.T) {
+	h, err := NewFrameHistory(t.TempDir(), 30*24*time.Hour, map[string]time.Duration{"91": 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameHistory = h
+	defer func() {
+		_ = h.Close()
+		frameHistory = nil
+	}()
+	id := "32010600213533"
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	StoreClient(id, server)
+	defer RemoveClient(server)
+
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/proxy/92", strings.NewReader(`{"id":"`+id+`","control":1}`)))
+	if w.Code != 200 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	PublishUplink(nil, "91", &RemoteRebootResponseMessage{Id: id, Result: 1}, []string{"68", "0c"})
+	old := &VerificationResponseMessage{Header: &Header{}, Id: id, Result: true}
+	PublishDownlink(nil, "02", old, PackVerificationResponseMessage(old), nil)
+	h.Record(&FrameRecord{Time: time.Now().Add(-72 * time.Hour), Direction: DirectionUplink, FrameType: "91", Id: id})
+
+	frames := func(query string) []*FrameRecord {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/devices/"+id+"/frames"+query, nil))
+		var list []*FrameRecord
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+		}
+		return list
+	}
+	list := frames("")
+	if len(list) != 3 || list[0].FrameType != "92" || list[1].FrameType != "91" || list[1].Raw != "680c" {
+		t.Fatalf("unexpected frames %+v", list)
+	}
+	if src := list[0].Source; src == nil || src.Api != SourceRest || src.Caller != "anonymous" || !strings.HasPrefix(list[0].Raw, "68") {
+		t.Fatalf("unexpected command frame %+v", list[0])
+	}
+	if src := list[2].Source; src == nil || src.Api != SourceAuto {
+		t.Fatalf("unexpected auto response %+v", list[2])
+	}
+	if list := frames("?type=91&from=" + time.Now().Add(-96*time.Hour).Format(time.RFC3339)); len(list) != 2 {
+		t.Fatalf("unexpected frames %+v", list)
+	}
+	if list := frames("?direction=downlink&limit=1"); len(list) != 1 || list[0].FrameType != "92" {
+		t.Fatalf("unexpected frames %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/devices/"+id+"/frames?from="+time.Now().Add(-32*24*time.Hour).Format(time.RFC3339), nil))
+	if w.Code != 400 {
+		t.Fatalf("unbounded range answered with %d %s", w.Code, w.Body.String())
+	}
+	//reading stops at the limit: today is never looked at
+	today := filepath.Join(h.Dir, id, time.Now().UTC().Format(historyDayLayout))
+	_ = os.Rename(today, today+".bak")
+	_ = os.WriteFile(today, nil, 0600)
+	if list, err := h.Frames(id, FrameFilter{From: time.Now().Add(-96 * time.Hour), To: time.Now(), Limit: 1}); err != nil || len(list) != 1 {
+		t.Fatalf("unexpected frames %+v %v", list, err)
+	}
+	if _, err := h.Frames(id, FrameFilter{From: time.Now().Add(-96 * time.Hour), To: time.Now(), Limit: 2}); err == nil {
+		t.Fatal("today not read")
+	}
+	_ = os.Remove(today)
+	_ = os.Rename(today+".bak", today)
+
+	h.cleanup(time.Now())
+	if list := frames("?type=91&from=" + time.Now().Add(-96*time.Hour).Format(time.RFC3339)); len(list) != 1 {
+		t.Fatalf("expired frames kept %+v", list)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HTTP_SIGNATURE_HEADER = "X-Ykc-Signature"
+	HTTP_TIMESTAMP_HEADER = "X-Ykc-Timestamp"
+
+	httpMinBackoff     = 100 * time.Millisecond
+	httpMaxDownTime    = time.Minute
+	httpHealthInterval = 10 * time.Second
+)
+
+var ErrNoHttpEndpoint = errors.New("no http endpoint configured")
+
+// endpointHealth tracks failures of one endpoint. An endpoint that failed is
+// skipped until downUntil, which grows with every failure in a row, or until
+// the health check reaches it again.
+type endpointHealth struct {
+	url       string
+	failures  int
+	downUntil time.Time
+}
+
+func (e *endpointHealth) healthy(now time.Time) bool {
+	return !now.Before(e.downUntil)
+}
+
+// HTTPForwarder posts device messages to <endpoint>/<frameType>. Messages are
+// spread round robin over the healthy endpoints, and a failed post is retried
+// on the next one with exponential back off. Any status but 2xx is a failure.
+// If Secret is set every post is signed, see sign.
+type HTTPForwarder struct {
+	Endpoints []string
+	Headers   map[string]string
+	Username  string
+	Password  string
+	Secret    string
+	Timeout   time.Duration
+	Retries   int
+	Encoding  string
+
+	client    *resty.Client
+	mu        sync.Mutex
+	endpoints []*endpointHealth
+	next      int
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func (h *HTTPForwarder) Connect() error {
+	h.endpoints = nil
+	for _, e := range h.Endpoints {
+		e = strings.TrimSuffix(strings.TrimSpace(e), "/")
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "://") {
+			e = "http://" + e
+		}
+		h.endpoints = append(h.endpoints, &endpointHealth{url: e})
+	}
+	if len(h.endpoints) == 0 {
+		return ErrNoHttpEndpoint
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = 3 * time.Second
+	}
+
+	// one client for all posts, so connections are kept alive and reused
+	h.client = resty.New().
+		SetTimeout(h.Timeout).
+		SetHeader("Content-Type", "application/json").
+		SetHeaders(h.Headers)
+	if h.Username != "" {
+		h.client.SetBasicAuth(h.Username, h.Password)
+	}
+	h.quit = make(chan struct{})
+	h.wg.Add(1)
+	go h.checkHealth()
+	return nil
+}
+
+// Subscribe is not supported, commands reach an http deployment through the
+// REST API.
+func (h *HTTPForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	return ErrSubscribeUnsupported
+}
+
+func (h *HTTPForwarder) Close() error {
+	close(h.quit)
+	h.wg.Wait()
+	return nil
+}
+
+func (h *HTTPForwarder) Publish(mid string, message []byte) error {
+	return h.PublishEvent(mid, message, nil)
+}
+
+// PublishEvent carries CloudEvents attributes as ce- headers.
+func (h *HTTPForwarder) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	body, headers, err := wireMessage(h.Encoding, mid, message, attrs, "ce-", "Content-Type")
+	if err != nil {
+		return err
+	}
+	backoff := httpMinBackoff
+	for attempt := 0; attempt <= h.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		e := h.pick()
+		var retry bool
+		retry, err = h.post(e, mid, body, headers)
+		if err == nil {
+			h.markUp(e)
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"mid":      mid,
+			"endpoint": e.url,
+			"attempt":  attempt + 1,
+		}).Warnf("error forwarding message: %v", err)
+		if !retry {
+			break
+		}
+		h.markDown(e)
+	}
+	log.WithFields(log.Fields{
+		"mid": mid,
+	}).Errorf("error forwarding message: %v", err)
+	return err
+}
+
+// post reports whether a failure is worth retrying: client errors other
+// than timeouts and rate limiting will fail the same way again.
+func (h *HTTPForwarder) post(e *endpointHealth, mid string, message []byte, headers map[string]string) (bool, error) {
+	url := e.url + "/" + mid
+	log.WithFields(log.Fields{
+		"mid":      mid,
+		"endpoint": url,
+	}).Info("forwarding message to http endpoint")
+
+	req := h.client.R().SetHeaders(headers).SetBody(message)
+	if h.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.SetHeader(HTTP_TIMESTAMP_HEADER, ts)
+		req.SetHeader(HTTP_SIGNATURE_HEADER, sign(h.Secret, ts, message))
+	}
+	res, err := req.Post(url)
+	if err != nil {
+		return true, err
+	}
+	if !res.IsSuccess() {
+		status := res.StatusCode()
+		retry := status >= 500 || status == 408 || status == 429
+		return retry, fmt.Errorf("http status %d", status)
+	}
+	log.WithFields(log.Fields{
+		"http_response": res.String(),
+	}).Info("response from http forwarder")
+	return false, nil
+}
+
+// sign returns the signature header value of a message:
+// sha256=hex(hmac-sha256(secret, timestamp + "." + body)).
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// pick returns the next healthy endpoint, or the one that is back up the
+// soonest if all of them are down.
+func (h *HTTPForwarder) pick() *endpointHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	n := len(h.endpoints)
+	for i := 0; i < n; i++ {
+		e := h.endpoints[(h.next+i)%n]
+		if e.healthy(now) {
+			h.next = (h.next + i + 1) % n
+			return e
+		}
+	}
+	best := h.endpoints[0]
+	for _, e := range h.endpoints[1:] {
+		if e.downUntil.Before(best.downUntil) {
+			best = e
+		}
+	}
+	return best
+}
+
+func (h *HTTPForwarder) markDown(e *endpointHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.failures++
+	d := time.Second << uint(e.failures-1)
+	if d > httpMaxDownTime || d <= 0 {
+		d = httpMaxDownTime
+	}
+	e.downUntil = time.Now().Add(d)
+}
+
+func (h *HTTPForwarder) markUp(e *endpointHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e.failures > 0 {
+		log.WithFields(log.Fields{
+			"endpoint": e.url,
+		}).Info("http endpoint is back up")
+	}
+	e.failures = 0
+	e.downUntil = time.Time{}
+}
+
+// checkHealth probes endpoints that are down, any response that is not a
+// server error brings them back.
+func (h *HTTPForwarder) checkHealth() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(httpHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.quit:
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		var down []*endpointHealth
+		for _, e := range h.endpoints {
+			if e.failures > 0 {
+				down = append(down, e)
+			}
+		}
+		h.mu.Unlock()
+		for _, e := range down {
+			res, err := h.client.R().Head(e.url)
+			if err == nil && res.StatusCode() < 500 {
+				h.markUp(e)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPForwarderFailsOverAndSigns(t *testing.T) {
+	var downHits int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downHits, 1)
+		w.WriteHeader(503)
+	}))
+	defer down.Close()
+
+	var path, signature, auth string
+	var body []byte
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(HTTP_SIGNATURE_HEADER)
+		if signature != sign("s3cret", r.Header.Get(HTTP_TIMESTAMP_HEADER), body) {
+			w.WriteHeader(401)
+			return
+		}
+		_, _ = w.Write([]byte(`"ok"`))
+	}))
+	defer up.Close()
+
+	f := &HTTPForwarder{
+		Endpoints: []string{down.URL + "/messages", up.URL + "/messages/"},
+		Headers:   map[string]string{"Authorization": "Bearer token"},
+		Secret:    "s3cret",
+		Retries:   2,
+	}
+	if err := f.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := f.Publish("13", []byte(`{"id":"32010600213533"}`)); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if path != "/messages/13" || auth != "Bearer token" || signature == "" {
+		t.Errorf("unexpected request: path %s auth %q signature %q", path, auth, signature)
+	}
+	// the failing endpoint is skipped once it is marked down
+	if n := atomic.LoadInt32(&downHits); n != 1 {
+		t.Errorf("expected the failing endpoint to be tried once, got %d", n)
+	}
+}
+
+func TestHTTPForwarderClientErrorIsNotRetried(t *testing.T) {
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(400)
+	}))
+	defer s.Close()
+
+	f := &HTTPForwarder{Endpoints: []string{s.URL}, Retries: 3}
+	if err := f.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Publish("13", []byte(`{}`)); err == nil {
+		t.Error("expected 400 to fail the publish")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected a single attempt, got %d", n)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafkaWriter and kafkaReader are the parts of kafka.Writer and kafka.Reader
+// the forwarder uses, so tests can stand in for a broker.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Publish writes one message at a time, so the writer must not wait the
+// default second for a batch to fill up.
+const kafkaBatchTimeout = 10 * time.Millisecond
+
+// KafkaForwarder publishes device messages to kafka, keyed by pile id so the
+// messages of one pile stay in one partition and thus in order. Messages go
+// to one topic per frame type (TopicPrefix.<frameType>), or all to Topic if
+// it is set.
+type KafkaForwarder struct {
+	Brokers     []string
+	Topic       string
+	TopicPrefix string
+	Acks        string
+	Compression string
+	GroupId     string
+	Username    string
+	Password    string
+	Encoding    string
+
+	writer    kafkaWriter
+	newReader func(topic string) kafkaReader
+	readers   []kafkaReader
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func (h *KafkaForwarder) Connect() error {
+	acks, err := kafkaAcks(h.Acks)
+	if err != nil {
+		return err
+	}
+	compression, err := kafkaCompression(h.Compression)
+	if err != nil {
+		return err
+	}
+	transport := &kafka.Transport{}
+	dialer := &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true}
+	if h.Username != "" {
+		mechanism := plain.Mechanism{Username: h.Username, Password: h.Password}
+		transport.SASL = mechanism
+		dialer.SASLMechanism = mechanism
+	}
+
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if h.writer == nil {
+		h.writer = &kafka.Writer{
+			Addr:                   kafka.TCP(h.Brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           acks,
+			Compression:            compression,
+			Transport:              transport,
+			BatchTimeout:           kafkaBatchTimeout,
+			AllowAutoTopicCreation: true,
+		}
+	}
+	if h.newReader == nil {
+		h.newReader = func(topic string) kafkaReader {
+			return kafka.NewReader(kafka.ReaderConfig{
+				Brokers: h.Brokers,
+				GroupID: h.GroupId,
+				Topic:   topic,
+				Dialer:  dialer,
+			})
+		}
+	}
+	log.WithFields(log.Fields{
+		"brokers": strings.Join(h.Brokers, ","),
+		"topic":   h.topic("<frameType>"),
+	}).Info("kafka forwarder ready")
+	return nil
+}
+
+func (h *KafkaForwarder) topic(mid string) string {
+	if h.Topic != "" {
+		return h.Topic
+	}
+	return h.TopicPrefix + "." + mid
+}
+
+func (h *KafkaForwarder) Publish(mid string, message []byte) error {
+	return h.PublishEvent(mid, message, nil)
+}
+
+// PublishEvent carries CloudEvents attributes as ce_ headers.
+func (h *KafkaForwarder) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	body, headers, err := wireMessage(h.Encoding, mid, message, attrs, "ce_", "content-type")
+	if err != nil {
+		return err
+	}
+	m := kafka.Message{
+		Topic: h.topic(mid),
+		Key:   []byte(MessageDeviceId(message)),
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: "frameType", Value: []byte(mid)},
+		},
+	}
+	for k, v := range headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	err = h.writer.WriteMessages(h.ctx, m)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mid":   mid,
+			"topic": m.Topic,
+		}).Errorf("error forwarding message to kafka: %v", err)
+	}
+	return err
+}
+
+// Subscribe consumes topic (relative to TopicPrefix) as member of the
+// consumer group GroupId. A message is committed once handler returns.
+func (h *KafkaForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	r := h.newReader(h.TopicPrefix + "." + topic)
+	h.mu.Lock()
+	h.readers = append(h.readers, r)
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			m, err := r.FetchMessage(h.ctx)
+			if err != nil {
+				if h.ctx.Err() != nil {
+					return
+				}
+				log.Errorf("error consuming kafka topic %s: %v", topic, err)
+				time.Sleep(time.Second)
+				continue
+			}
+			handler(m.Value)
+			if err := r.CommitMessages(h.ctx, m); err != nil && h.ctx.Err() == nil {
+				log.Errorf("error committing kafka message: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *KafkaForwarder) Close() error {
+	h.cancel()
+	h.mu.Lock()
+	for _, r := range h.readers {
+		_ = r.Close()
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+	return h.writer.Close()
+}
+
+func kafkaAcks(v string) (kafka.RequiredAcks, error) {
+	switch v {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	}
+	return 0, errors.New("kafka acks must be all, one or none")
+}
+
+func kafkaCompression(v string) (kafka.Compression, error) {
+	switch v {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	}
+	return 0, errors.New("kafka compression must be none, gzip, snappy, lz4 or zstd")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka stands in for a broker: it records written messages and hands
+// out queued messages to readers.
+type fakeKafka struct {
+	mu        sync.Mutex
+	written   []kafka.Message
+	committed []kafka.Message
+	queue     chan kafka.Message
+}
+
+func (k *fakeKafka) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.written = append(k.written, msgs...)
+	return nil
+}
+
+func (k *fakeKafka) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case m := <-k.queue:
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (k *fakeKafka) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.committed = append(k.committed, msgs...)
+	return nil
+}
+
+func (k *fakeKafka) Close() error {
+	return nil
+}
+
+func newTestKafkaForwarder(k *fakeKafka, topic string) *KafkaForwarder {
+	f := &KafkaForwarder{
+		Topic:       topic,
+		TopicPrefix: NATS_PUBLISH_SUBJECT_PREFIX,
+		writer:      k,
+		newReader:   func(string) kafkaReader { return k },
+	}
+	if err := f.Connect(); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestKafkaPublish(t *testing.T) {
+	k := &fakeKafka{}
+	f := newTestKafkaForwarder(k, "")
+	defer f.Close()
+
+	_ = f.Publish("03", []byte(`{"id":"32010600213533","header":{}}`))
+	_ = f.Publish("01", []byte(`{"Id":"32010600213534"}`))
+
+	if len(k.written) != 2 {
+		t.Fatalf("written %d messages, want 2", len(k.written))
+	}
+	m := k.written[0]
+	if m.Topic != "charge.proxy.ykc.03" || string(m.Key) != "32010600213533" {
+		t.Errorf("got topic %s key %s", m.Topic, m.Key)
+	}
+	if string(k.written[1].Key) != "32010600213534" {
+		t.Errorf("got key %s for Id field", k.written[1].Key)
+	}
+}
+
+func TestKafkaPublishSingleTopic(t *testing.T) {
+	k := &fakeKafka{}
+	f := newTestKafkaForwarder(k, "ykc")
+	defer f.Close()
+
+	_ = f.Publish("13", []byte(`{"id":"32010600213533"}`))
+	m := k.written[0]
+	if m.Topic != "ykc" {
+		t.Errorf("got topic %s, want ykc", m.Topic)
+	}
+	if len(m.Headers) != 1 || string(m.Headers[0].Value) != "13" {
+		t.Errorf("frame type header missing: %v", m.Headers)
+	}
+}
+
+func TestKafkaSubscribeCommits(t *testing.T) {
+	k := &fakeKafka{queue: make(chan kafka.Message, 1)}
+	f := newTestKafkaForwarder(k, "")
+
+	got := make(chan []byte, 1)
+	_ = f.Subscribe("cmd.34", func(message []byte) {
+		got <- message
+	})
+	k.queue <- kafka.Message{Value: []byte(`{"id":"32010600213533"}`)}
+
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+	_ = f.Close()
+	if len(k.committed) != 1 {
+		t.Errorf("committed %d messages, want 1", len(k.committed))
+	}
+}
+
+func TestKafkaOptions(t *testing.T) {
+	if _, err := kafkaAcks("some"); err == nil {
+		t.Error("expected error for invalid acks")
+	}
+	if c, err := kafkaCompression("zstd"); err != nil || c != kafka.Zstd {
+		t.Errorf("got %v %v for zstd", c, err)
+	}
+	h := &KafkaForwarder{Brokers: []string{"127.0.0.1:9092"}, TopicPrefix: "charge.proxy.ykc"}
+	if err := h.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if w := h.writer.(*kafka.Writer); w.BatchTimeout != kafkaBatchTimeout {
+		t.Errorf("publishing waits %v for a batch", w.BatchTimeout)
+	}
+}
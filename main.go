@@ -1,16 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -18,17 +16,51 @@ import (
 
 var clients sync.Map
 
+var ErrClientNotFound = errors.New("client does not exist")
+
 func StoreClient(id string, conn net.Conn) {
 	clients.Store(id, conn)
 }
 
+// RemoveClient forgets every id a closed connection was stored under and
+// returns them.
+func RemoveClient(conn net.Conn) []string {
+	var ids []string
+	clients.Range(func(key, value interface{}) bool {
+		if value.(net.Conn) == conn {
+			clients.Delete(key)
+			ids = append(ids, key.(string))
+		}
+		return true
+	})
+	return ids
+}
+
+// ConnDeviceId returns the id of the pile on a connection, empty if it has
+// not logged in yet.
+func ConnDeviceId(conn net.Conn) string {
+	if id := sessions.Id(conn); id != "" {
+		return id
+	}
+	var id string
+	clients.Range(func(key, value interface{}) bool {
+		//every connection is stored under its address too
+		if value.(net.Conn) == conn && key.(string) != conn.RemoteAddr().String() {
+			id = key.(string)
+			return false
+		}
+		return true
+	})
+	return id
+}
+
 func GetClient(id string) (net.Conn, error) {
 	value, ok := clients.Load(id)
 	if ok {
 		conn := value.(net.Conn)
 		return conn, nil
 	} else {
-		return nil, errors.New("client does not exist")
+		return nil, ErrClientNotFound
 	}
 }
 
@@ -36,109 +68,6 @@ func HelloWorldRouter(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "Hello world"})
 }
 
-func StartChargin(c *gin.Context) {
-	clientID := c.DefaultQuery("clientID", "")
-	if clientID == "" {
-		c.JSON(400, gin.H{"error": "client ID is required"})
-		return
-	}
-	fmt.Println(clientID)
-	// // Retrieve the client connection using the GetClient function
-	conn, err := GetClient(clientID)
-
-	if err != nil {
-		c.JSON(404, gin.H{"error": "client not found"})
-		return
-	}
-
-	// // Define the message you want to send (in bytes format)
-	// message := []byte{0x5A, 0xA5, 0x11, 0x00, 0x82, 0x1F, 0x1E, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xDC}
-	// packet := []byte{
-	// 	0x5A, 0xA5,
-	// 	0x16, 0x00,
-	// 	0x83, 0x00,
-	// 	0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, //emai
-	// 	0x01,                   //port
-	// 	0x01, 0x01, 0x01, 0x02, // order
-	// 	0x01,                   //mode
-	// 	0x01, 0x00, 0x00, 0x01, // time params
-	// 	0x00, 0x00, 0x00, 0x00, //balance
-	// 	0x03, 0xE8, 0x03, 0x00, 0x00, 0x03, 0xe8, 0x00, 0x00, 0xED,
-	// }
-	packet := []byte{
-		0x5A, 0xA5, // header
-		0x16, 0x00, // length
-		0x83, 0x00, // cmd
-		0x38, 0x36, 0x31, 0x34, 0x33, 0x35, 0x30, 0x37, 0x33, 0x39, 0x30, 0x30, 0x38, 0x34, 0x33, //emai,
-		0x01,                   //port
-		0x01, 0x01, 0x05, 0x01, // order
-		0x03,                   // payment mode
-		0x00, 0x00, 0x00, 0x00, // card number
-		0x05,                   // charging mode
-		0xE8, 0x03, 0x00, 0x00, // time number
-		0x64, 0x00, 0x00, 0x00, //balance
-		0xED, // checksum
-	}
-
-	// // Send the message to the client
-	err = sendMessage(conn, packet)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to send message"})
-		return
-	}
-	// // packet := []byte{
-	// // 	0x5A, 0xA5,
-	// // 	0x16, 0x00,
-	// // 	0x83, 0x00,
-	// // 	0x01, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x03, 0xE8, 0x03, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0xED,
-	// // }
-	// sendMessage(conn, packet)
-	// Respond to HTTP request
-	c.JSON(200, gin.H{"status": "message sent"})
-}
-
-func StopCharging(c *gin.Context) {
-	clientID := c.DefaultQuery("clientID", "")
-	if clientID == "" {
-		c.JSON(400, gin.H{"error": "client ID is required"})
-		return
-	}
-	fmt.Println(clientID)
-	// // Retrieve the client connection using the GetClient function
-	conn, err := GetClient(clientID)
-
-	if err != nil {
-		c.JSON(404, gin.H{"error": "client not found"})
-		return
-	}
-
-	// // Define the message you want to send (in bytes format)
-	// message := []byte{0x5A, 0xA5, 0x11, 0x00, 0x82, 0x1F, 0x1E, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xDC}
-	packet := []byte{
-		0x5A, 0xA5,
-		0x08, 0x00,
-		0x84, 0x00,
-		0x01, 0x01, 0x05, 0x01,
-		0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01,
-		0x01, 0x01, 0x00, 0x00, 0x00, 0x8F}
-
-	// // Send the message to the client
-	err = sendMessage(conn, packet)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to send message"})
-		return
-	}
-	// // packet := []byte{
-	// // 	0x5A, 0xA5,
-	// // 	0x16, 0x00,
-	// // 	0x83, 0x00,
-	// // 	0x01, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x03, 0xE8, 0x03, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0xED,
-	// // }
-	// sendMessage(conn, packet)
-	// Respond to HTTP request
-	c.JSON(200, gin.H{"status": "message sent"})
-}
-
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		ForceColors:   true,
@@ -149,115 +78,211 @@ func main() {
 
 	opt := parseOptions()
 
+	if opt.Encoding != EncodingJSON && opt.Encoding != EncodingProtobuf {
+		log.Fatalf("encoding must be json or protobuf")
+	}
+
 	//define message forwarder
-	var f MessageForwarder
-	switch opt.MessagingServerType {
-	case "http":
-		f := &HTTPForwarder{
-			Endpoints: opt.Servers,
+	if opt.Routes != "" {
+		f, err := NewRoutingForwarder(opt.Routes, opt)
+		if err != nil {
+			log.Fatalf("can not set up message routing, error: %s", err.Error())
 		}
 		opt.MessageForwarder = f
-	case "nats":
-		servers := strings.Join(opt.Servers, ",")
-		f := &NatsForwarder{
-			Servers:  servers,
-			Username: opt.Username,
-			Password: opt.Password,
+	} else if opt.MessagingServerType != "" {
+		f, err := NewForwarder(opt.MessagingServerType, opt.Servers, opt.Username, opt.Password, opt)
+		if err != nil {
+			log.Fatalf("can not set up %s forwarder, error: %s", opt.MessagingServerType, err.Error())
+		}
+		if err := SubscribeCommands(f, opt.CommandReplyTimeout); err != nil {
+			log.Fatalf("can not subscribe to commands, error: %s", err.Error())
 		}
-		f.Connect()
-		opt.MessageForwarder = f
-	default:
-		f = nil
 		opt.MessageForwarder = f
+		if opt.Outbox {
+			o, err := WithOutbox("", f, opt)
+			if err != nil {
+				log.Fatalf("can not open outbox, error: %s", err.Error())
+			}
+			opt.MessageForwarder = o
+		}
 	}
 
-	go enableTcpServer(opt)
-	go enableHttpServer(opt)
+	if opt.CloudEvents != "" && opt.MessageForwarder != nil {
+		if opt.CloudEvents != CloudEventsStructured && opt.CloudEvents != CloudEventsBinary {
+			log.Fatalf("cloudEvents must be structured or binary")
+		}
+		opt.MessageForwarder = &CloudEventsForwarder{
+			Forwarder: opt.MessageForwarder,
+			Mode:      opt.CloudEvents,
+			Source:    opt.CloudEventsSource,
+		}
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-	sig := <-sigChan
-	log.Info("exit:", sig)
-	os.Exit(0)
-}
+	if opt.DeviceRegistry != "" {
+		r, err := NewDeviceRegistry(opt.DeviceRegistry, opt.UnknownDevicePolicy)
+		if err != nil {
+			log.Fatalf("can not load device registry, error: %s", err.Error())
+		}
+		deviceRegistry = r
+	}
 
-func enableTcpServer(opt *Options) {
-	host := opt.Host
-	port := strconv.Itoa(opt.TcpPort)
-	addr, err := net.ResolveTCPAddr("tcp", host+":"+port)
-	if err != nil {
-		log.Error("error resolving address:", err)
-		return
+	if opt.ApiKeys != "" || opt.Jwks != "" {
+		a, err := NewAuthenticator(opt.ApiKeys, opt.Jwks, opt.JwtIssuer, opt.JwtAudience)
+		if err != nil {
+			log.Fatalf("can not set up api authentication, error: %s", err.Error())
+		}
+		auth = a
 	}
 
-	ln, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		log.Error("error listening:", err)
-		return
+	if opt.AuditLog != "" {
+		l, err := OpenAuditLog(opt.AuditLog)
+		if err != nil {
+			log.Fatalf("can not open audit log, error: %s", err.Error())
+		}
+		auditLog = l
 	}
-	defer ln.Close()
-	log.Info("server listening on", addr.String())
 
-	for {
-		conn, err := ln.Accept()
+	if opt.FrameHistoryDir != "" {
+		retentions, err := ParseRetentions(opt.FrameHistoryRetentionTypes)
+		if err != nil {
+			log.Fatalf("can not parse frame history retentions, error: %s", err.Error())
+		}
+		h, err := NewFrameHistory(opt.FrameHistoryDir, opt.FrameHistoryRetention, retentions)
 		if err != nil {
-			log.Error("error accepting connection:", err)
-			continue
+			log.Fatalf("can not open frame history, error: %s", err.Error())
 		}
-		StoreClient(conn.RemoteAddr().String(), conn)
-		fmt.Println(conn.RemoteAddr().String())
-		go handleConnection(opt, conn)
+		frameHistory = h
+		go h.Run()
 	}
-}
 
-func enableHttpServer(opt *Options) {
-	fmt.Println("Http ok")
-	r := gin.Default()
-	r.GET("/", StartChargin)
-	r.GET("/stop", StopCharging)
-	r.POST("/proxy/02", VerificationResponseRouter)
-	r.POST("/proxy/06", BillingModelVerificationResponseRouter)
-	r.POST("/proxy/0a", BillingModelResponseMessageRouter)
-	r.POST("/proxy/34", RemoteBootstrapRequestRouter)
-	r.POST("/proxy/36", RemoteShutdownRequestRouter)
-	r.POST("/proxy/40", TransactionRecordConfirmedRouter)
-	r.POST("/proxy/58", SetBillingModelRequestRouter)
-	r.POST("/proxy/92", RemoteRebootRequestMessageRouter)
-	host := opt.Host
-
-	port := strconv.Itoa(opt.HttpPort)
-	fmt.Println(port)
-	fmt.Println(host)
-	err := r.Run(host + ":" + port)
-	if err != nil {
-		panic(err)
+	if opt.StoreFile != "" {
+		st, err := OpenStore(opt.StoreFile)
+		if err != nil {
+			log.Fatalf("can not open store, error: %s", err.Error())
+		}
+		store = st
 	}
-}
 
-func handleConnection(opt *Options, conn net.Conn) {
-	defer conn.Close()
+	if opt.CommandQueue {
+		q, err := NewCommandQueue(opt.CommandQueueFile, opt.CommandTTL, opt.CommandReplyTimeout, opt.CommandMaxAttempts)
+		if err != nil {
+			log.Fatalf("can not load command queue, error: %s", err.Error())
+		}
+		commandQueue = q
+		go q.Run()
+	}
 
-	log.WithFields(log.Fields{
-		"address": conn.RemoteAddr().String(),
-	}).Info("new client connected")
+	s, _ := NewServer(opt)
+	s.Start()
+	s.StartHttp()
+	s.StartGrpc()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+	log.Info("exit:", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opt.ShutdownTimeout)
+	defer cancel()
+	err := s.Stop(ctx)
+	_ = auditLog.Close()
+	if err != nil {
+		log.Errorf("error during shutdown: %v", err)
+		os.Exit(1)
+	}
+}
 
-	var connErr error
-	for connErr == nil {
-		connErr = drain(opt, conn)
-		time.Sleep(time.Millisecond * 1)
+func (s *Server) newHttpRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(AccessLogFormatter), gin.Recovery())
+	r.GET("/openapi.json", OpenAPIRouter(r))
+	r.GET("/swagger", SwaggerRouter)
+	r.GET("/swagger/swagger-ui.css", SwaggerAssetRouter("swagger-ui.css"))
+	r.GET("/swagger/swagger-ui-bundle.js", SwaggerAssetRouter("swagger-ui-bundle.js"))
+	r.Use(Authenticate, RequireRole(RoleReadOnly))
+	//commands are audited before they are checked, so refused ones are too
+	proxy := r.Group("/proxy", AuditCommand, RequireRole(RoleOperator), AuthorizeDevice, ValidateRequest)
+	proxy.POST("/02", VerificationResponseRouter)
+	proxy.POST("/06", BillingModelVerificationResponseRouter)
+	proxy.POST("/0a", BillingModelResponseMessageRouter)
+	proxy.POST("/34", RemoteBootstrapRequestRouter)
+	proxy.POST("/36", RemoteShutdownRequestRouter)
+	proxy.POST("/40", TransactionRecordConfirmedRouter)
+	proxy.POST("/58", SetBillingModelRequestRouter)
+	proxy.POST("/92", RemoteRebootRequestMessageRouter)
+	proxy.POST("/52", SetWorkingParamsRequestRouter)
+	proxy.POST("/56", NtpRequestRouter)
+	proxy.POST("/81", DeviceLoginResponseRouter)
+	r.POST("/devices/:id/ports/:port/start", AuditCommand, RequireRole(RoleOperator), AuthorizeDevice, ValidateRequest, s.RemoteStartPortRouter)
+	r.POST("/devices/:id/ports/:port/stop", AuditCommand, RequireRole(RoleOperator), AuthorizeDevice, ValidateRequest, s.RemoteStopPortRouter)
+	r.DELETE("/devices/:id/connection", AuditCommand, RequireRole(RoleAdmin), AuthorizeDevice, CloseConnectionRouter)
+	if len(outboxes) > 0 {
+		r.POST("/outbox/:seq/replay", AuditCommand, RequireRole(RoleAdmin), ValidateRequest, ReplayOutboxRouter)
+		r.DELETE("/outbox/dead/:seq", AuditCommand, RequireRole(RoleAdmin), ValidateRequest, DropDeadLetterRouter)
 	}
 
+	api := r.Group("", ValidateRequest)
+	api.GET("/schemas", ListSchemasRouter)
+	api.GET("/schemas/:frameType", GetSchemaRouter)
+	if commandQueue != nil {
+		api.GET("/commands", ListCommandsRouter)
+		api.GET("/commands/:id", GetCommandRouter)
+	}
+	if len(outboxes) > 0 {
+		api.GET("/outbox", RequireRole(RoleAdmin), ListOutboxRouter)
+		api.GET("/outbox/dead", RequireRole(RoleAdmin), ListDeadLettersRouter)
+	}
+	api.GET("/stats", s.StatsRouter)
+	api.GET("/devices", ListDevicesRouter)
+	api.GET("/devices/:id", AuthorizeDevice, GetDeviceRouter)
+	api.GET("/devices/:id/guns/:gun", AuthorizeDevice, GetGunRouter)
+	if frameHistory != nil {
+		api.GET("/devices/:id/frames", AuthorizeDevice, ListFramesRouter)
+	}
+	if store != nil {
+		api.GET("/devices/:id/sessions", AuthorizeDevice, ListSessionsRouter)
+		api.GET("/devices/:id/commands", AuthorizeDevice, ListDeviceCommandsRouter)
+		api.GET("/devices/:id/billing-model", AuthorizeDevice, GetBillingModelRouter)
+		api.GET("/transactions", ListTransactionsRouter)
+		api.GET("/transactions/:tradeSeq", GetTransactionRouter)
+	}
+	api.GET("/events", s.EventsRouter)
+	api.GET("/ws/devices/:id", AuthorizeDevice, s.DeviceEventsWsRouter)
+	return r
 }
 
-func drain(opt *Options, conn net.Conn) error {
-	buf := make([]byte, 1024)
+// drain reads the next chunk of data from a pile and routes it. check is
+// given every chunk before it is routed, an error from it ends the
+// connection.
+func drain(opt *Options, conn net.Conn, check func(data []byte) error) error {
+	buf := make([]byte, frameBufferSize(opt))
 	n, err := conn.Read(buf)
 	if err != nil {
 		log.Error("Error reading: ", err)
 		return err
 	}
+	if check != nil {
+		if err := check(buf[:n]); err != nil {
+			return err
+		}
+	}
 
-	hex := BytesToHex(buf[:n])
+	//the routers only get the bytes read, so their length checks hold
+	buf = buf[:n]
+	if n < 6 {
+		log.WithFields(log.Fields{
+			"length": n,
+		}).Error("Message too short to process")
+		return nil
+	}
+	hex := BytesToHex(buf)
+
+	//YKC frames carry the frame type after the encryption flag, Huaping
+	//frames right after the length
+	frameType := buf[4]
+	if buf[0] == StartFlag {
+		frameType = buf[5]
+	}
 
 	encrypted := false
 	if buf[4] == byte(0x01) {
@@ -265,13 +290,13 @@ func drain(opt *Options, conn net.Conn) error {
 	}
 
 	length := buf[1]
-	seq := buf[3]<<8 | buf[2]
+	seq := int(buf[3])<<8 | int(buf[2])
 
 	header := &Header{
 		Length:    int(length),
-		Seq:       int(seq),
+		Seq:       seq,
 		Encrypted: encrypted,
-		FrameId:   strconv.Itoa(int(buf[4])),
+		FrameId:   strconv.Itoa(int(frameType)),
 	}
 
 	log.WithFields(log.Fields{
@@ -279,16 +304,18 @@ func drain(opt *Options, conn net.Conn) error {
 		"encrypted": encrypted,
 		"length":    length,
 		"seq":       seq,
-		"frame_id":  int(buf[4]),
+		"frame_id":  int(frameType),
 	}).Info("Received message")
 
 	log.Debugf("buf[4] (frame_id in hex): %X", buf[4]) // Added for clarity
 
-	switch buf[4] {
+	switch frameType {
 	case Verification:
 		VerificationRouter(opt, buf, hex, header, conn)
+	case PileHeartbeat:
+		PileHeartbeatRouter(opt, buf, hex, header, conn)
 	case Heartbeat:
-		HeartbeatRouter(buf, header, conn)
+		HeartbeatRouter(buf, hex, header, conn)
 		// 38 36 31 34 33 35 30 37 33 39 30 30 38 34 33
 		// packet := []byte{
 		// 	0x5a, 0xa5, 0x25, 0x00, 0x83, 0x00, 0x01, 0x38, 0x36,
@@ -331,23 +358,29 @@ func drain(opt *Options, conn net.Conn) error {
 		SetBillingModelResponseMessageRouter(opt, hex, header)
 	case RemoteRebootResponse:
 		RemoteRebootResponseMessageRouter(opt, hex, header)
+	case SetWorkingParamsResponse:
+		SetWorkingParamsResponseRouter(opt, hex, header)
+	case NtpResponse:
+		NtpResponseRouter(opt, buf, hex, header)
 	case TransactionRecord:
 		TransactionRecordMessageRouter(opt, buf, hex, header)
 	case DeviceLogin:
 		log.Debug("Handling Device Login...")
-		DeviceLoginRouter(opt, buf, header, conn)
+		DeviceLoginRouter(opt, buf, hex, header, conn)
 		// message := []byte{0x5A, 0xA5, 0x11, 0x00, 0x82, 0x1F, 0x1E, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xDC}
 		// sendMessage(conn, message)
 	case RemoteStart:
-		RemoteStartRouter(buf, header, conn)
+		RemoteStartRouter(buf, hex, header, conn)
 	case RemoteStop:
-		RemoteStopRouter(buf, header, conn)
+		RemoteStopRouter(buf, hex, header, conn)
 	case SubmitFinalStatus:
-		SubmitFinalStatusRouter(opt, buf, header, conn)
+		SubmitFinalStatusRouter(opt, buf, hex, header, conn)
 	default:
 		log.WithFields(log.Fields{
-			"frame_id": int(buf[5]),
+			"frame_id": int(frameType),
 		}).Info("unsupported message")
+		//kept in the frame history all the same, undecoded
+		PublishUplink(conn, ByteToHex(frameType), nil, hex)
 	}
 	return nil
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MQTT_TOPIC_PREFIX   = "ykc"
+	MQTT_GATEWAY_STATUS = MQTT_TOPIC_PREFIX + "/gateway/status"
+	mqttTimeout         = 5 * time.Second
+)
+
+// DeviceStatusPublisher is implemented by forwarders that publish when a pile
+// comes online or goes offline.
+type DeviceStatusPublisher interface {
+	PublishDeviceStatus(id string, online bool) error
+}
+
+// PublishDeviceStatus tells the forwarder, if it cares, that a pile has
+// logged in or that its connection is gone.
+func PublishDeviceStatus(opt *Options, id string, online bool) {
+	if p, ok := opt.MessageForwarder.(DeviceStatusPublisher); ok {
+		_ = p.PublishDeviceStatus(id, online)
+	}
+}
+
+// MqttForwarder publishes device messages to ykc/<pileId>/<frameType> and
+// keeps a retained online/offline message per pile under ykc/<pileId>/status.
+// The gateway itself reports under ykc/gateway/status, with a last will that
+// marks it offline if it dies. A connection has one will only, so pile states
+// are stale while the gateway is offline; once back it marks the piles it
+// does not serve anymore offline. Commands are read from
+// ykc/<pileId>/cmd/<frameType>. Version is the MQTT version spoken, 3 for
+// 3.1.1 or 5.
+type MqttForwarder struct {
+	Servers  []string
+	Username string
+	Password string
+	ClientId string
+	Qos      byte
+	Version  int
+	Encoding string
+
+	client    mqttClient
+	newClient func(o *mqtt.ClientOptions) mqtt.Client
+	mu        sync.Mutex
+	online    map[string]bool
+	handlers  map[string]func(message []byte)
+	// pile states waiting to be published, the latest per pile
+	statuses   map[string]bool
+	statusWake chan struct{}
+	quit       chan struct{}
+	statusDone chan struct{}
+}
+
+// mqttClient is what the forwarder needs of an MQTT client, so it can speak
+// MQTT 3.1.1 or 5. Publish and Subscribe wait for the broker; the content
+// type is only sent with MQTT 5.
+type mqttClient interface {
+	Connect() error
+	Publish(topic string, qos byte, retained bool, payload []byte, contentType string) error
+	Subscribe(filter string, qos byte, handler func(topic string, payload []byte)) error
+	IsConnected() bool
+	Disconnect()
+}
+
+func (h *MqttForwarder) Connect() error {
+	if h.Qos > 2 {
+		return errors.New("mqtt qos must be 0, 1 or 2")
+	}
+	h.online = make(map[string]bool)
+	h.handlers = make(map[string]func(message []byte))
+	h.statuses = make(map[string]bool)
+	h.statusWake = make(chan struct{}, 1)
+	h.quit = make(chan struct{})
+	h.statusDone = make(chan struct{})
+
+	switch h.Version {
+	case 0, 3:
+		h.client = newMqtt3Client(h)
+	case 5:
+		h.client = newMqtt5Client(h)
+	default:
+		return errors.New("mqtt version must be 3 or 5")
+	}
+	if err := h.client.Connect(); err != nil {
+		return err
+	}
+	go h.publishStatuses()
+	return nil
+}
+
+// onConnect runs on every (re)connect: the broker may have fired the last
+// will meanwhile, and subscriptions of a clean session are gone.
+func (h *MqttForwarder) onConnect() {
+	log.WithFields(log.Fields{
+		"client_id": h.ClientId,
+		"version":   h.Version,
+	}).Info("connected to mqtt broker")
+	c := h.client
+	_ = c.Publish(MQTT_GATEWAY_STATUS, h.Qos, true, []byte("online"), "")
+
+	h.mu.Lock()
+	ids := make([]string, 0, len(h.online))
+	for id := range h.online {
+		ids = append(ids, id)
+	}
+	handlers := make(map[string]func(message []byte), len(h.handlers))
+	for topic, handler := range h.handlers {
+		handlers[topic] = handler
+	}
+	h.mu.Unlock()
+	//published unlocked, the broker may answer on the status subscription
+	for _, id := range ids {
+		_ = c.Publish(mqttStatusTopic(id), h.Qos, true, []byte("online"), "")
+	}
+	for topic, handler := range handlers {
+		_ = h.subscribe(topic, handler)
+	}
+	//the retained states left by a gateway that died come in first
+	if err := c.Subscribe(mqttStatusTopic("+"), h.Qos, h.onStatus); err != nil {
+		log.Errorf("error subscribing to mqtt pile states: %v", err)
+	}
+}
+
+// onStatus marks a pile offline that is retained as online but not connected
+// to this gateway, which happens when the gateway died.
+func (h *MqttForwarder) onStatus(topic string, payload []byte) {
+	id := strings.Split(topic, "/")[1]
+	if id == "gateway" || string(payload) != "online" {
+		return
+	}
+	h.mu.Lock()
+	online := h.online[id]
+	h.mu.Unlock()
+	if online {
+		return
+	}
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Info("marking stale mqtt pile state offline")
+	_ = h.client.Publish(topic, h.Qos, true, []byte("offline"), "")
+}
+
+func (h *MqttForwarder) Publish(mid string, message []byte) error {
+	topic := MQTT_TOPIC_PREFIX + "/" + mqttDeviceId(MessageDeviceId(message)) + "/" + mid
+	body, contentType, err := EncodeMessage(h.Encoding, mid, message)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	err = h.client.Publish(topic, h.Qos, false, body, contentType)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mid":   mid,
+			"topic": topic,
+		}).Errorf("error forwarding message to mqtt: %v", err)
+	}
+	return err
+}
+
+// PublishDeviceStatus does not wait for the broker, it is called when a
+// pile logs in or disconnects. The states are published in order by
+// publishStatuses.
+func (h *MqttForwarder) PublishDeviceStatus(id string, online bool) error {
+	h.mu.Lock()
+	if online {
+		h.online[id] = true
+	} else if h.online[id] {
+		delete(h.online, id)
+	} else {
+		// never reported online
+		h.mu.Unlock()
+		return nil
+	}
+	h.statuses[id] = online
+	h.mu.Unlock()
+	select {
+	case h.statusWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// publishStatuses publishes the pile states until Close. A pile whose state
+// changed again meanwhile only gets the latest one.
+func (h *MqttForwarder) publishStatuses() {
+	defer close(h.statusDone)
+	for {
+		select {
+		case <-h.statusWake:
+			h.flushStatuses()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func (h *MqttForwarder) flushStatuses() {
+	h.mu.Lock()
+	statuses := h.statuses
+	h.statuses = make(map[string]bool)
+	h.mu.Unlock()
+	for id, online := range statuses {
+		status := "offline"
+		if online {
+			status = "online"
+		}
+		if err := h.client.Publish(mqttStatusTopic(id), h.Qos, true, []byte(status), ""); err != nil {
+			log.WithFields(log.Fields{
+				"id":     id,
+				"status": status,
+			}).Errorf("error publishing pile state to mqtt: %v", err)
+		}
+	}
+}
+
+// Subscribe maps a topic like cmd.34 to ykc/+/cmd/34. The pile id of the
+// topic is filled into commands that carry none.
+func (h *MqttForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	h.mu.Lock()
+	h.handlers[topic] = handler
+	h.mu.Unlock()
+	if !h.client.IsConnected() {
+		// subscribed on connect
+		return nil
+	}
+	return h.subscribe(topic, handler)
+}
+
+func (h *MqttForwarder) subscribe(topic string, handler func(message []byte)) error {
+	filter := MQTT_TOPIC_PREFIX + "/+/" + strings.ReplaceAll(topic, ".", "/")
+	err := h.client.Subscribe(filter, h.Qos, func(topic string, payload []byte) {
+		payload, err := mqttCommand(topic, payload)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"topic": topic,
+			}).Errorf("invalid mqtt command: %v", err)
+			return
+		}
+		handler(payload)
+	})
+	if err != nil {
+		log.Errorf("error subscribing to mqtt topic %s: %v", filter, err)
+	}
+	return err
+}
+
+// Close marks the piles still online and the gateway offline, since a clean
+// disconnect does not fire the last will.
+func (h *MqttForwarder) Close() error {
+	close(h.quit)
+	<-h.statusDone
+	h.mu.Lock()
+	for id := range h.online {
+		h.statuses[id] = false
+	}
+	h.online = make(map[string]bool)
+	h.mu.Unlock()
+	h.flushStatuses()
+	err := h.client.Publish(MQTT_GATEWAY_STATUS, h.Qos, true, []byte("offline"), "")
+	h.client.Disconnect()
+	return err
+}
+
+// mqtt3Client speaks MQTT 3.1.1.
+type mqtt3Client struct {
+	client mqtt.Client
+}
+
+func newMqtt3Client(h *MqttForwarder) *mqtt3Client {
+	opts := mqtt.NewClientOptions()
+	for _, s := range h.Servers {
+		opts.AddBroker(s)
+	}
+	opts.SetClientID(h.ClientId)
+	opts.SetUsername(h.Username)
+	opts.SetPassword(h.Password)
+	opts.SetWill(MQTT_GATEWAY_STATUS, "offline", h.Qos, true)
+	opts.SetAutoReconnect(true)
+	opts.SetOrderMatters(false)
+	opts.SetOnConnectHandler(func(mqtt.Client) { h.onConnect() })
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Warnf("mqtt connection lost: %v", err)
+	})
+	if h.newClient == nil {
+		h.newClient = mqtt.NewClient
+	}
+	return &mqtt3Client{client: h.newClient(opts)}
+}
+
+func (c *mqtt3Client) Connect() error {
+	t := c.client.Connect()
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timeout connecting to mqtt broker")
+	}
+	return t.Error()
+}
+
+func (c *mqtt3Client) Publish(topic string, qos byte, retained bool, payload []byte, contentType string) error {
+	return mqttWait(c.client.Publish(topic, qos, retained, payload))
+}
+
+func (c *mqtt3Client) Subscribe(filter string, qos byte, handler func(topic string, payload []byte)) error {
+	return mqttWait(c.client.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	}))
+}
+
+func (c *mqtt3Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqtt3Client) Disconnect() {
+	c.client.Disconnect(uint(mqttTimeout / time.Millisecond))
+}
+
+func mqttWait(t mqtt.Token) error {
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timeout waiting for mqtt broker")
+	}
+	return t.Error()
+}
+
+func mqttStatusTopic(id string) string {
+	return MQTT_TOPIC_PREFIX + "/" + mqttDeviceId(id) + "/status"
+}
+
+func mqttDeviceId(id string) string {
+	if id == "" {
+		return "unknown"
+	}
+	return id
+}
+
+// mqttCommand checks the body of a command published to
+// ykc/<pileId>/cmd/<frameType> against the pile id of its topic.
+func mqttCommand(topic string, payload []byte) ([]byte, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 {
+		return nil, errors.New("unexpected topic")
+	}
+	id := parts[1]
+	var body map[string]interface{}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, err
+	}
+	bodyId := MessageDeviceId(payload)
+	if bodyId == "" {
+		body["id"] = id
+		return json.Marshal(body)
+	}
+	if bodyId != id {
+		return nil, errors.New("pile id " + bodyId + " does not match topic")
+	}
+	return payload, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	log "github.com/sirupsen/logrus"
+)
+
+// mqtt5Client speaks MQTT 5, reconnecting like the 3.1.1 client does.
+// Messages are sent with their content type.
+type mqtt5Client struct {
+	h         *MqttForwarder
+	router    *paho.StandardRouter
+	cm        *autopaho.ConnectionManager
+	connected int32
+}
+
+func newMqtt5Client(h *MqttForwarder) *mqtt5Client {
+	return &mqtt5Client{h: h, router: paho.NewStandardRouter()}
+}
+
+func (c *mqtt5Client) Connect() error {
+	h := c.h
+	var urls []*url.URL
+	for _, s := range h.Servers {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return errors.New("no mqtt broker")
+	}
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:     urls,
+		KeepAlive:      30,
+		ConnectTimeout: mqttTimeout,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			atomic.StoreInt32(&c.connected, 1)
+			h.onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Warnf("error connecting to mqtt broker: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: h.ClientId,
+			Router:   c.router,
+			OnClientError: func(err error) {
+				atomic.StoreInt32(&c.connected, 0)
+				log.Warnf("mqtt connection lost: %v", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				atomic.StoreInt32(&c.connected, 0)
+				log.Warnf("mqtt broker disconnected, reason %d", d.ReasonCode)
+			},
+		},
+	}
+	cfg.SetUsernamePassword(h.Username, []byte(h.Password))
+	cfg.SetWillMessage(MQTT_GATEWAY_STATUS, []byte("offline"), h.Qos, true)
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	c.cm = cm
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		_ = cm.Disconnect(context.Background())
+		return errors.New("timeout connecting to mqtt broker")
+	}
+	return nil
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	p := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	}
+	if contentType != "" {
+		p.Properties = &paho.PublishProperties{ContentType: contentType}
+	}
+	_, err := c.cm.Publish(ctx, p)
+	return err
+}
+
+// Subscribe hands the messages to handler on a goroutine of their own, a
+// handler publishing would otherwise wait for an ack the client can not
+// read.
+func (c *mqtt5Client) Subscribe(filter string, qos byte, handler func(topic string, payload []byte)) error {
+	c.router.UnregisterHandler(filter)
+	c.router.RegisterHandler(filter, func(p *paho.Publish) {
+		go handler(p.Topic, p.Payload)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	_, err := c.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{filter: {QoS: qos}},
+	})
+	return err
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+func (c *mqtt5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	_ = c.cm.Disconnect(ctx)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMqttCommand(t *testing.T) {
+	b, err := mqttCommand("ykc/32010600213533/cmd/92", []byte(`{"header":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := MessageDeviceId(b); id != "32010600213533" {
+		t.Errorf("got id %q from topic", id)
+	}
+
+	if _, err := mqttCommand("ykc/32010600213533/cmd/92", []byte(`{"id":"32010600213533"}`)); err != nil {
+		t.Errorf("matching id rejected: %v", err)
+	}
+	if _, err := mqttCommand("ykc/32010600213533/cmd/92", []byte(`{"Id":"32010600213534"}`)); err == nil {
+		t.Error("expected error for id not matching topic")
+	}
+	if _, err := mqttCommand("ykc/32010600213533/cmd/92", []byte(`not json`)); err == nil {
+		t.Error("expected error for invalid json")
+	}
+}
+
+type fakeToken struct{ err error }
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+func (t *fakeToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+type fakeMqttMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+func (m *fakeMqttMessage) Duplicate() bool   { return false }
+func (m *fakeMqttMessage) Qos() byte         { return 1 }
+func (m *fakeMqttMessage) Retained() bool    { return m.retained }
+func (m *fakeMqttMessage) Topic() string     { return m.topic }
+func (m *fakeMqttMessage) MessageID() uint16 { return 0 }
+func (m *fakeMqttMessage) Payload() []byte   { return m.payload }
+func (m *fakeMqttMessage) Ack()              {}
+
+// fakeBroker is an mqtt client talking to a broker of its own: it keeps the
+// retained messages and hands them to new subscriptions.
+type fakeBroker struct {
+	mqtt.Client
+	opts      *mqtt.ClientOptions
+	mu        sync.Mutex
+	published []*fakeMqttMessage
+	retained  map[string]*fakeMqttMessage
+	subs      map[string]mqtt.MessageHandler
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{retained: make(map[string]*fakeMqttMessage), subs: make(map[string]mqtt.MessageHandler)}
+}
+
+func (b *fakeBroker) Connect() mqtt.Token {
+	b.opts.OnConnect(b)
+	return &fakeToken{}
+}
+
+func (b *fakeBroker) IsConnectionOpen() bool { return true }
+
+func (b *fakeBroker) Disconnect(uint) {}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var body []byte
+	switch p := payload.(type) {
+	case string:
+		body = []byte(p)
+	case []byte:
+		body = p
+	}
+	m := &fakeMqttMessage{topic: topic, retained: retained, payload: body}
+	b.mu.Lock()
+	b.published = append(b.published, m)
+	if retained {
+		b.retained[topic] = m
+	}
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range b.subs {
+		if mqttTopicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(b, &fakeMqttMessage{topic: topic, payload: body})
+	}
+	return &fakeToken{}
+}
+
+func (b *fakeBroker) Subscribe(filter string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	b.mu.Lock()
+	b.subs[filter] = callback
+	var retained []*fakeMqttMessage
+	for topic, m := range b.retained {
+		if mqttTopicMatches(filter, topic) {
+			retained = append(retained, m)
+		}
+	}
+	b.mu.Unlock()
+	for _, m := range retained {
+		callback(b, m)
+	}
+	return &fakeToken{}
+}
+
+func (b *fakeBroker) state(topic string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.retained[topic]; ok {
+		return string(m.payload)
+	}
+	return ""
+}
+
+// waitState waits for the pile states published in the background.
+func (b *fakeBroker) waitState(topic string, want string) string {
+	deadline := time.Now().Add(time.Second)
+	for b.state(topic) != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return b.state(topic)
+}
+
+func (b *fakeBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.published)
+}
+
+func mqttTopicMatches(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(f) != len(t) {
+		return false
+	}
+	for i := range f {
+		if f[i] != "+" && f[i] != t[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestMqttForwarder(b *fakeBroker) *MqttForwarder {
+	f := &MqttForwarder{ClientId: "ykc-proxy-server", Qos: 1, newClient: func(o *mqtt.ClientOptions) mqtt.Client {
+		b.opts = o
+		return b
+	}}
+	if err := f.Connect(); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestMqttPublish(t *testing.T) {
+	b := newFakeBroker()
+	f := newTestMqttForwarder(b)
+	if err := f.Publish("13", []byte(`{"id":"32010600213533","gunId":"01"}`)); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	m := b.published[len(b.published)-1]
+	b.mu.Unlock()
+	if m.topic != "ykc/32010600213533/13" || m.retained || !strings.Contains(string(m.payload), `"gunId":"01"`) {
+		t.Fatalf("unexpected message %s %v %s", m.topic, m.retained, m.payload)
+	}
+	if b.opts.WillTopic != MQTT_GATEWAY_STATUS || string(b.opts.WillPayload) != "offline" || !b.opts.WillRetained {
+		t.Fatalf("unexpected last will %s %s", b.opts.WillTopic, b.opts.WillPayload)
+	}
+}
+
+func TestMqttDeviceStatus(t *testing.T) {
+	//a gateway that died left a pile online
+	b := newFakeBroker()
+	b.Publish("ykc/32010600213534/status", 1, true, "online")
+	f := newTestMqttForwarder(b)
+	if s := b.state(MQTT_GATEWAY_STATUS); s != "online" {
+		t.Fatalf("gateway %s", s)
+	}
+	if s := b.waitState("ykc/32010600213534/status", "offline"); s != "offline" {
+		t.Fatalf("stale pile state %s", s)
+	}
+
+	_ = f.PublishDeviceStatus("32010600213533", true)
+	if s := b.waitState("ykc/32010600213533/status", "online"); s != "online" {
+		t.Fatalf("pile %s", s)
+	}
+	//a Huaping pile is online once logged in with 81
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	raw := deviceLoginFrame("861435073900843")
+	DeviceLoginRouter(&Options{MessageForwarder: f}, raw, BytesToHex(raw), &Header{}, server)
+	RemoveClient(server)
+	if s := b.waitState("ykc/861435073900843/status", "online"); s != "online" {
+		t.Fatalf("huaping pile %s", s)
+	}
+	//a pile never reported online is not reported offline
+	n := b.count()
+	_ = f.PublishDeviceStatus("32010600213535", false)
+	time.Sleep(10 * time.Millisecond)
+	if b.count() != n {
+		t.Fatal("offline published for an unknown pile")
+	}
+
+	//a reconnect restores what the last will may have changed
+	b.Publish(MQTT_GATEWAY_STATUS, 1, true, "offline")
+	b.opts.OnConnect(b)
+	if b.state(MQTT_GATEWAY_STATUS) != "online" || b.waitState("ykc/32010600213533/status", "online") != "online" {
+		t.Fatal("states not restored on reconnect")
+	}
+
+	_ = f.Close()
+	if b.state(MQTT_GATEWAY_STATUS) != "offline" || b.state("ykc/32010600213533/status") != "offline" {
+		t.Fatal("states not offline after close")
+	}
+}
+
+func TestMqttStatusDoesNotWait(t *testing.T) {
+	b := newFakeBroker()
+	f := newTestMqttForwarder(b)
+	b.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.PublishDeviceStatus("32010600213536", true)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("login waits for the broker")
+	}
+	b.mu.Unlock()
+	if s := b.waitState("ykc/32010600213536/status", "online"); s != "online" {
+		t.Fatalf("pile %s", s)
+	}
+}
+
+// mqtt5Broker answers an MQTT 5 client on a socket and keeps what it
+// published.
+type mqtt5Broker struct {
+	mu        sync.Mutex
+	connect   *packets.Connect
+	published []*packets.Publish
+}
+
+func (b *mqtt5Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var resp *packets.ControlPacket
+		switch m := p.Content.(type) {
+		case *packets.Connect:
+			b.mu.Lock()
+			b.connect = m
+			b.mu.Unlock()
+			resp = packets.NewControlPacket(packets.CONNACK)
+		case *packets.Subscribe:
+			resp = packets.NewControlPacket(packets.SUBACK)
+			ack := resp.Content.(*packets.Suback)
+			ack.PacketID = m.PacketID
+			for range m.Subscriptions {
+				ack.Reasons = append(ack.Reasons, 1)
+			}
+		case *packets.Publish:
+			//not read from the fixed header by the packets package
+			m.Retain = p.Flags&1 == 1
+			b.mu.Lock()
+			b.published = append(b.published, m)
+			b.mu.Unlock()
+			if m.QoS == 1 {
+				resp = packets.NewControlPacket(packets.PUBACK)
+				resp.Content.(*packets.Puback).PacketID = m.PacketID
+			}
+		case *packets.Pingreq:
+			resp = packets.NewControlPacket(packets.PINGRESP)
+		case *packets.Disconnect:
+			return
+		}
+		if resp != nil {
+			if _, err := resp.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (b *mqtt5Broker) find(topic string) *packets.Publish {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for _, p := range b.published {
+			if p.Topic == topic {
+				b.mu.Unlock()
+				return p
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func TestMqtt5Publish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := &mqtt5Broker{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	f := &MqttForwarder{Servers: []string{"tcp://" + l.Addr().String()}, ClientId: "ykc-proxy-server", Qos: 1, Version: 5}
+	if err := f.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	c := b.connect
+	b.mu.Unlock()
+	if c.ProtocolVersion != 5 || c.WillTopic != MQTT_GATEWAY_STATUS || string(c.WillMessage) != "offline" || !c.WillRetain {
+		t.Fatalf("unexpected connect %v", c)
+	}
+	if err := f.Publish("13", []byte(`{"id":"32010600213533","gunId":"01"}`)); err != nil {
+		t.Fatal(err)
+	}
+	p := b.find("ykc/32010600213533/13")
+	if p == nil || p.Properties.ContentType != "application/json" || !strings.Contains(string(p.Payload), `"gunId":"01"`) {
+		t.Fatalf("unexpected message %v", p)
+	}
+	_ = f.PublishDeviceStatus("32010600213533", true)
+	if p := b.find("ykc/32010600213533/status"); p == nil || !p.Retain || string(p.Payload) != "online" {
+		t.Fatalf("unexpected state %v", p)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestNatsJetStreamDeduplicatesTransactionRecords(t *testing.T) {
+	ns := runJetStreamServer(t)
+	f := &NatsForwarder{Servers: ns.ClientURL(), JetStream: true, Stream: "YKC"}
+	if err := f.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	record := []byte(`{"id":"32010600213533","tradeSeq":"32010600213533012307291034220001"}`)
+	for i := 0; i < 2; i++ {
+		if err := f.Publish("3b", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = f.Publish("13", []byte(`{"id":"32010600213533","tradeSeq":"32010600213533012307291034220001"}`))
+	_ = f.Publish("13", []byte(`{"id":"32010600213533","tradeSeq":"32010600213533012307291034220001"}`))
+
+	info, err := f.js.StreamInfo("YKC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 3 {
+		t.Errorf("expected 3 stored messages, got %d", info.State.Msgs)
+	}
+
+	// a second gateway finds the stream in place
+	g := &NatsForwarder{Servers: ns.ClientURL(), JetStream: true, Stream: "YKC"}
+	if err := g.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// commands are not captured by the stream
+	if _, err := f.nc.Request(NATS_PUBLISH_SUBJECT_PREFIX+".cmd.34", []byte(`{}`), 100*time.Millisecond); err == nil {
+		t.Error("command request answered by the stream")
+	}
+}
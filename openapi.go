@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const OPENAPI_VERSION = "3.1.0"
+
+// ApiMessage is the body of the answers of the http api that carry no data,
+// errors included. Errors lists what is wrong with an invalid request.
+type ApiMessage struct {
+	Message string   `json:"message" schema:"required"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// apiParameter is a path or query parameter of an operation.
+type apiParameter struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+	Schema      map[string]interface{}
+}
+
+// apiResponse is an answer of an operation. A nil Type is an object the
+// document does not describe further, List makes it an array of Type.
+type apiResponse struct {
+	Description string
+	Type        reflect.Type
+	List        bool
+	ContentType string
+}
+
+// apiOperation documents a route of the http api. Request is the message
+// taken as body, its fields named like path parameters are taken from the
+// path instead. Path parameters not listed in Parameters are described by
+// the field of Request with their name, or as strings.
+type apiOperation struct {
+	Summary    string
+	Tag        string
+	Role       string
+	Request    reflect.Type
+	Parameters []apiParameter
+	Responses  map[int]apiResponse
+}
+
+var (
+	apiMessageType    = reflect.TypeOf(ApiMessage{})
+	queuedCommandType = reflect.TypeOf(QueuedCommand{})
+	outboxEntryType   = reflect.TypeOf(OutboxEntry{})
+	deviceSessionType = reflect.TypeOf(DeviceSession{})
+	commandResultType = reflect.TypeOf(CommandResult{})
+)
+
+func stringParameter(name string, in string, description string) apiParameter {
+	return apiParameter{Name: name, In: in, Description: description, Required: in == "path", Schema: map[string]interface{}{"type": "string"}}
+}
+
+var (
+	sinkParameter       = stringParameter("sink", "query", "forwarder of the outbox, empty for the only one")
+	storeLimitParameter = apiParameter{Name: "limit", In: "query", Description: "at most this many, 100 by default", Schema: map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxStoreLimit}}
+	seqParameter        = apiParameter{Name: "seq", In: "path", Required: true, Schema: map[string]interface{}{"type": "integer", "minimum": 0}}
+	// the live feeds take the filters of EventFilter
+	eventParameters = []apiParameter{
+		stringParameter("frameType", "query", "frame types, repeated or comma separated"),
+		{Name: "direction", In: "query", Schema: map[string]interface{}{"type": "string", "enum": []string{DirectionUplink, DirectionDownlink}}},
+		{Name: "raw", In: "query", Description: "send the frames as hex too", Schema: map[string]interface{}{"type": "boolean"}},
+		stringParameter("access_token", "query", "api key or bearer token, for clients that can not set headers"),
+	}
+)
+
+// apiOperations documents the routes of newHttpRouter by method and path;
+// the commands under /proxy are described by their message schemas (see
+// proxyOperation).
+var apiOperations = map[string]apiOperation{
+	"GET /openapi.json": {
+		Summary: "This document",
+		Tag:     "docs",
+		Responses: map[int]apiResponse{
+			200: {Description: "OpenAPI document"},
+		},
+	},
+	"GET /swagger": {
+		Summary: "Swagger UI of this document",
+		Tag:     "docs",
+		Responses: map[int]apiResponse{
+			200: {Description: "html page", ContentType: "text/html"},
+		},
+	},
+	"GET /swagger/swagger-ui.css": {
+		Summary: "Style sheet of Swagger UI",
+		Tag:     "docs",
+		Responses: map[int]apiResponse{
+			200: {Description: "css file", ContentType: "text/css"},
+		},
+	},
+	"GET /swagger/swagger-ui-bundle.js": {
+		Summary: "Script of Swagger UI",
+		Tag:     "docs",
+		Responses: map[int]apiResponse{
+			200: {Description: "javascript file", ContentType: "text/javascript"},
+		},
+	},
+	"GET /schemas": {
+		Summary: "JSON Schemas of all messages",
+		Tag:     "schemas",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "schemas keyed by frame type"},
+		},
+	},
+	"GET /schemas/:frameType": {
+		Summary: "JSON Schema of the message of a frame type, or ykc.proto",
+		Tag:     "schemas",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "JSON Schema"},
+			404: {Description: "no such frame type", Type: apiMessageType},
+		},
+	},
+	"GET /commands": {
+		Summary:    "Queued commands",
+		Tag:        "commands",
+		Role:       RoleReadOnly,
+		Parameters: []apiParameter{stringParameter("deviceId", "query", "only the commands for this pile")},
+		Responses: map[int]apiResponse{
+			200: {Description: "commands, oldest first", Type: queuedCommandType, List: true},
+		},
+	},
+	"GET /commands/:id": {
+		Summary: "A queued command",
+		Tag:     "commands",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "the command", Type: queuedCommandType},
+			404: {Description: "no such command", Type: apiMessageType},
+		},
+	},
+	"GET /outbox": {
+		Summary:    "Messages waiting in the outbox",
+		Tag:        "outbox",
+		Role:       RoleAdmin,
+		Parameters: []apiParameter{sinkParameter, stringParameter("deviceId", "query", "only the messages of this pile")},
+		Responses: map[int]apiResponse{
+			200: {Description: "waiting messages", Type: outboxEntryType, List: true},
+			404: {Description: "no such outbox", Type: apiMessageType},
+		},
+	},
+	"GET /outbox/dead": {
+		Summary:    "Dead letters of the outbox",
+		Tag:        "outbox",
+		Role:       RoleAdmin,
+		Parameters: []apiParameter{sinkParameter},
+		Responses: map[int]apiResponse{
+			200: {Description: "dead letters", Type: outboxEntryType, List: true},
+			404: {Description: "no such outbox", Type: apiMessageType},
+		},
+	},
+	"POST /outbox/:seq/replay": {
+		Summary:    "Forward a dead letter again",
+		Tag:        "outbox",
+		Role:       RoleAdmin,
+		Parameters: []apiParameter{sinkParameter, seqParameter},
+		Responses: map[int]apiResponse{
+			200: {Description: "the message, back in the outbox", Type: outboxEntryType},
+			404: {Description: "no such outbox or dead letter", Type: apiMessageType},
+			500: {Description: "the outbox could not be written", Type: apiMessageType},
+		},
+	},
+	"DELETE /outbox/dead/:seq": {
+		Summary:    "Drop a dead letter",
+		Tag:        "outbox",
+		Role:       RoleAdmin,
+		Parameters: []apiParameter{sinkParameter, seqParameter},
+		Responses: map[int]apiResponse{
+			200: {Description: "dropped", Type: apiMessageType},
+			404: {Description: "no such outbox or dead letter", Type: apiMessageType},
+		},
+	},
+	"GET /stats": {
+		Summary: "Connection count and limit counters",
+		Tag:     "devices",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "counters"},
+		},
+	},
+	"GET /devices": {
+		Summary: "Connected piles",
+		Tag:     "devices",
+		Role:    RoleReadOnly,
+		Parameters: []apiParameter{
+			{Name: "offline", In: "query", Description: "add the last session of the piles not connected, with -storeFile", Schema: map[string]interface{}{"type": "boolean"}},
+		},
+		Responses: map[int]apiResponse{
+			200: {Description: "piles that have logged in, by id", Type: deviceSessionType, List: true},
+		},
+	},
+	"GET /devices/:id": {
+		Summary: "A connected pile, or its last session with -storeFile",
+		Tag:     "devices",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "the pile", Type: deviceSessionType},
+			404: {Description: "not connected", Type: apiMessageType},
+		},
+	},
+	"GET /devices/:id/sessions": {
+		Summary:    "Stored sessions of a pile, with -storeFile",
+		Tag:        "store",
+		Role:       RoleReadOnly,
+		Parameters: []apiParameter{storeLimitParameter},
+		Responses: map[int]apiResponse{
+			200: {Description: "sessions, newest first", Type: deviceSessionType, List: true},
+		},
+	},
+	"GET /devices/:id/commands": {
+		Summary:    "Commands sent to a pile over the apis, with -storeFile",
+		Tag:        "store",
+		Role:       RoleReadOnly,
+		Parameters: []apiParameter{storeLimitParameter},
+		Responses: map[int]apiResponse{
+			200: {Description: "commands, newest first", Type: reflect.TypeOf(FrameRecord{}), List: true},
+		},
+	},
+	"GET /devices/:id/billing-model": {
+		Summary: "Billing model last sent to a pile (0a or 58), with -storeFile",
+		Tag:     "store",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "the billing model", Type: reflect.TypeOf(BillingModelRecord{})},
+			404: {Description: "none sent", Type: apiMessageType},
+		},
+	},
+	"GET /transactions": {
+		Summary: "Stored transaction records (3b), with -storeFile",
+		Tag:     "store",
+		Role:    RoleReadOnly,
+		Parameters: []apiParameter{
+			stringParameter("id", "query", "pile id, every pile in scope by default"),
+			stringParameter("from", "query", "RFC 3339 time, a day before to by default"),
+			stringParameter("to", "query", "RFC 3339 time, now by default"),
+			{Name: "unconfirmed", In: "query", Description: "only the records not confirmed yet, however old unless from is given", Schema: map[string]interface{}{"type": "boolean"}},
+			storeLimitParameter,
+		},
+		Responses: map[int]apiResponse{
+			200: {Description: "records received between from and to, oldest first", Type: reflect.TypeOf(StoredTransaction{}), List: true},
+			403: {Description: "pile not in scope", Type: apiMessageType},
+		},
+	},
+	"GET /transactions/:tradeSeq": {
+		Summary: "A stored transaction record (3b), with -storeFile",
+		Tag:     "store",
+		Role:    RoleReadOnly,
+		Responses: map[int]apiResponse{
+			200: {Description: "the record", Type: reflect.TypeOf(StoredTransaction{})},
+			404: {Description: "not found", Type: apiMessageType},
+		},
+	},
+	"GET /devices/:id/guns/:gun": {
+		Summary:    "State of a gun",
+		Tag:        "devices",
+		Role:       RoleReadOnly,
+		Parameters: []apiParameter{{Name: "gun", In: "path", Required: true, Schema: map[string]interface{}{"type": "string", "pattern": "^[0-9a-fA-F]{2}$"}}},
+		Responses: map[int]apiResponse{
+			200: {Description: "the gun", Type: reflect.TypeOf(GunState{})},
+			404: {Description: "not connected, or no state reported", Type: apiMessageType},
+		},
+	},
+	"GET /devices/:id/frames": {
+		Summary: "Recorded frames of a pile, with -frameHistoryDir",
+		Tag:     "devices",
+		Role:    RoleReadOnly,
+		Parameters: []apiParameter{
+			stringParameter("from", "query", "RFC 3339 time, a day before to by default and at most 31 days before it"),
+			stringParameter("to", "query", "RFC 3339 time, now by default"),
+			stringParameter("type", "query", "frame types, repeated or comma separated"),
+			{Name: "direction", In: "query", Schema: map[string]interface{}{"type": "string", "enum": []string{DirectionUplink, DirectionDownlink}}},
+			{Name: "limit", In: "query", Description: "at most this many frames, the oldest", Schema: map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxFramesLimit}},
+		},
+		Responses: map[int]apiResponse{
+			200: {Description: "frames, oldest first", Type: reflect.TypeOf(FrameRecord{}), List: true},
+		},
+	},
+	"POST /devices/:id/ports/:port/start": {
+		Summary:   "Start charging on a port of a Huaping pile (83)",
+		Tag:       "commands",
+		Role:      RoleOperator,
+		Request:   reflect.TypeOf(RemoteStartRequestMessage{}),
+		Responses: portCommandResponses,
+	},
+	"POST /devices/:id/ports/:port/stop": {
+		Summary:   "Stop charging on a port of a Huaping pile (84)",
+		Tag:       "commands",
+		Role:      RoleOperator,
+		Request:   reflect.TypeOf(RemoteStopRequestMessage{}),
+		Responses: portCommandResponses,
+	},
+	"DELETE /devices/:id/connection": {
+		Summary: "Drop the connection of a pile",
+		Tag:     "devices",
+		Role:    RoleAdmin,
+		Responses: map[int]apiResponse{
+			200: {Description: "closed", Type: apiMessageType},
+			404: {Description: "not connected", Type: apiMessageType},
+			500: {Description: "the connection could not be closed", Type: apiMessageType},
+		},
+	},
+	"GET /events": {
+		Summary:    "Live traffic of the piles as server-sent events",
+		Tag:        "events",
+		Role:       RoleReadOnly,
+		Parameters: append([]apiParameter{stringParameter("id", "query", "pile ids, repeated or comma separated")}, eventParameters...),
+		Responses: map[int]apiResponse{
+			200: {Description: "events named by direction", Type: reflect.TypeOf(Event{}), ContentType: "text/event-stream"},
+		},
+	},
+	"GET /ws/devices/:id": {
+		Summary:    "Live traffic of a pile over a WebSocket",
+		Tag:        "events",
+		Role:       RoleReadOnly,
+		Parameters: eventParameters,
+		Responses: map[int]apiResponse{
+			101: {Description: "one json Event per message"},
+		},
+	},
+}
+
+var portCommandResponses = map[int]apiResponse{
+	200: {Description: "the pile replied", Type: commandResultType},
+	202: {Description: "queued, with -commandQueue", Type: commandResultType},
+	404: {Description: "not connected", Type: commandResultType},
+	500: {Description: "the command could not be sent", Type: commandResultType},
+	504: {Description: "no reply in time", Type: commandResultType},
+}
+
+// proxyOperation describes the command of a frame type posted to
+// /proxy/<frameType>.
+func proxyOperation(frameType string) (apiOperation, bool) {
+	ms, ok := LookupCommandSchema(frameType)
+	if !ok {
+		return apiOperation{}, false
+	}
+	return apiOperation{
+		Summary: fmt.Sprintf("Send %s (%s)", ms.Type.Name(), ms.FrameType),
+		Tag:     "commands",
+		Role:    RoleOperator,
+		Request: ms.Type,
+		Parameters: []apiParameter{{
+			Name:        "ttl",
+			In:          "query",
+			Description: "how long a queued command waits for the pile, e.g. 10m, with -commandQueue",
+			Schema:      map[string]interface{}{"type": "string"},
+		}},
+		Responses: map[int]apiResponse{
+			200: {Description: "sent", Type: apiMessageType},
+			202: {Description: "queued, with -commandQueue", Type: queuedCommandType},
+			500: {Description: "the command could not be sent", Type: apiMessageType},
+		},
+	}, true
+}
+
+// lookupApiOperation finds the operation of a route, path as registered
+// with gin.
+func lookupApiOperation(method string, path string) (apiOperation, bool) {
+	if method == "POST" && strings.HasPrefix(path, "/proxy/") {
+		return proxyOperation(strings.TrimPrefix(path, "/proxy/"))
+	}
+	op, ok := apiOperations[method+" "+path]
+	return op, ok
+}
+
+// pathParameters returns the names of the parameters of a gin path.
+func pathParameters(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			names = append(names, seg[1:])
+		}
+	}
+	return names
+}
+
+// openapiPath turns /devices/:id into /devices/{id}.
+func openapiPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			segs[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// parameters returns the declared parameters of the operation of path and
+// the path parameters it does not declare.
+func (op apiOperation) parameters(path string) []apiParameter {
+	params := append([]apiParameter(nil), op.Parameters...)
+	for _, name := range pathParameters(path) {
+		declared := false
+		for _, p := range op.Parameters {
+			declared = declared || (p.In == "path" && p.Name == name)
+		}
+		if declared {
+			continue
+		}
+		p := stringParameter(name, "path", "")
+		if op.Request != nil {
+			for _, f := range schemaFields(op.Request) {
+				if f.Name == name {
+					p.Schema = fieldSchema(f)
+				}
+			}
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// requestSchema is the schema of the body of the operation of path, without
+// the fields taken from the path.
+func (op apiOperation) requestSchema(path string) map[string]interface{} {
+	js := objectSchema(op.Request)
+	fromPath := pathParameters(path)
+	if len(fromPath) == 0 {
+		return js
+	}
+	props := make(map[string]interface{})
+	for name, p := range js["properties"].(map[string]interface{}) {
+		if !containsString(fromPath, name) {
+			props[name] = p
+		}
+	}
+	js["properties"] = props
+	if required, ok := js["required"].([]string); ok {
+		var left []string
+		for _, name := range required {
+			if !containsString(fromPath, name) {
+				left = append(left, name)
+			}
+		}
+		js["required"] = left
+		if len(left) == 0 {
+			delete(js, "required")
+		}
+	}
+	js["title"] = op.Request.Name() + "Body"
+	return js
+}
+
+// OpenAPIDocument describes the routes of the http api. Routes without an
+// apiOperation are left out.
+func OpenAPIDocument(routes gin.RoutesInfo) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	ref := func(js map[string]interface{}) map[string]interface{} {
+		name := js["title"].(string)
+		schemas[name] = js
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	paths := make(map[string]interface{})
+	for _, r := range routes {
+		op, ok := lookupApiOperation(r.Method, r.Path)
+		if !ok {
+			continue
+		}
+		o := map[string]interface{}{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": operationId(r.Method, r.Path),
+		}
+		if op.Role != "" {
+			o["description"] = "Requires role " + op.Role + " when authentication is enabled."
+		} else {
+			o["security"] = []interface{}{}
+		}
+		var params []interface{}
+		for _, p := range op.parameters(r.Path) {
+			param := map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   p.Schema,
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		responses := make(map[string]interface{})
+		if op.Request != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": ref(op.requestSchema(r.Path))},
+				},
+			}
+		}
+		if op.Request != nil || len(params) > 0 {
+			responses["400"] = map[string]interface{}{"$ref": "#/components/responses/BadRequest"}
+		}
+		if op.Role != "" {
+			responses["401"] = map[string]interface{}{"$ref": "#/components/responses/Unauthorized"}
+			responses["403"] = map[string]interface{}{"$ref": "#/components/responses/Forbidden"}
+		}
+		for code, res := range op.Responses {
+			response := map[string]interface{}{"description": res.Description}
+			if code != 101 {
+				schema := map[string]interface{}{"type": "object"}
+				if res.Type != nil {
+					schema = ref(objectSchema(res.Type))
+				}
+				if res.List {
+					schema = map[string]interface{}{"type": "array", "items": schema}
+				}
+				contentType := res.ContentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				response["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": schema}}
+			}
+			responses[strconv.Itoa(code)] = response
+		}
+		o["responses"] = responses
+		path := openapiPath(r.Path)
+		item, _ := paths[path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(r.Method)] = o
+	}
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": ref(objectSchema(apiMessageType))},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":       "ykc-proxy-server",
+			"version":     SCHEMA_VERSION,
+			"description": "Commands to and state of the charging piles connected to the proxy.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"responses": map[string]interface{}{
+				"BadRequest":   errorResponse("the request does not match this document"),
+				"Unauthorized": errorResponse("missing or invalid api key or bearer token"),
+				"Forbidden":    errorResponse("the role or devices of the caller do not allow the request"),
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "api key or JWT"},
+			},
+		},
+		// authentication is optional, see -apiKeys and -jwks
+		"security": []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{},
+		},
+	}
+}
+
+// operationId names an operation after its method and path, e.g.
+// getDevicesIdGunsGun.
+func operationId(method string, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '.' || r == ':' || r == '*' }) {
+		b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return b.String()
+}
+
+// ValidateRequest checks the parameters and the body of a request against
+// the operation of its route and answers 400 with what is wrong.
+func ValidateRequest(c *gin.Context) {
+	op, ok := lookupApiOperation(c.Request.Method, c.FullPath())
+	if !ok {
+		return
+	}
+	var errs []string
+	for _, p := range op.parameters(c.FullPath()) {
+		var v string
+		var present bool
+		if p.In == "path" {
+			v, present = c.Params.Get(p.Name)
+		} else {
+			v, present = c.GetQuery(p.Name)
+		}
+		if !present {
+			if p.Required {
+				errs = append(errs, p.Name+": is required")
+			}
+			continue
+		}
+		validateValue(p.Schema, parameterValue(p.Schema, v), p.Name, &errs)
+	}
+	message := "invalid request"
+	if op.Request != nil {
+		message = "invalid command"
+		d := json.NewDecoder(bytes.NewReader(peekBody(c)))
+		d.UseNumber()
+		var body interface{}
+		if err := d.Decode(&body); err != nil {
+			errs = append(errs, "invalid json: "+err.Error())
+		} else {
+			validateValue(op.requestSchema(c.FullPath()), body, "", &errs)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		c.AbortWithStatusJSON(400, ApiMessage{Message: message, Errors: errs})
+	}
+}
+
+// parameterValue converts a parameter to the type of its schema, as it
+// would be decoded from json; a value that does not convert stays a string
+// and fails validation.
+func parameterValue(schema map[string]interface{}, v string) interface{} {
+	switch schema["type"] {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
+
+// OpenAPIRouter serves the OpenAPI document of the routes of the router.
+func OpenAPIRouter(r *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, OpenAPIDocument(r.Routes()))
+	}
+}
+
+const swaggerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ykc-proxy-server</title>
+<link rel="stylesheet" href="swagger/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="swagger/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// swaggerAssets are the files of swagger-ui-dist 5 (Apache License 2.0)
+// the page needs, so Swagger UI works without internet access.
+//
+//go:embed swagger/swagger-ui.css swagger/swagger-ui-bundle.js
+var swaggerAssets embed.FS
+
+// SwaggerRouter serves Swagger UI on the OpenAPI document.
+func SwaggerRouter(c *gin.Context) {
+	c.Data(200, "text/html; charset=utf-8", []byte(swaggerPage))
+}
+
+// SwaggerAssetRouter serves an embedded file of Swagger UI.
+func SwaggerAssetRouter(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.FileFromFS("swagger/"+name, http.FS(swaggerAssets))
+	}
+}
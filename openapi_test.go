@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	commandQueue, outboxes[""] = &CommandQueue{}, &Outbox{}
+	frameHistory, store = &FrameHistory{}, &Store{}
+	defer func() {
+		commandQueue = nil
+		delete(outboxes, "")
+		frameHistory, store = nil, nil
+	}()
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	for _, route := range r.Routes() {
+		if _, ok := lookupApiOperation(route.Method, route.Path); !ok {
+			t.Errorf("%s %s is not documented", route.Method, route.Path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	body := w.Body.String()
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["openapi"] != OPENAPI_VERSION {
+		t.Fatalf("unexpected document %d %s", w.Code, body)
+	}
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, ref := range strings.Split(body, `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if schemas[name] == nil {
+			t.Errorf("schema %s is referenced but missing", name)
+		}
+	}
+	start := doc["paths"].(map[string]interface{})["/devices/{id}/ports/{port}/start"].(map[string]interface{})["post"].(map[string]interface{})
+	b, _ := json.Marshal(start)
+	if !strings.Contains(string(b), "RemoteStartRequestMessageBody") || !strings.Contains(string(b), `"name":"port"`) {
+		t.Fatalf("unexpected operation %s", b)
+	}
+	if props := schemas["RemoteStartRequestMessageBody"].(map[string]interface{})["properties"].(map[string]interface{}); props["id"] != nil || props["orderNumber"] == nil {
+		t.Fatalf("path fields left in the body %v", props)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	for _, tc := range []struct {
+		method, path, body string
+		want               string
+	}{
+		{"POST", "/proxy/92", `{"id":"32010600213533","control":"1"}`, "control: must be of type integer"},
+		{"POST", "/proxy/92", `{"id":"32010600213533",`, "invalid json"},
+		{"POST", "/devices/861435073900843/ports/0/start", `{"orderNumber":1,"chargingMode":1}`, "port: must be at least 1"},
+		{"GET", "/events?direction=sideways", "", "direction: must be one of uplink, downlink"},
+		{"GET", "/devices/32010600213533/guns/1", "", "gun: must match"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		var res ApiMessage
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != 400 || len(res.Errors) == 0 || !strings.Contains(res.Errors[0], tc.want) {
+			t.Errorf("%s %s answered %d %s", tc.method, tc.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSwaggerServesEmbeddedAssets(t *testing.T) {
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/swagger", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "https://") {
+		t.Fatalf("unexpected page %d %s", w.Code, w.Body.String())
+	}
+	for file, contentType := range map[string]string{"swagger-ui.css": "text/css", "swagger-ui-bundle.js": "text/javascript"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/swagger/"+file, nil))
+		if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), contentType) || w.Body.Len() == 0 {
+			t.Errorf("unexpected answer for %s: %d %s", file, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
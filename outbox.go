@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+var (
+	ErrOutboxFull          = errors.New("outbox is full")
+	ErrOutboxEntryNotFound = errors.New("outbox entry does not exist")
+)
+
+// outboxes by the name of the sink they feed, "" without message routing
+var outboxes = make(map[string]*Outbox)
+
+// WithOutbox puts an outbox in front of a forwarder. The outbox of a routing
+// sink lives in a sub directory named after the sink.
+func WithOutbox(name string, f MessageForwarder, opt *Options) (MessageForwarder, error) {
+	o, err := NewOutbox(filepath.Join(opt.OutboxDir, name), f, opt.OutboxMaxEntries, opt.OutboxMaxBytes, opt.OutboxMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	_ = o.Connect()
+	outboxes[name] = o
+	return o, nil
+}
+
+// OutboxEntry is a device message waiting to be forwarded, or given up on
+// in the dead letter store.
+type OutboxEntry struct {
+	Seq         uint64          `json:"seq"`
+	DeviceId    string          `json:"deviceId"`
+	Mid         string          `json:"mid"`
+	Message     json.RawMessage `json:"message"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+	// CloudEvents attributes of a binary mode event
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Outbox sits between the routers and the forwarder. A message is written to
+// Dir before Publish returns and deleted once the forwarder took it; failed
+// deliveries are retried with exponential back off. Messages of one pile are
+// forwarded in order, so a failing message holds back the ones after it
+// until it is delivered or, after MaxAttempts, moved to the dead letter
+// store. The dead letter store is held to MaxEntries and MaxBytes on its
+// own, dropping the oldest dead letters.
+type Outbox struct {
+	Dir         string
+	Forwarder   MessageForwarder
+	MaxEntries  int
+	MaxBytes    int64
+	MaxAttempts int
+
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[string][]*OutboxEntry
+	dead     map[uint64]*OutboxEntry
+	inflight map[string]bool
+	count    int
+	size     int64
+	deadSize int64
+	wake     chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewOutbox(dir string, f MessageForwarder, maxEntries int, maxBytes int64, maxAttempts int) (*Outbox, error) {
+	o := &Outbox{
+		Dir:         dir,
+		Forwarder:   f,
+		MaxEntries:  maxEntries,
+		MaxBytes:    maxBytes,
+		MaxAttempts: maxAttempts,
+		pending:     make(map[string][]*OutboxEntry),
+		dead:        make(map[uint64]*OutboxEntry),
+		inflight:    make(map[string]bool),
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+	}
+	for _, d := range []string{o.pendingDir(), o.deadDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Outbox) pendingDir() string {
+	return filepath.Join(o.Dir, "pending")
+}
+
+func (o *Outbox) deadDir() string {
+	return filepath.Join(o.Dir, "dead")
+}
+
+func entryFile(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (o *Outbox) load() error {
+	pending, err := readOutboxEntries(o.pendingDir())
+	if err != nil {
+		return err
+	}
+	dead, err := readOutboxEntries(o.deadDir())
+	if err != nil {
+		return err
+	}
+	for _, e := range pending {
+		o.pending[e.DeviceId] = append(o.pending[e.DeviceId], e)
+		o.count++
+		o.size += int64(len(e.Message))
+		if e.Seq > o.seq {
+			o.seq = e.Seq
+		}
+	}
+	for _, e := range dead {
+		o.dead[e.Seq] = e
+		o.deadSize += int64(len(e.Message))
+		if e.Seq > o.seq {
+			o.seq = e.Seq
+		}
+	}
+	o.pruneDead()
+	log.WithFields(log.Fields{
+		"dir":     o.Dir,
+		"pending": len(pending),
+		"dead":    len(dead),
+	}).Info("outbox loaded")
+	return nil
+}
+
+// readOutboxEntries returns the entries stored in dir, oldest first.
+func readOutboxEntries(dir string) ([]*OutboxEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*OutboxEntry
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e OutboxEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			log.Errorf("skipping broken outbox entry %s: %v", f.Name(), err)
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries, nil
+}
+
+// writeOutboxEntry stores an entry durably: written to a temporary file,
+// synced and renamed into place.
+func writeOutboxEntry(dir string, e *OutboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	file := entryFile(dir, e.Seq)
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (o *Outbox) Connect() error {
+	o.wg.Add(1)
+	go o.run()
+	return nil
+}
+
+// Publish stores the message, it is forwarded in the background. An error
+// means the message is not stored.
+func (o *Outbox) Publish(mid string, message []byte) error {
+	return o.store(mid, message, nil)
+}
+
+// PublishEvent stores the CloudEvents attributes with the message if the
+// forwarder takes binary mode events, else the structured envelope.
+func (o *Outbox) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	if _, ok := o.Forwarder.(BinaryEventPublisher); !ok {
+		return publishStructuredEvent(o, mid, message, attrs)
+	}
+	return o.store(mid, message, attrs)
+}
+
+func (o *Outbox) store(mid string, message []byte, attrs map[string]string) error {
+	//a transaction record is confirmed to the pile once it is forwarded, so
+	//it skips the outbox; an unconfirmed record is uploaded again
+	if mid == "3b" {
+		if attrs != nil {
+			return publishEvent(o.Forwarder, mid, message, attrs)
+		}
+		return o.Forwarder.Publish(mid, message)
+	}
+	if !json.Valid(message) {
+		return errors.New("outbox only takes json messages")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if (o.MaxEntries > 0 && o.count >= o.MaxEntries) || (o.MaxBytes > 0 && o.size+int64(len(message)) > o.MaxBytes) {
+		log.WithFields(log.Fields{
+			"mid":     mid,
+			"entries": o.count,
+			"bytes":   o.size,
+		}).Error("outbox is full, dropping message")
+		return ErrOutboxFull
+	}
+	o.seq++
+	now := time.Now()
+	e := &OutboxEntry{
+		Seq:         o.seq,
+		DeviceId:    MessageDeviceId(message),
+		Mid:         mid,
+		Message:     message,
+		CreatedAt:   now,
+		NextAttempt: now,
+		Attributes:  attrs,
+	}
+	if err := writeOutboxEntry(o.pendingDir(), e); err != nil {
+		log.Errorf("error writing outbox entry: %v", err)
+		return err
+	}
+	o.pending[e.DeviceId] = append(o.pending[e.DeviceId], e)
+	o.count++
+	o.size += int64(len(message))
+	o.notify()
+	return nil
+}
+
+func (o *Outbox) Subscribe(topic string, handler func(message []byte)) error {
+	return o.Forwarder.Subscribe(topic, handler)
+}
+
+func (o *Outbox) PublishDeviceStatus(id string, online bool) error {
+	if p, ok := o.Forwarder.(DeviceStatusPublisher); ok {
+		return p.PublishDeviceStatus(id, online)
+	}
+	return nil
+}
+
+// Close waits for deliveries in flight, the rest stays on disk for the next
+// start.
+func (o *Outbox) Close() error {
+	close(o.quit)
+	o.wg.Wait()
+	return o.Forwarder.Close()
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) run() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		o.dispatch()
+		select {
+		case <-o.quit:
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch starts delivering the oldest message of every pile that is due.
+func (o *Outbox) dispatch() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for deviceId, entries := range o.pending {
+		if o.inflight[deviceId] || len(entries) == 0 || entries[0].NextAttempt.After(now) {
+			continue
+		}
+		o.inflight[deviceId] = true
+		o.wg.Add(1)
+		go o.deliver(entries[0])
+	}
+}
+
+func (o *Outbox) deliver(e *OutboxEntry) {
+	defer o.wg.Done()
+	var err error
+	if e.Attributes != nil {
+		err = publishEvent(o.Forwarder, e.Mid, e.Message, e.Attributes)
+	} else {
+		err = o.Forwarder.Publish(e.Mid, e.Message)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	defer o.notify()
+	o.inflight[e.DeviceId] = false
+	entries := o.pending[e.DeviceId]
+	if len(entries) == 0 || entries[0] != e {
+		// replayed or dropped meanwhile
+		return
+	}
+	if err == nil {
+		o.remove(e)
+		_ = os.Remove(entryFile(o.pendingDir(), e.Seq))
+		return
+	}
+
+	e.Attempts++
+	e.LastError = err.Error()
+	if o.MaxAttempts > 0 && e.Attempts >= o.MaxAttempts {
+		log.WithFields(log.Fields{
+			"seq":       e.Seq,
+			"device_id": e.DeviceId,
+			"mid":       e.Mid,
+			"attempts":  e.Attempts,
+		}).Error("giving up forwarding message, moved to dead letter store")
+		o.remove(e)
+		o.dead[e.Seq] = e
+		o.deadSize += int64(len(e.Message))
+		if err := writeOutboxEntry(o.deadDir(), e); err != nil {
+			log.Errorf("error writing dead letter entry: %v", err)
+			return
+		}
+		_ = os.Remove(entryFile(o.pendingDir(), e.Seq))
+		o.pruneDead()
+		return
+	}
+	backoff := outboxMinBackoff << uint(e.Attempts-1)
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		backoff = outboxMaxBackoff
+	}
+	e.NextAttempt = time.Now().Add(backoff)
+	_ = writeOutboxEntry(o.pendingDir(), e)
+}
+
+// remove takes the head entry of its pile off the pending queue. Must be
+// called with o.mu held.
+func (o *Outbox) remove(e *OutboxEntry) {
+	entries := o.pending[e.DeviceId][1:]
+	if len(entries) == 0 {
+		delete(o.pending, e.DeviceId)
+	} else {
+		o.pending[e.DeviceId] = entries
+	}
+	o.count--
+	o.size -= int64(len(e.Message))
+}
+
+// pruneDead drops the oldest dead letters beyond MaxEntries and MaxBytes.
+// Must be called with o.mu held.
+func (o *Outbox) pruneDead() {
+	full := func() bool {
+		return (o.MaxEntries > 0 && len(o.dead) > o.MaxEntries) || (o.MaxBytes > 0 && o.deadSize > o.MaxBytes)
+	}
+	if !full() {
+		return
+	}
+	seqs := make([]uint64, 0, len(o.dead))
+	for seq := range o.dead {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		if !full() {
+			return
+		}
+		e := o.dead[seq]
+		log.WithFields(log.Fields{
+			"seq":       e.Seq,
+			"device_id": e.DeviceId,
+			"mid":       e.Mid,
+		}).Warn("dead letter store is full, dropping oldest dead letter")
+		delete(o.dead, seq)
+		o.deadSize -= int64(len(e.Message))
+		_ = os.Remove(entryFile(o.deadDir(), seq))
+	}
+}
+
+// copy returns a snapshot of the entry, which the retry loop keeps changing.
+func (e *OutboxEntry) copy() *OutboxEntry {
+	c := *e
+	return &c
+}
+
+// Pending lists the entries waiting to be forwarded, of one pile if deviceId
+// is not empty.
+func (o *Outbox) Pending(deviceId string) []*OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]*OutboxEntry, 0)
+	for id, entries := range o.pending {
+		if deviceId == "" || id == deviceId {
+			for _, e := range entries {
+				list = append(list, e.copy())
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seq < list[j].Seq
+	})
+	return list
+}
+
+func (o *Outbox) Dead() []*OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]*OutboxEntry, 0, len(o.dead))
+	for _, e := range o.dead {
+		list = append(list, e.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seq < list[j].Seq
+	})
+	return list
+}
+
+// Replay retries a pending entry right away, or puts a dead letter back into
+// the pending queue of its pile, behind the messages queued meanwhile.
+func (o *Outbox) Replay(seq uint64) (*OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	defer o.notify()
+	for _, entries := range o.pending {
+		for _, e := range entries {
+			if e.Seq == seq {
+				e.NextAttempt = time.Now()
+				return e.copy(), nil
+			}
+		}
+	}
+	e, ok := o.dead[seq]
+	if !ok {
+		return nil, ErrOutboxEntryNotFound
+	}
+	e.Attempts = 0
+	e.NextAttempt = time.Now()
+	if err := writeOutboxEntry(o.pendingDir(), e); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(entryFile(o.deadDir(), seq))
+	delete(o.dead, seq)
+	o.deadSize -= int64(len(e.Message))
+	o.pending[e.DeviceId] = append(o.pending[e.DeviceId], e)
+	o.count++
+	o.size += int64(len(e.Message))
+	return e.copy(), nil
+}
+
+// DropDead deletes a dead letter for good.
+func (o *Outbox) DropDead(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e, ok := o.dead[seq]
+	if !ok {
+		return ErrOutboxEntryNotFound
+	}
+	delete(o.dead, seq)
+	o.deadSize -= int64(len(e.Message))
+	return os.Remove(entryFile(o.deadDir(), seq))
+}
+
+// outboxOf returns the outbox of the sink named by the query parameter sink.
+func outboxOf(c *gin.Context) *Outbox {
+	o, ok := outboxes[c.Query("sink")]
+	if !ok {
+		c.JSON(404, gin.H{"message": "no outbox for sink " + c.Query("sink")})
+		return nil
+	}
+	return o
+}
+
+func ListOutboxRouter(c *gin.Context) {
+	if o := outboxOf(c); o != nil {
+		c.JSON(200, o.Pending(c.Query("deviceId")))
+	}
+}
+
+func ListDeadLettersRouter(c *gin.Context) {
+	if o := outboxOf(c); o != nil {
+		c.JSON(200, o.Dead())
+	}
+}
+
+func ReplayOutboxRouter(c *gin.Context) {
+	seq, err := strconv.ParseUint(c.Param("seq"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "invalid seq"})
+		return
+	}
+	o := outboxOf(c)
+	if o == nil {
+		return
+	}
+	e, err := o.Replay(seq)
+	if errors.Is(err, ErrOutboxEntryNotFound) {
+		c.JSON(404, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, e)
+}
+
+func DropDeadLetterRouter(c *gin.Context) {
+	seq, err := strconv.ParseUint(c.Param("seq"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "invalid seq"})
+		return
+	}
+	o := outboxOf(c)
+	if o == nil {
+		return
+	}
+	if err := o.DropDead(seq); err != nil {
+		c.JSON(404, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
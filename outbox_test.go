@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyForwarder fails the first failures publishes.
+type flakyForwarder struct {
+	mu        sync.Mutex
+	failures  int
+	published []string
+	messages  [][]byte
+}
+
+func (f *flakyForwarder) Connect() error { return nil }
+
+func (f *flakyForwarder) Publish(mid string, message []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("broker down")
+	}
+	f.published = append(f.published, mid)
+	f.messages = append(f.messages, message)
+	return nil
+}
+
+func (f *flakyForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	return ErrSubscribeUnsupported
+}
+
+func (f *flakyForwarder) Close() error { return nil }
+
+// step runs one delivery round and makes every entry due again.
+func step(o *Outbox) {
+	o.dispatch()
+	o.wg.Wait()
+	o.mu.Lock()
+	for _, entries := range o.pending {
+		for _, e := range entries {
+			e.NextAttempt = time.Now()
+		}
+	}
+	o.mu.Unlock()
+}
+
+func TestOutboxRetriesInOrderAndSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	f := &flakyForwarder{failures: 2}
+	o, err := NewOutbox(dir, f, 0, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Publish("13", []byte(`{"id":"32010600213533"}`))
+	_ = o.Publish("05", []byte(`{"id":"32010600213533"}`))
+
+	step(o)
+	if p := o.Pending(""); len(p) != 2 || p[0].Attempts != 1 || p[0].LastError == "" {
+		t.Fatalf("expected both messages pending after a failure, got %+v", p)
+	}
+
+	// a restart picks up where we left off
+	o, err = NewOutbox(dir, f, 0, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := o.Pending("32010600213533"); len(p) != 2 {
+		t.Fatalf("expected 2 pending messages after reload, got %d", len(p))
+	}
+	for i := 0; i < 4; i++ {
+		step(o)
+	}
+	if len(f.published) != 2 || f.published[0] != "13" || f.published[1] != "05" {
+		t.Fatalf("expected messages forwarded in order, got %v", f.published)
+	}
+	if p := o.Pending(""); len(p) != 0 {
+		t.Fatalf("expected outbox to be empty, got %d", len(p))
+	}
+}
+
+func TestOutboxPassesTransactionRecordsThrough(t *testing.T) {
+	f := &flakyForwarder{failures: 1}
+	o, err := NewOutbox(t.TempDir(), f, 0, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the router must not confirm a record the forwarder did not take
+	if err := o.Publish("3b", []byte(`{"id":"32010600213533"}`)); err == nil {
+		t.Fatal("expected the forwarder error")
+	}
+	if err := o.Publish("3b", []byte(`{"id":"32010600213533"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if p := o.Pending(""); len(p) != 0 || len(f.published) != 1 {
+		t.Fatalf("expected the record forwarded directly, got %+v %v", p, f.published)
+	}
+}
+
+func TestOutboxDeadLetterAndReplay(t *testing.T) {
+	f := &flakyForwarder{failures: 2}
+	o, err := NewOutbox(t.TempDir(), f, 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Publish("13", []byte(`{"id":"32010600213533"}`))
+	listed := o.Pending("")
+	step(o)
+	if listed[0].Attempts != 0 {
+		t.Fatal("listed entry changed by the retry loop")
+	}
+	step(o)
+	dead := o.Dead()
+	if len(dead) != 1 || len(o.Pending("")) != 0 {
+		t.Fatalf("expected message in dead letter store, got %d dead", len(dead))
+	}
+
+	if _, err := o.Replay(dead[0].Seq); err != nil {
+		t.Fatal(err)
+	}
+	step(o)
+	if len(f.published) != 1 || len(o.Dead()) != 0 {
+		t.Fatalf("expected replayed message to be forwarded, got %v", f.published)
+	}
+	if _, err := o.Replay(12345); !errors.Is(err, ErrOutboxEntryNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	o, err := NewOutbox(t.TempDir(), &flakyForwarder{}, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Publish("13", []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Publish("13", []byte(`{"id":"2"}`)); !errors.Is(err, ErrOutboxFull) {
+		t.Errorf("expected outbox to be full, got %v", err)
+	}
+
+	o, _ = NewOutbox(t.TempDir(), &flakyForwarder{}, 0, 16, 0)
+	if err := o.Publish("13", []byte(`{"id":"32010600213533"}`)); !errors.Is(err, ErrOutboxFull) {
+		t.Errorf("expected message over size limit to be refused, got %v", err)
+	}
+}
+
+func TestOutboxDeadLetterLimit(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, &flakyForwarder{failures: 2}, 1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Publish("13", []byte(`{"id":"1"}`))
+	step(o)
+	_ = o.Publish("13", []byte(`{"id":"2"}`))
+	step(o)
+	dead := o.Dead()
+	if len(dead) != 1 || string(dead[0].Message) != `{"id":"2"}` {
+		t.Fatalf("expected only the newest dead letter, got %v", dead)
+	}
+	files, _ := os.ReadDir(o.deadDir())
+	if len(files) != 1 {
+		t.Fatalf("expected one dead letter file, got %d", len(files))
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	hex2 "encoding/hex"
 	"fmt"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -15,6 +17,7 @@ const (
 
 	//device -> platform
 	Verification                = byte(0x01)
+	PileHeartbeat               = byte(0x03)
 	Heartbeat                   = byte(0x82)
 	BillingModelVerification    = byte(0x05)
 	BillingModelRequest         = byte(0x09)
@@ -80,22 +83,22 @@ func CalculateChecksum(data []byte) byte {
 }
 
 type Header struct {
-	Length    int    `json:"length"`
-	Seq       int    `json:"seq"`
-	Encrypted bool   `json:"encrypted"`
-	FrameId   string `json:"frameId"`
+	Length    int    `json:"length" proto:"1"`
+	Seq       int    `json:"seq" proto:"2"`
+	Encrypted bool   `json:"encrypted" proto:"3"`
+	FrameId   string `json:"frameId" proto:"4"`
 }
 
 type VerificationMessage struct {
-	Header          *Header `json:"header"`
-	Id              string  `json:"Id"`
-	ElcType         int     `json:"elcType"`
-	Guns            int     `json:"guns"`
-	ProtocolVersion int     `json:"protocolVersion"`
-	SoftwareVersion string  `json:"softwareVersion"`
-	Network         int     `json:"network"`
-	Sim             string  `json:"sim"`
-	Operator        int     `json:"operator"`
+	Header          *Header `json:"header" proto:"1"`
+	Id              string  `json:"id" proto:"2"`
+	ElcType         int     `json:"elcType" proto:"3"`
+	Guns            int     `json:"guns" proto:"4"`
+	ProtocolVersion int     `json:"protocolVersion" proto:"5"`
+	SoftwareVersion string  `json:"softwareVersion" proto:"6"`
+	Network         int     `json:"network" proto:"7"`
+	Sim             string  `json:"sim" proto:"8"`
+	Operator        int     `json:"operator" proto:"9"`
 }
 
 func PackVerificationMessage(buf []byte, hex []string, header *Header) *VerificationMessage {
@@ -145,9 +148,9 @@ func PackVerificationMessage(buf []byte, hex []string, header *Header) *Verifica
 }
 
 type VerificationResponseMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"id"`
-	Result bool    `json:"result"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" schema:"required,hex=14" proto:"2"`
+	Result bool    `json:"result" proto:"3"`
 }
 
 func PackVerificationResponseMessage(msg *VerificationResponseMessage) []byte {
@@ -173,9 +176,9 @@ func PackVerificationResponseMessage(msg *VerificationResponseMessage) []byte {
 }
 
 type BillingModelVerificationMessage struct {
-	Header           *Header `json:"header"`
-	Id               string  `json:"Id"`
-	BillingModelCode string  `json:"billingModelCode"`
+	Header           *Header `json:"header" proto:"1"`
+	Id               string  `json:"id" proto:"2"`
+	BillingModelCode string  `json:"billingModelCode" proto:"3"`
 }
 
 func PackBillingModelVerificationMessage(hex []string, header *Header) *BillingModelVerificationMessage {
@@ -197,8 +200,8 @@ func PackBillingModelVerificationMessage(hex []string, header *Header) *BillingM
 }
 
 type BillingModelRequestMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"Id"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
 }
 
 func PackBillingModelRequestMessage(hex []string, header *Header) *BillingModelRequestMessage {
@@ -216,19 +219,19 @@ func PackBillingModelRequestMessage(hex []string, header *Header) *BillingModelR
 }
 
 type BillingModelResponseMessage struct {
-	Header           *Header `json:"header"`
-	Id               string  `json:"id"`
-	BillingModelCode string  `json:"billingModelCode"`
-	SharpUnitPrice   int     `json:"sharpUnitPrice"`
-	SharpServiceFee  int     `json:"sharpServiceFee"`
-	PeakUnitPrice    int     `json:"peakUnitPrice"`
-	PeakServiceFee   int     `json:"peakServiceFee"`
-	FlatUnitPrice    int     `json:"flatUnitPrice"`
-	FlatServiceFee   int     `json:"flatServiceFee"`
-	ValleyUnitPrice  int     `json:"valleyUnitPrice"`
-	ValleyServiceFee int     `json:"valleyServiceFee"`
-	AccrualRatio     int     `json:"accrualRatio"`
-	RateList         []int   `json:"rateList"`
+	Header           *Header `json:"header" proto:"1"`
+	Id               string  `json:"id" schema:"required,hex=14" proto:"2"`
+	BillingModelCode string  `json:"billingModelCode" schema:"required,hex=4" proto:"3"`
+	SharpUnitPrice   int     `json:"sharpUnitPrice" proto:"4"`
+	SharpServiceFee  int     `json:"sharpServiceFee" proto:"5"`
+	PeakUnitPrice    int     `json:"peakUnitPrice" proto:"6"`
+	PeakServiceFee   int     `json:"peakServiceFee" proto:"7"`
+	FlatUnitPrice    int     `json:"flatUnitPrice" proto:"8"`
+	FlatServiceFee   int     `json:"flatServiceFee" proto:"9"`
+	ValleyUnitPrice  int     `json:"valleyUnitPrice" proto:"10"`
+	ValleyServiceFee int     `json:"valleyServiceFee" proto:"11"`
+	AccrualRatio     int     `json:"accrualRatio" proto:"12"`
+	RateList         []int   `json:"rateList" proto:"13"`
 }
 
 func PackBillingModelResponseMessage(msg *BillingModelResponseMessage) []byte {
@@ -264,10 +267,10 @@ func PackBillingModelResponseMessage(msg *BillingModelResponseMessage) []byte {
 }
 
 type BillingModelVerificationResponseMessage struct {
-	Header           *Header `json:"header"`
-	Id               string  `json:"id"`
-	BillingModelCode string  `json:"billingModelCode"`
-	Result           bool    `json:"result"`
+	Header           *Header `json:"header" proto:"1"`
+	Id               string  `json:"id" schema:"required,hex=14" proto:"2"`
+	BillingModelCode string  `json:"billingModelCode" schema:"required,hex=4" proto:"3"`
+	Result           bool    `json:"result" proto:"4"`
 }
 
 func PackBillingModelVerificationResponseMessage(msg *BillingModelVerificationResponseMessage) []byte {
@@ -296,15 +299,47 @@ func PackBillingModelVerificationResponseMessage(msg *BillingModelVerificationRe
 	return resp.Bytes()
 }
 
+// PileHeartbeatMessage is the heartbeat (03) a YKC pile sends for every gun.
+type PileHeartbeatMessage struct {
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	Gun    string  `json:"gun" proto:"3"`
+	// 0 normal, 1 fault
+	Status int `json:"status" proto:"4"`
+}
+
+func PackPileHeartbeatMessage(buf []byte, hex []string, header *Header) *PileHeartbeatMessage {
+	if len(buf) < 17 {
+		log.Error("Message too short to process")
+		return nil
+	}
+	//Id
+	id := ""
+	for _, v := range hex[6:13] {
+		id += v
+	}
+
+	return &PileHeartbeatMessage{
+		Header: header,
+		Id:     id,
+		Gun:    hex[13],
+		Status: int(buf[14]),
+	}
+}
+
 type HeartbeatMessage struct {
-	Header         *Header `json:"header"`
-	SignalValue    int     `json:"signalValue"`
-	Temperature    int     `json:"temperature"`
-	TotalPortCount int     `json:"totalPortCount"`
-	PortStatus     []int   `json:"portStatus"`
+	Header         *Header `json:"header" proto:"1"`
+	SignalValue    int     `json:"signalValue" proto:"2"`
+	Temperature    int     `json:"temperature" proto:"3"`
+	TotalPortCount int     `json:"totalPortCount" proto:"4"`
+	PortStatus     []int   `json:"portStatus" proto:"5"`
 }
 
 func PackHeartbeatMessage(buf []byte, header *Header) *HeartbeatMessage {
+	if len(buf) < 24 || len(buf) < 24+int(buf[23]) {
+		log.Error("Message too short to process")
+		return nil
+	}
 	payload := buf[21:] // Skip the header (first 5 bytes)
 
 	// Parse fields
@@ -332,7 +367,7 @@ func PackHeartbeatMessage(buf []byte, header *Header) *HeartbeatMessage {
 
 type HeartbeatResponseMessage struct {
 	Header   *Header `json:"header"`
-	Id       string  `json:"Id"`
+	Id       string  `json:"id"`
 	Gun      string  `json:"gun"`
 	Response int     `json:"response"`
 }
@@ -361,13 +396,13 @@ func PackHeartbeatResponseMessage(msg *HeartbeatResponseMessage) []byte {
 }
 
 type RemoteBootstrapRequestMessage struct {
-	Header       *Header `json:"header"`
-	TradeSeq     string  `json:"tradeSeq"`
-	Id           string  `json:"id"`
-	GunId        string  `json:"gunId"`
-	LogicCard    string  `json:"logicCard"`
-	PhysicalCard string  `json:"physicalCard"`
-	Balance      int     `json:"balance"`
+	Header       *Header `json:"header" proto:"1"`
+	TradeSeq     string  `json:"tradeSeq" schema:"required,hex=32" proto:"2"`
+	Id           string  `json:"id" schema:"required,hex=14" proto:"3"`
+	GunId        string  `json:"gunId" schema:"required,hex=2" proto:"4"`
+	LogicCard    string  `json:"logicCard" proto:"5"`
+	PhysicalCard string  `json:"physicalCard" proto:"6"`
+	Balance      int     `json:"balance" schema:"min=0" proto:"7"`
 }
 
 func PackRemoteBootstrapRequestMessage(msg *RemoteBootstrapRequestMessage) []byte {
@@ -399,12 +434,12 @@ func PackRemoteBootstrapRequestMessage(msg *RemoteBootstrapRequestMessage) []byt
 }
 
 type RemoteBootstrapResponseMessage struct {
-	Header   *Header `json:"header"`
-	TradeSeq string  `json:"tradeSeq"`
-	Id       string  `json:"id"`
-	GunId    string  `json:"gunId"`
-	Result   bool    `json:"result"`
-	Reason   int     `json:"reason"`
+	Header   *Header `json:"header" proto:"1"`
+	TradeSeq string  `json:"tradeSeq" proto:"2"`
+	Id       string  `json:"id" proto:"3"`
+	GunId    string  `json:"gunId" proto:"4"`
+	Result   bool    `json:"result" proto:"5"`
+	Reason   int     `json:"reason" proto:"6"`
 }
 
 func PackRemoteBootstrapResponseMessage(hex []string, header *Header) *RemoteBootstrapResponseMessage {
@@ -444,25 +479,25 @@ func PackRemoteBootstrapResponseMessage(hex []string, header *Header) *RemoteBoo
 }
 
 type OfflineDataReportMessage struct {
-	Header                  *Header `json:"header"`
-	TradeSeq                string  `json:"tradeSeq"`
-	Id                      string  `json:"id"`
-	GunId                   string  `json:"gunId"`
-	Status                  int     `json:"status"`
-	Reset                   int     `json:"reset"`
-	Plugged                 int     `json:"plugged"`
-	Ov                      int     `json:"ov"`
-	Oc                      int     `json:"oc"`
-	LineTemp                int     `json:"lineTemp"`
-	LineCode                string  `json:"lineCode"`
-	Soc                     int     `json:"soc"`
-	BpTopTemp               int     `json:"bpTopTemp"`
-	AccumulatedChargingTime int     `json:"accumulatedChargingTime"`
-	RemainingTime           int     `json:"remainingTime"`
-	ChargingDegrees         int     `json:"chargingDegrees"`
-	LossyChargingDegrees    int     `json:"lossyChargingDegrees"`
-	ChargedAmount           int     `json:"chargedAmount"`
-	HardwareFailure         int     `json:"hardwareFailure"`
+	Header                  *Header `json:"header" proto:"1"`
+	TradeSeq                string  `json:"tradeSeq" proto:"2"`
+	Id                      string  `json:"id" proto:"3"`
+	GunId                   string  `json:"gunId" proto:"4"`
+	Status                  int     `json:"status" proto:"5"`
+	Reset                   int     `json:"reset" proto:"6"`
+	Plugged                 int     `json:"plugged" proto:"7"`
+	Ov                      int     `json:"ov" proto:"8"`
+	Oc                      int     `json:"oc" proto:"9"`
+	LineTemp                int     `json:"lineTemp" proto:"10"`
+	LineCode                string  `json:"lineCode" proto:"11"`
+	Soc                     int     `json:"soc" proto:"12"`
+	BpTopTemp               int     `json:"bpTopTemp" proto:"13"`
+	AccumulatedChargingTime int     `json:"accumulatedChargingTime" proto:"14"`
+	RemainingTime           int     `json:"remainingTime" proto:"15"`
+	ChargingDegrees         int     `json:"chargingDegrees" proto:"16"`
+	LossyChargingDegrees    int     `json:"lossyChargingDegrees" proto:"17"`
+	ChargedAmount           int     `json:"chargedAmount" proto:"18"`
+	HardwareFailure         int     `json:"hardwareFailure" proto:"19"`
 }
 
 func PackOfflineDataReportMessage(hex []string, raw []byte, header *Header) *OfflineDataReportMessage {
@@ -552,11 +587,11 @@ func PackOfflineDataReportMessage(hex []string, raw []byte, header *Header) *Off
 }
 
 type RemoteShutdownResponseMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"id"`
-	GunId  string  `json:"gunId"`
-	Result bool    `json:"result"`
-	Reason int     `json:"reason"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	GunId  string  `json:"gunId" proto:"3"`
+	Result bool    `json:"result" proto:"4"`
+	Reason int     `json:"reason" proto:"5"`
 }
 
 func PackRemoteShutdownResponseMessage(hex []string, header *Header) *RemoteShutdownResponseMessage {
@@ -589,9 +624,9 @@ func PackRemoteShutdownResponseMessage(hex []string, header *Header) *RemoteShut
 }
 
 type RemoteShutdownRequestMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"id"`
-	GunId  string  `json:"gunId"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" schema:"required,hex=14" proto:"2"`
+	GunId  string  `json:"gunId" schema:"required,hex=2" proto:"3"`
 }
 
 func PackRemoteShutdownRequestMessage(msg *RemoteShutdownRequestMessage) []byte {
@@ -613,38 +648,38 @@ func PackRemoteShutdownRequestMessage(msg *RemoteShutdownRequestMessage) []byte
 }
 
 type TransactionRecordMessage struct {
-	Header                    *Header `json:"header"`
-	TradeSeq                  string  `json:"tradeSeq"`
-	Id                        string  `json:"id"`
-	GunId                     string  `json:"gunId"`
-	StartAt                   int64   `json:"startAt"`
-	EndAt                     int64   `json:"endAt"`
-	SharpUnitPrice            int64   `json:"sharpUnitPrice"`
-	SharpElectricCharge       int64   `json:"sharpElectricCharge"`
-	LossySharpElectricCharge  int64   `json:"lossySharpElectricCharge"`
-	SharpPrice                int64   `json:"sharpPrice"`
-	PeakUnitPrice             int64   `json:"peakUnitPrice"`
-	PeakElectricCharge        int64   `json:"peakElectricCharge"`
-	LossyPeakElectricCharge   int64   `json:"lossyPeakElectricCharge"`
-	PeakPrice                 int64   `json:"peakPrice"`
-	FlatUnitPrice             int64   `json:"flatUnitPrice"`
-	FlatElectricCharge        int64   `json:"flatElectricCharge"`
-	LossyFlatElectricCharge   int64   `json:"lossyFlatElectricCharge"`
-	FlatPrice                 int64   `json:"flatPrice"`
-	ValleyUnitPrice           int64   `json:"valleyUnitPrice"`
-	ValleyElectricCharge      int64   `json:"valleyElectricCharge"`
-	LossyValleyElectricCharge int64   `json:"lossyValleyElectricCharge"`
-	ValleyPrice               int64   `json:"valleyPrice"`
-	InitialMeterReading       int64   `json:"initialMeterReading"`
-	FinalMeterReading         int64   `json:"finalMeterReading"`
-	TotalElectricCharge       int64   `json:"totalElectricCharge"`
-	LossyTotalElectricCharge  int64   `json:"lossyTotalElectricCharge"`
-	ConsumptionAmount         int64   `json:"consumptionAmount"`
-	Vin                       string  `json:"vin"`
-	StartType                 int     `json:"startType"`
-	TransactionDateTime       int64   `json:"transactionDateTime"`
-	StopReason                int     `json:"stopReason"`
-	PhysicalCardNumber        string  `json:"physicalCardNumber"`
+	Header                    *Header `json:"header" proto:"1"`
+	TradeSeq                  string  `json:"tradeSeq" proto:"2"`
+	Id                        string  `json:"id" proto:"3"`
+	GunId                     string  `json:"gunId" proto:"4"`
+	StartAt                   int64   `json:"startAt" proto:"5"`
+	EndAt                     int64   `json:"endAt" proto:"6"`
+	SharpUnitPrice            int64   `json:"sharpUnitPrice" proto:"7"`
+	SharpElectricCharge       int64   `json:"sharpElectricCharge" proto:"8"`
+	LossySharpElectricCharge  int64   `json:"lossySharpElectricCharge" proto:"9"`
+	SharpPrice                int64   `json:"sharpPrice" proto:"10"`
+	PeakUnitPrice             int64   `json:"peakUnitPrice" proto:"11"`
+	PeakElectricCharge        int64   `json:"peakElectricCharge" proto:"12"`
+	LossyPeakElectricCharge   int64   `json:"lossyPeakElectricCharge" proto:"13"`
+	PeakPrice                 int64   `json:"peakPrice" proto:"14"`
+	FlatUnitPrice             int64   `json:"flatUnitPrice" proto:"15"`
+	FlatElectricCharge        int64   `json:"flatElectricCharge" proto:"16"`
+	LossyFlatElectricCharge   int64   `json:"lossyFlatElectricCharge" proto:"17"`
+	FlatPrice                 int64   `json:"flatPrice" proto:"18"`
+	ValleyUnitPrice           int64   `json:"valleyUnitPrice" proto:"19"`
+	ValleyElectricCharge      int64   `json:"valleyElectricCharge" proto:"20"`
+	LossyValleyElectricCharge int64   `json:"lossyValleyElectricCharge" proto:"21"`
+	ValleyPrice               int64   `json:"valleyPrice" proto:"22"`
+	InitialMeterReading       int64   `json:"initialMeterReading" proto:"23"`
+	FinalMeterReading         int64   `json:"finalMeterReading" proto:"24"`
+	TotalElectricCharge       int64   `json:"totalElectricCharge" proto:"25"`
+	LossyTotalElectricCharge  int64   `json:"lossyTotalElectricCharge" proto:"26"`
+	ConsumptionAmount         int64   `json:"consumptionAmount" proto:"27"`
+	Vin                       string  `json:"vin" proto:"28"`
+	StartType                 int     `json:"startType" proto:"29"`
+	TransactionDateTime       int64   `json:"transactionDateTime" proto:"30"`
+	StopReason                int     `json:"stopReason" proto:"31"`
+	PhysicalCardNumber        string  `json:"physicalCardNumber" proto:"32"`
 }
 
 func PackTransactionRecordMessage(raw []byte, hex []string, header *Header) *TransactionRecordMessage {
@@ -786,10 +821,10 @@ func PackTransactionRecordMessage(raw []byte, hex []string, header *Header) *Tra
 }
 
 type TransactionRecordConfirmedMessage struct {
-	Header   *Header `json:"header"`
-	Id       string  `json:"id"`
-	TradeSeq string  `json:"tradeSeq"`
-	Result   int     `json:"result"`
+	Header   *Header `json:"header" proto:"1"`
+	Id       string  `json:"id" schema:"required,hex=14" proto:"2"`
+	TradeSeq string  `json:"tradeSeq" schema:"required,hex=32" proto:"3"`
+	Result   int     `json:"result" proto:"4"`
 }
 
 func PackTransactionRecordConfirmedMessage(msg *TransactionRecordConfirmedMessage) []byte {
@@ -811,9 +846,9 @@ func PackTransactionRecordConfirmedMessage(msg *TransactionRecordConfirmedMessag
 }
 
 type RemoteRebootResponseMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"id"`
-	Result int     `json:"result"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	Result int     `json:"result" proto:"3"`
 }
 
 func PackRemoteRebootResponseMessage(hex []string, header *Header) *RemoteRebootResponseMessage {
@@ -838,9 +873,9 @@ func PackRemoteRebootResponseMessage(hex []string, header *Header) *RemoteReboot
 }
 
 type RemoteRebootRequestMessage struct {
-	Header  *Header `json:"header"`
-	Id      string  `json:"id"`
-	Control int     `json:"control"`
+	Header  *Header `json:"header" proto:"1"`
+	Id      string  `json:"id" schema:"required,hex=14" proto:"2"`
+	Control int     `json:"control" schema:"required" proto:"3"`
 }
 
 func PackRemoteRebootRequestMessage(msg *RemoteRebootRequestMessage) []byte {
@@ -862,19 +897,19 @@ func PackRemoteRebootRequestMessage(msg *RemoteRebootRequestMessage) []byte {
 }
 
 type SetBillingModelRequestMessage struct {
-	Header           *Header `json:"header"`
-	Id               string  `json:"id"`
-	BillingModelCode string  `json:"billingModelCode"`
-	SharpUnitPrice   int     `json:"sharpUnitPrice"`
-	SharpServiceFee  int     `json:"sharpServiceFee"`
-	PeakUnitPrice    int     `json:"peakUnitPrice"`
-	PeakServiceFee   int     `json:"peakServiceFee"`
-	FlatUnitPrice    int     `json:"flatUnitPrice"`
-	FlatServiceFee   int     `json:"flatServiceFee"`
-	ValleyUnitPrice  int     `json:"valleyUnitPrice"`
-	ValleyServiceFee int     `json:"valleyServiceFee"`
-	AccrualRatio     int     `json:"accrualRatio"`
-	RateList         []int   `json:"rateList"`
+	Header           *Header `json:"header" proto:"1"`
+	Id               string  `json:"id" schema:"required,hex=14" proto:"2"`
+	BillingModelCode string  `json:"billingModelCode" schema:"required,hex=4" proto:"3"`
+	SharpUnitPrice   int     `json:"sharpUnitPrice" proto:"4"`
+	SharpServiceFee  int     `json:"sharpServiceFee" proto:"5"`
+	PeakUnitPrice    int     `json:"peakUnitPrice" proto:"6"`
+	PeakServiceFee   int     `json:"peakServiceFee" proto:"7"`
+	FlatUnitPrice    int     `json:"flatUnitPrice" proto:"8"`
+	FlatServiceFee   int     `json:"flatServiceFee" proto:"9"`
+	ValleyUnitPrice  int     `json:"valleyUnitPrice" proto:"10"`
+	ValleyServiceFee int     `json:"valleyServiceFee" proto:"11"`
+	AccrualRatio     int     `json:"accrualRatio" proto:"12"`
+	RateList         []int   `json:"rateList" proto:"13"`
 }
 
 func PackSetBillingModelRequestMessage(msg *SetBillingModelRequestMessage) []byte {
@@ -910,9 +945,9 @@ func PackSetBillingModelRequestMessage(msg *SetBillingModelRequestMessage) []byt
 }
 
 type SetBillingModelResponseMessage struct {
-	Header *Header `json:"header"`
-	Id     string  `json:"id"`
-	Result int     `json:"result"`
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	Result int     `json:"result" proto:"3"`
 }
 
 func PackSetBillingModelResponseMessage(hex []string, header *Header) *SetBillingModelResponseMessage {
@@ -936,19 +971,129 @@ func PackSetBillingModelResponseMessage(hex []string, header *Header) *SetBillin
 	return msg
 }
 
+type SetWorkingParamsRequestMessage struct {
+	Header   *Header `json:"header" proto:"1"`
+	Id       string  `json:"id" schema:"required,hex=14" proto:"2"`
+	Disabled bool    `json:"disabled" proto:"3"`
+	MaxPower int     `json:"maxPower" schema:"required,min=30,max=100" proto:"4"`
+}
+
+func PackSetWorkingParamsRequestMessage(msg *SetWorkingParamsRequestMessage) []byte {
+	var resp bytes.Buffer
+	resp.Write([]byte{0x68, 0x0d})
+	seqStr := fmt.Sprintf("%x", GenerateSeq())
+	seq := ConvertIntSeqToReversedHexArr(seqStr)
+	resp.Write(HexToBytes(MakeHexStringFromHexArray(seq)))
+	if msg.Header.Encrypted {
+		resp.WriteByte(0x01)
+	} else {
+		resp.WriteByte(0x00)
+	}
+	resp.Write([]byte{0x52})
+	resp.Write(HexToBytes(msg.Id))
+	//0x00 working, 0x01 out of service and locked
+	if msg.Disabled {
+		resp.WriteByte(0x01)
+	} else {
+		resp.WriteByte(0x00)
+	}
+	//max output power in percent
+	resp.WriteByte(byte(msg.MaxPower))
+	resp.Write(ModbusCRC(resp.Bytes()[2:]))
+	return resp.Bytes()
+}
+
+type SetWorkingParamsResponseMessage struct {
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	Result int     `json:"result" proto:"3"`
+}
+
+func PackSetWorkingParamsResponseMessage(hex []string, header *Header) *SetWorkingParamsResponseMessage {
+	//id
+	id := ""
+	for _, v := range hex[6:13] {
+		id += v
+	}
+
+	//result 0-fail 1-success
+	result := 1
+	if hex[13] == "00" {
+		result = 0
+	}
+
+	msg := &SetWorkingParamsResponseMessage{
+		Header: header,
+		Id:     id,
+		Result: result,
+	}
+	return msg
+}
+
+type NtpRequestMessage struct {
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" schema:"required,hex=14" proto:"2"`
+	Time   int64   `json:"time" schema:"min=0" proto:"3"`
+}
+
+// PackNtpRequestMessage sets the clock of the pile to msg.Time, in unix
+// milliseconds, or to the current time if it is zero.
+func PackNtpRequestMessage(msg *NtpRequestMessage) []byte {
+	t := msg.Time
+	if t == 0 {
+		t = time.Now().UnixMilli()
+	}
+	var resp bytes.Buffer
+	resp.Write([]byte{0x68, 0x12})
+	seqStr := fmt.Sprintf("%x", GenerateSeq())
+	seq := ConvertIntSeqToReversedHexArr(seqStr)
+	resp.Write(HexToBytes(MakeHexStringFromHexArray(seq)))
+	if msg.Header.Encrypted {
+		resp.WriteByte(0x01)
+	} else {
+		resp.WriteByte(0x00)
+	}
+	resp.Write([]byte{0x56})
+	resp.Write(HexToBytes(msg.Id))
+	resp.Write(UnixMillisecondsToCp56time2a(t))
+	resp.Write(ModbusCRC(resp.Bytes()[2:]))
+	return resp.Bytes()
+}
+
+type NtpResponseMessage struct {
+	Header *Header `json:"header" proto:"1"`
+	Id     string  `json:"id" proto:"2"`
+	Time   int64   `json:"time" proto:"3"`
+}
+
+func PackNtpResponseMessage(raw []byte, hex []string, header *Header) *NtpResponseMessage {
+	//id
+	id := ""
+	for _, v := range hex[6:13] {
+		id += v
+	}
+
+	msg := &NtpResponseMessage{
+		Header: header,
+		Id:     id,
+		Time:   Cp56time2aToUnixMilliseconds(raw[13:20]),
+	}
+	return msg
+}
+
 type ChargingFinishedMessage struct {
-	Header                           *Header `json:"header"`
-	TradeSeq                         string  `json:"tradeSeq"`
-	Id                               string  `json:"id"`
-	GunId                            string  `json:"gunId"`
-	BmsSoc                           int     `json:"bmsSoc"`
-	BmsBatteryPackLowestVoltage      int     `json:"bmsBatteryPackLowestVoltage"`
-	BmsBatteryPackHighestVoltage     int     `json:"bmsBatteryPackHighestVoltage"`
-	BmsBatteryPackLowestTemperature  int     `json:"bmsBatteryPackLowestTemperature"`
-	BmsBatteryPackHighestTemperature int     `json:"bmsBatteryPackHighestTemperature"`
-	CumulativeChargingDuration       int     `json:"cumulativeChargingDuration"`
-	OutputPower                      int     `json:"outputPower"`
-	ChargingUnitId                   int     `json:"chargingUnitId"`
+	Header                           *Header `json:"header" proto:"1"`
+	TradeSeq                         string  `json:"tradeSeq" proto:"2"`
+	Id                               string  `json:"id" proto:"3"`
+	GunId                            string  `json:"gunId" proto:"4"`
+	BmsSoc                           int     `json:"bmsSoc" proto:"5"`
+	BmsBatteryPackLowestVoltage      int     `json:"bmsBatteryPackLowestVoltage" proto:"6"`
+	BmsBatteryPackHighestVoltage     int     `json:"bmsBatteryPackHighestVoltage" proto:"7"`
+	BmsBatteryPackLowestTemperature  int     `json:"bmsBatteryPackLowestTemperature" proto:"8"`
+	BmsBatteryPackHighestTemperature int     `json:"bmsBatteryPackHighestTemperature" proto:"9"`
+	CumulativeChargingDuration       int     `json:"cumulativeChargingDuration" proto:"10"`
+	OutputPower                      int     `json:"outputPower" proto:"11"`
+	ChargingUnitId                   int     `json:"chargingUnitId" proto:"12"`
 }
 
 func PackChargingFinishedMessage(hex []string, header *Header) *ChargingFinishedMessage {
@@ -996,18 +1141,18 @@ func PackChargingFinishedMessage(hex []string, header *Header) *ChargingFinished
 }
 
 type DeviceLoginMessage struct {
-	Header          *Header `json:"Header"`
-	IMEI            string  `json:"imei"`
-	DevicePortCount int     `json:"devicePortCount"`
-	HardwareVersion string  `json:"hardwareVersion"`
-	SoftwareVersion string  `json:"softwareVersion"`
-	CCID            string  `json:"ccid"`
-	SignalValue     int     `json:"signalValue"`
-	LoginReason     int     `json:"loginReason"`
+	Header          *Header `json:"header" proto:"1"`
+	IMEI            string  `json:"imei" proto:"2"`
+	DevicePortCount int     `json:"devicePortCount" proto:"3"`
+	HardwareVersion string  `json:"hardwareVersion" proto:"4"`
+	SoftwareVersion string  `json:"softwareVersion" proto:"5"`
+	CCID            string  `json:"ccid" proto:"6"`
+	SignalValue     int     `json:"signalValue" proto:"7"`
+	LoginReason     int     `json:"loginReason" proto:"8"`
 }
 
 func PackDeviceLoginMessage(buf []byte, header *Header) *DeviceLoginMessage {
-	if len(buf) < 6 {
+	if len(buf) < 76 {
 		log.Error("Message too short to process")
 		return nil
 	}
@@ -1053,167 +1198,71 @@ func PackDeviceLoginMessage(buf []byte, header *Header) *DeviceLoginMessage {
 	}
 }
 
+// DeviceLoginResponseMessage answers the login (81) of a Huaping pile,
+// addressed by its IMEI.
 type DeviceLoginResponseMessage struct {
-	Header          *Header `json:"header"`
-	Time            string  `json:"time"`            // Reserved Time (BCD format)
-	HeartbeatPeriod int     `json:"heartbeatPeriod"` // Heartbeat interval in seconds
-	Result          byte    `json:"result"`          // Login Result (0x00 = success, 0x01 = illegal module, 0xF0 = protocol upgrade)
-}
-
-func PackDeviceLoginResponseMessage(msg *DeviceLoginResponseMessage) []byte {
-	var resp bytes.Buffer
-
-	// Frame Header (5AA5)
-	resp.Write(HexToBytes("5AA5"))
-
-	// Data Length (12 bytes)
-	resp.Write(HexToBytes("0C00"))
-
-	// Command (81)
-	resp.Write([]byte{0x81})
-
-	// Time (7 bytes, BCD format)
-	resp.Write(HexToBytes(msg.Time))
-
-	// Heartbeat Interval (1 byte)
-	resp.Write([]byte{byte(msg.HeartbeatPeriod)})
-
-	// Login Result (1 byte)
-	resp.Write([]byte{byte(msg.Result)})
-
-	return resp.Bytes()
+	Header          *Header `json:"header" proto:"1"`
+	Id              string  `json:"id" schema:"required,hex=15" proto:"2"`
+	Time            string  `json:"time" schema:"hex=14" proto:"3"`                   // Reserved Time (BCD format)
+	HeartbeatPeriod int     `json:"heartbeatPeriod" schema:"min=0,max=255" proto:"4"` // Heartbeat interval in seconds
+	Result          byte    `json:"result" proto:"5"`                                 // Login Result (0x00 = success, 0x01 = illegal module, 0xF0 = protocol upgrade)
 }
 
-type RemoteStartMessage struct {
-	Header          *Header `json:"header"`
-	Port            int     `json:"port"`
-	OrderNumber     uint32  `json:"orderNumber"`
-	StartMethod     int     `json:"startMethod"`
-	CardNumber      uint32  `json:"cardNumber"`
-	ChargingMethod  int     `json:"chargingMethod"`
-	ChargingParam   uint32  `json:"chargingParam"`
-	AvailableAmount uint32  `json:"availableAmount"`
-}
-
-func PackRemoteStartMessage(buf []byte, header *Header) *RemoteStartMessage {
-	PrintHexAndByte(buf)
-	payload := buf[5:] // Skip header bytes
+// DeviceLoginIllegal is the result refusing a login.
+const DeviceLoginIllegal = byte(0x01)
 
-	return &RemoteStartMessage{
-		Header:          header,
-		Port:            int(payload[0]),
-		OrderNumber:     uint32(payload[1])<<24 | uint32(payload[2])<<16 | uint32(payload[3])<<8 | uint32(payload[4]),
-		StartMethod:     int(payload[5]),
-		CardNumber:      uint32(payload[6])<<24 | uint32(payload[7])<<16 | uint32(payload[8])<<8 | uint32(payload[9]),
-		ChargingMethod:  int(payload[10]),
-		ChargingParam:   uint32(payload[11])<<24 | uint32(payload[12])<<16 | uint32(payload[13])<<8 | uint32(payload[14]),
-		AvailableAmount: uint32(payload[15])<<24 | uint32(payload[16])<<16 | uint32(payload[17])<<8 | uint32(payload[18]),
+func PackDeviceLoginResponseMessage(msg *DeviceLoginResponseMessage) []byte {
+	t := HexToBytes(msg.Time)
+	if len(t) != 7 {
+		t = make([]byte, 7)
 	}
+	data := append(t, byte(msg.HeartbeatPeriod), msg.Result)
+	return PackHuapingFrame(DeviceLogin, "", data)
 }
 
-type RemoteStartResponseMessage struct {
-	Header      *Header `json:"header"`
-	Port        int     `json:"port"`
-	OrderNumber uint32  `json:"orderNumber"`
-	StartMethod int     `json:"startMethod"`
-	Result      int     `json:"result"`
+// PortCommandReplyMessage is a Huaping pile's answer to a remote start (83)
+// or stop (84) sent by the proxy: the command and 00, the IMEI like in the
+// other frames of the pile, then the port, the order number (little endian,
+// as sent) and the result, 0 for success.
+type PortCommandReplyMessage struct {
+	Header      *Header `json:"header" proto:"1"`
+	Id          string  `json:"id" proto:"2"`
+	Port        int     `json:"port" proto:"3"`
+	OrderNumber uint32  `json:"orderNumber" proto:"4"`
+	Result      int     `json:"result" proto:"5"`
 }
 
-func PackRemoteStartResponseMessage(msg *RemoteStartResponseMessage) []byte {
-	var resp bytes.Buffer
-
-	// Frame Header (5AA5)
-	resp.Write(HexToBytes("5AA5"))
-
-	// Data Length (7 bytes total)
-	resp.Write([]byte{0x07, 0x00})
-
-	// Command (0x83)
-	resp.Write([]byte{RemoteStart})
-
-	// Payload
-	resp.Write([]byte{byte(msg.Port)})
-	resp.Write([]byte{
-		byte(msg.OrderNumber >> 24),
-		byte(msg.OrderNumber >> 16),
-		byte(msg.OrderNumber >> 8),
-		byte(msg.OrderNumber),
-	})
-	resp.Write([]byte{byte(msg.StartMethod), byte(msg.Result)})
-
-	// Calculate and append checksum
-	checksum := CalculateChecksum(resp.Bytes()[2:])
-	resp.Write([]byte{checksum})
-
-	return resp.Bytes()
-}
-
-type RemoteStopMessage struct {
-	Header      *Header `json:"header"`
-	Port        int     `json:"port"`
-	OrderNumber uint32  `json:"orderNumber"`
-}
-
-func PackRemoteStopMessage(buf []byte, header *Header) *RemoteStopMessage {
-	payload := buf[5:] // Skip the header (first 5 bytes)
+func PackPortCommandReplyMessage(buf []byte, header *Header) *PortCommandReplyMessage {
+	// 5A A5, length, command, 00, IMEI, port, order number, result
+	if len(buf) < 27 {
+		log.Error("Message too short to process")
+		return nil
+	}
+	payload := buf[21:] // Skip header and IMEI
 
-	return &RemoteStopMessage{
+	return &PortCommandReplyMessage{
 		Header:      header,
+		Id:          string(buf[6:21]),
 		Port:        int(payload[0]),
-		OrderNumber: uint32(payload[1])<<24 | uint32(payload[2])<<16 | uint32(payload[3])<<8 | uint32(payload[4]),
+		OrderNumber: binary.LittleEndian.Uint32(payload[1:5]),
+		Result:      int(payload[5]),
 	}
 }
 
-type RemoteStopResponseMessage struct {
-	Header      *Header `json:"header"`
-	Port        int     `json:"port"`
-	OrderNumber uint32  `json:"orderNumber"`
-	Result      byte    `json:"result"`
-}
-
-func PackRemoteStopResponseMessage(msg *RemoteStopResponseMessage) []byte {
-	var resp bytes.Buffer
-
-	// Frame Header
-	resp.Write(HexToBytes("5AA5"))
-
-	// Data Length
-	resp.Write([]byte{0x07, 0x00})
-
-	// Command
-	resp.Write([]byte{0x84})
-
-	// Payload
-	resp.Write([]byte{byte(msg.Port)})
-	resp.Write([]byte{
-		byte(msg.OrderNumber >> 24),
-		byte(msg.OrderNumber >> 16),
-		byte(msg.OrderNumber >> 8),
-		byte(msg.OrderNumber),
-	})
-	resp.Write([]byte{msg.Result})
-
-	// Checksum
-	checksum := CalculateChecksum(resp.Bytes()[2:])
-	resp.Write([]byte{checksum})
-
-	return resp.Bytes()
-}
-
 type SubmitFinalStatusMessage struct {
-	Header           *Header  `json:"header"`
-	Port             byte     `json:"port"`
-	OrderNumber      uint32   `json:"orderNumber"`
-	ChargingTime     uint32   `json:"chargingTime"`
-	ElectricityUsage uint32   `json:"electricityUsage"`
-	UsageCost        uint32   `json:"usageCost"`
-	StopReason       byte     `json:"stopReason"`
-	StopPower        uint16   `json:"stopPower"`
-	CardID           uint32   `json:"cardId"`
-	SegmentCount     byte     `json:"segmentCount"`
-	SegmentDurations []uint16 `json:"segmentDurations"`
-	SegmentPrices    []uint16 `json:"segmentPrices"`
-	Reserved         []byte   `json:"reserved"`
+	Header           *Header  `json:"header" proto:"1"`
+	Port             byte     `json:"port" proto:"2"`
+	OrderNumber      uint32   `json:"orderNumber" proto:"3"`
+	ChargingTime     uint32   `json:"chargingTime" proto:"4"`
+	ElectricityUsage uint32   `json:"electricityUsage" proto:"5"`
+	UsageCost        uint32   `json:"usageCost" proto:"6"`
+	StopReason       byte     `json:"stopReason" proto:"7"`
+	StopPower        uint16   `json:"stopPower" proto:"8"`
+	CardID           uint32   `json:"cardId" proto:"9"`
+	SegmentCount     byte     `json:"segmentCount" proto:"10"`
+	SegmentDurations []uint16 `json:"segmentDurations" proto:"11"`
+	SegmentPrices    []uint16 `json:"segmentPrices" proto:"12"`
+	Reserved         []byte   `json:"reserved" proto:"13"`
 }
 
 type SubmitFinalStatusResponse struct {
@@ -1222,6 +1271,10 @@ type SubmitFinalStatusResponse struct {
 }
 
 func PackSubmitFinalStatusMessage(buf []byte, header *Header) *SubmitFinalStatusMessage {
+	if len(buf) < 29 || len(buf) < 29+int(buf[15])*4 {
+		log.Error("Message too short to process")
+		return nil
+	}
 	payload := buf[5:]
 	segmentCount := payload[10]
 
@@ -1260,3 +1313,56 @@ func PackSubmitFinalStatusResponse(msg *SubmitFinalStatusResponse) []byte {
 	resp.Write([]byte{checksum})
 	return resp.Bytes()
 }
+
+// RemoteStartRequestMessage starts charging on a port of a Huaping pile,
+// addressed by its IMEI.
+type RemoteStartRequestMessage struct {
+	Id            string `json:"id" schema:"required,hex=15" proto:"1"`
+	Port          int    `json:"port" schema:"required,min=1,max=255" proto:"2"`
+	OrderNumber   uint32 `json:"orderNumber" schema:"required" proto:"3"`
+	PaymentMode   int    `json:"paymentMode" schema:"min=0,max=255" proto:"4"`
+	CardNumber    uint32 `json:"cardNumber" proto:"5"`
+	ChargingMode  int    `json:"chargingMode" schema:"required,min=0,max=255" proto:"6"`
+	ChargingParam uint32 `json:"chargingParam" proto:"7"`
+	Balance       uint32 `json:"balance" proto:"8"`
+}
+
+func PackRemoteStartRequestMessage(msg *RemoteStartRequestMessage) []byte {
+	data := &bytes.Buffer{}
+	data.Write([]byte{byte(msg.Port)})
+	data.Write(binary.LittleEndian.AppendUint32(nil, msg.OrderNumber))
+	data.Write([]byte{byte(msg.PaymentMode)})
+	data.Write(binary.LittleEndian.AppendUint32(nil, msg.CardNumber))
+	data.Write([]byte{byte(msg.ChargingMode)})
+	data.Write(binary.LittleEndian.AppendUint32(nil, msg.ChargingParam))
+	data.Write(binary.LittleEndian.AppendUint32(nil, msg.Balance))
+	return PackHuapingFrame(RemoteStart, msg.Id, data.Bytes())
+}
+
+// RemoteStopRequestMessage stops charging on a port of a Huaping pile.
+type RemoteStopRequestMessage struct {
+	Id          string `json:"id" schema:"required,hex=15" proto:"1"`
+	Port        int    `json:"port" schema:"required,min=1,max=255" proto:"2"`
+	OrderNumber uint32 `json:"orderNumber" schema:"required" proto:"3"`
+}
+
+func PackRemoteStopRequestMessage(msg *RemoteStopRequestMessage) []byte {
+	data := &bytes.Buffer{}
+	data.Write([]byte{byte(msg.Port)})
+	data.Write(binary.LittleEndian.AppendUint32(nil, msg.OrderNumber))
+	return PackHuapingFrame(RemoteStop, msg.Id, data.Bytes())
+}
+
+// PackHuapingFrame frames a command to a pile: 5A A5, the length (little
+// endian) counting the command, the data and the checksum but not the IMEI,
+// the command and 00, the IMEI, the data and the checksum, the byte sum of
+// everything after 5A A5.
+func PackHuapingFrame(command byte, id string, data []byte) []byte {
+	frame := make([]byte, 0, len(id)+len(data)+7)
+	frame = append(frame, 0x5a, 0xa5)
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(2+len(data)+1))
+	frame = append(frame, command, 0x00)
+	frame = append(frame, id...)
+	frame = append(frame, data...)
+	return append(frame, CalculateChecksum(frame[2:]))
+}
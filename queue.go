@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CommandPending = "pending"
+	CommandSent    = "sent"
+	CommandReplied = "replied"
+	CommandFailed  = "failed"
+	CommandExpired = "expired"
+)
+
+// commandRetention is how long finished commands stay queryable.
+const commandRetention = 24 * time.Hour
+
+var ErrCommandNotFound = errors.New("command does not exist")
+
+var commandQueue *CommandQueue
+
+type QueuedCommand struct {
+	Id        string          `json:"id"`
+	DeviceId  string          `json:"deviceId"`
+	FrameType string          `json:"frameType"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	SentAt    *time.Time      `json:"sentAt,omitempty"`
+	DoneAt    *time.Time      `json:"doneAt,omitempty"`
+	Reply     json.RawMessage `json:"reply,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Source    *CommandSource  `json:"source,omitempty"`
+}
+
+func (c *QueuedCommand) finished() bool {
+	return c.Status == CommandReplied || c.Status == CommandFailed || c.Status == CommandExpired
+}
+
+// CommandQueue holds downlink commands per pile until they are delivered and
+// answered. Commands of one pile are delivered strictly in order, the next
+// one is only sent once the previous one is finished. Commands are sent and
+// the queue is written to File without mu held.
+type CommandQueue struct {
+	File         string
+	DefaultTTL   time.Duration
+	ReplyTimeout time.Duration
+	MaxAttempts  int
+
+	mu       sync.Mutex
+	commands map[string]*QueuedCommand
+	devices  map[string][]string
+	version  uint64
+	quit     chan struct{}
+
+	// fileMu orders the writes of File, saved is the version last written
+	fileMu sync.Mutex
+	saved  uint64
+}
+
+// queueSnapshot is the encoded queue at a version.
+type queueSnapshot struct {
+	version uint64
+	data    []byte
+}
+
+func NewCommandQueue(file string, defaultTTL time.Duration, replyTimeout time.Duration, maxAttempts int) (*CommandQueue, error) {
+	q := &CommandQueue{
+		File:         file,
+		DefaultTTL:   defaultTTL,
+		ReplyTimeout: replyTimeout,
+		MaxAttempts:  maxAttempts,
+		commands:     make(map[string]*QueuedCommand),
+		devices:      make(map[string][]string),
+		quit:         make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *CommandQueue) load() error {
+	if q.File == "" {
+		return nil
+	}
+	b, err := os.ReadFile(q.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var commands []*QueuedCommand
+	if err := json.Unmarshal(b, &commands); err != nil {
+		return err
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].CreatedAt.Before(commands[j].CreatedAt)
+	})
+	for _, c := range commands {
+		// a command that was on the wire when we stopped has lost its reply
+		if c.Status == CommandSent {
+			c.Status = CommandPending
+		}
+		q.commands[c.Id] = c
+		if !c.finished() {
+			q.devices[c.DeviceId] = append(q.devices[c.DeviceId], c.Id)
+		}
+	}
+	log.WithFields(log.Fields{
+		"file":     q.File,
+		"commands": len(commands),
+	}).Info("command queue loaded")
+	return nil
+}
+
+// snapshot encodes the queue for save. Must be called with q.mu held.
+func (q *CommandQueue) snapshot() *queueSnapshot {
+	if q.File == "" {
+		return nil
+	}
+	commands := make([]*QueuedCommand, 0, len(q.commands))
+	for _, c := range q.commands {
+		commands = append(commands, c)
+	}
+	b, err := json.Marshal(commands)
+	if err != nil {
+		log.Errorf("error encoding command queue: %v", err)
+		return nil
+	}
+	q.version++
+	return &queueSnapshot{version: q.version, data: b}
+}
+
+// save writes a snapshot to File, unless a later one has been written
+// already. Must be called without q.mu held.
+func (q *CommandQueue) save(s *queueSnapshot) {
+	if s == nil {
+		return
+	}
+	q.fileMu.Lock()
+	defer q.fileMu.Unlock()
+	if s.version <= q.saved {
+		return
+	}
+	tmp := q.File + ".tmp"
+	if err := os.WriteFile(tmp, s.data, 0600); err != nil {
+		log.Errorf("error writing command queue: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, q.File); err != nil {
+		log.Errorf("error writing command queue: %v", err)
+		return
+	}
+	q.saved = s.version
+}
+
+// Enqueue stores a command for a pile, sent for src, and tries to deliver it
+// right away.
+func (q *CommandQueue) Enqueue(frameType string, payload []byte, ttl time.Duration, src *CommandSource) (*QueuedCommand, error) {
+	if _, ok := downlinkCommands[frameType]; !ok {
+		return nil, ErrUnsupportedCommand
+	}
+	id := CommandDeviceId(payload)
+	if id == "" {
+		return nil, errors.New("command has no device id")
+	}
+	if ttl <= 0 {
+		ttl = q.DefaultTTL
+	}
+	now := time.Now()
+	c := &QueuedCommand{
+		Id:        NewId(),
+		DeviceId:  id,
+		FrameType: frameType,
+		Payload:   payload,
+		Status:    CommandPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if src == nil {
+		src = autoSource
+	}
+	source := *src
+	c.Source = &source
+
+	q.mu.Lock()
+	q.commands[c.Id] = c
+	q.devices[id] = append(q.devices[id], c.Id)
+	snap := q.snapshot()
+	q.mu.Unlock()
+	q.save(snap)
+
+	q.deliver(id)
+	q.mu.Lock()
+	cp := *c
+	q.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"id":         c.Id,
+		"device_id":  id,
+		"frame_type": frameType,
+		"expires_at": c.ExpiresAt,
+	}).Debug("command queued")
+	return &cp, nil
+}
+
+// Get returns a copy of a command.
+func (q *CommandQueue) Get(id string) (*QueuedCommand, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c, ok := q.commands[id]
+	if !ok {
+		return nil, ErrCommandNotFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+// List returns copies of all commands of a pile, or of all piles if
+// deviceId is empty, oldest first.
+func (q *CommandQueue) List(deviceId string) []*QueuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var commands []*QueuedCommand
+	for _, c := range q.commands {
+		if deviceId != "" && c.DeviceId != deviceId {
+			continue
+		}
+		cp := *c
+		commands = append(commands, &cp)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].CreatedAt.Before(commands[j].CreatedAt)
+	})
+	return commands
+}
+
+// Flush delivers the next queued command of a pile, used once the pile has
+// (re)connected and passed verification.
+func (q *CommandQueue) Flush(deviceId string) {
+	q.deliver(deviceId)
+}
+
+// Resolve finishes the in-flight command of a pile that is answered by the
+// given reply frame type.
+func (q *CommandQueue) Resolve(deviceId string, replyFrameType string, reply interface{}) {
+	q.mu.Lock()
+	c := q.head(deviceId)
+	if c == nil || c.Status != CommandSent || downlinkCommands[c.FrameType].Reply != replyFrameType {
+		q.mu.Unlock()
+		return
+	}
+	c.Reply, _ = json.Marshal(reply)
+	q.finish(c, CommandReplied, "")
+	snap := q.snapshot()
+	q.mu.Unlock()
+	q.save(snap)
+
+	q.deliver(deviceId)
+}
+
+// Run retries and expires commands until Close is called.
+func (q *CommandQueue) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.tick()
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+func (q *CommandQueue) Close() error {
+	close(q.quit)
+	q.mu.Lock()
+	snap := q.snapshot()
+	q.mu.Unlock()
+	q.save(snap)
+	return nil
+}
+
+func (q *CommandQueue) tick() {
+	q.mu.Lock()
+	now := time.Now()
+	changed := false
+	devices := make([]string, 0, len(q.devices))
+	for deviceId := range q.devices {
+		c := q.head(deviceId)
+		if c == nil {
+			continue
+		}
+		devices = append(devices, deviceId)
+		if c.Status == CommandSent && now.Sub(*c.SentAt) > q.ReplyTimeout {
+			if c.Attempts >= q.MaxAttempts {
+				q.finish(c, CommandFailed, "no reply from device")
+			} else {
+				c.Status = CommandPending
+			}
+			changed = true
+		}
+	}
+	for id, c := range q.commands {
+		if c.finished() && now.Sub(*c.DoneAt) > commandRetention {
+			delete(q.commands, id)
+			changed = true
+		}
+	}
+	var snap *queueSnapshot
+	if changed {
+		snap = q.snapshot()
+	}
+	q.mu.Unlock()
+	q.save(snap)
+
+	for _, deviceId := range devices {
+		q.deliver(deviceId)
+	}
+}
+
+// head returns the oldest unfinished command of a pile. Must be called with
+// q.mu held.
+func (q *CommandQueue) head(deviceId string) *QueuedCommand {
+	ids := q.devices[deviceId]
+	if len(ids) == 0 {
+		return nil
+	}
+	return q.commands[ids[0]]
+}
+
+// finish must be called with q.mu held, c must be the head of its pile.
+func (q *CommandQueue) finish(c *QueuedCommand, status string, reason string) {
+	now := time.Now()
+	c.Status = status
+	c.Error = reason
+	c.DoneAt = &now
+	ids := q.devices[c.DeviceId][1:]
+	if len(ids) == 0 {
+		delete(q.devices, c.DeviceId)
+	} else {
+		q.devices[c.DeviceId] = ids
+	}
+	log.WithFields(log.Fields{
+		"id":         c.Id,
+		"device_id":  c.DeviceId,
+		"frame_type": c.FrameType,
+		"status":     status,
+		"attempts":   c.Attempts,
+	}).Info("command finished")
+}
+
+// deliver sends pending commands of a pile until one is waiting for a reply
+// or the pile turns out to be unreachable. A command is marked sent before
+// it is written to the pile without q.mu held, so it is neither sent twice
+// nor does a quick reply find it still pending.
+func (q *CommandQueue) deliver(deviceId string) {
+	for {
+		q.mu.Lock()
+		c, changed := q.next(deviceId)
+		var snap *queueSnapshot
+		if changed {
+			snap = q.snapshot()
+		}
+		if c == nil {
+			q.mu.Unlock()
+			q.save(snap)
+			return
+		}
+		prev := c.SentAt
+		now := time.Now()
+		c.Status = CommandSent
+		c.SentAt = &now
+		c.Attempts++
+		frameType, payload := c.FrameType, c.Payload
+		src := &CommandSource{Api: SourceAuto, CommandId: c.Id}
+		if c.Source != nil {
+			src.Api, src.Caller = c.Source.Api, c.Source.Caller
+		}
+		q.mu.Unlock()
+		q.save(snap)
+
+		err := DispatchCommand(frameType, payload, src)
+
+		q.mu.Lock()
+		more := q.sent(c, prev, err)
+		snap = q.snapshot()
+		q.mu.Unlock()
+		q.save(snap)
+		if !more {
+			return
+		}
+	}
+}
+
+// next returns the pending command of a pile to send, if the pile is
+// connected, expiring the ones past their time. Reports whether anything
+// changed. Must be called with q.mu held.
+func (q *CommandQueue) next(deviceId string) (*QueuedCommand, bool) {
+	changed := false
+	for {
+		c := q.head(deviceId)
+		if c == nil || c.Status != CommandPending {
+			return nil, changed
+		}
+		if time.Now().After(c.ExpiresAt) {
+			q.finish(c, CommandExpired, "")
+			changed = true
+			continue
+		}
+		if _, err := GetClient(deviceId); err != nil {
+			return nil, changed
+		}
+		return c, changed
+	}
+}
+
+// sent records the outcome of sending c, prev is when it was sent before.
+// Reports whether the next command of the pile may be sent. Must be called
+// with q.mu held.
+func (q *CommandQueue) sent(c *QueuedCommand, prev *time.Time, err error) bool {
+	//answered while it was being written
+	if c.Status != CommandSent {
+		return true
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":        c.Id,
+			"device_id": c.DeviceId,
+			"attempts":  c.Attempts,
+		}).Warnf("error delivering command: %v", err)
+		c.Error = err.Error()
+		c.SentAt = prev
+		if c.Attempts >= q.MaxAttempts {
+			q.finish(c, CommandFailed, err.Error())
+			return true
+		}
+		c.Status = CommandPending
+		return false
+	}
+	c.Error = ""
+	if downlinkCommands[c.FrameType].Reply == "" {
+		q.finish(c, CommandReplied, "")
+		return true
+	}
+	return false
+}
+
+// ResolveCommand hands an uplink reply to the request waiting for it and to
+// the command queue, if enabled.
+func ResolveCommand(deviceId string, replyFrameType string, reply interface{}) {
+	notifyReply(deviceId, replyFrameType, reply)
+	if commandQueue != nil {
+		commandQueue.Resolve(deviceId, replyFrameType, reply)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCommandQueueDeliversInOrderOnceConnected(t *testing.T) {
+	q, err := NewCommandQueue("", time.Minute, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "32010600213533"
+	first, _ := q.Enqueue("36", []byte(`{"id":"`+id+`","gunId":"01"}`), 0, nil)
+	second, _ := q.Enqueue("92", []byte(`{"id":"`+id+`","control":1}`), 0, nil)
+	if c, _ := q.Get(first.Id); c.Status != CommandPending {
+		t.Fatalf("expected offline command to stay pending, got %s", c.Status)
+	}
+
+	server, device := net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, device) }()
+	StoreClient(id, server)
+	defer clients.Delete(id)
+
+	q.Flush(id)
+	if c, _ := q.Get(first.Id); c.Status != CommandSent || c.Attempts != 1 {
+		t.Fatalf("expected first command to be sent once, got %s/%d", c.Status, c.Attempts)
+	}
+	if c, _ := q.Get(second.Id); c.Status != CommandPending {
+		t.Fatalf("expected second command to wait for the first, got %s", c.Status)
+	}
+
+	// a reply of the wrong frame type must not resolve the command
+	q.Resolve(id, "91", nil)
+	if c, _ := q.Get(first.Id); c.Status != CommandSent {
+		t.Fatalf("expected first command to still be in flight, got %s", c.Status)
+	}
+
+	q.Resolve(id, "35", &RemoteShutdownResponseMessage{Id: id, Result: true})
+	if c, _ := q.Get(first.Id); c.Status != CommandReplied || len(c.Reply) == 0 {
+		t.Fatalf("expected first command to be replied, got %s", c.Status)
+	}
+	if c, _ := q.Get(second.Id); c.Status != CommandSent {
+		t.Fatalf("expected second command to be sent next, got %s", c.Status)
+	}
+}
+
+func TestCommandQueueExpiresAndRetries(t *testing.T) {
+	q, err := NewCommandQueue("", time.Minute, time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := q.Enqueue("92", []byte(`{"id":"00000000000001","control":1}`), time.Millisecond, nil)
+	time.Sleep(5 * time.Millisecond)
+	q.tick()
+	if c, _ := q.Get(expired.Id); c.Status != CommandExpired {
+		t.Fatalf("expected command to expire, got %s", c.Status)
+	}
+
+	id := "00000000000002"
+	server, device := net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, device) }()
+	StoreClient(id, server)
+	defer clients.Delete(id)
+
+	cmd, _ := q.Enqueue("92", []byte(`{"id":"`+id+`","control":1}`), 0, nil)
+	for i := 0; i < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+		q.tick()
+	}
+	c, _ := q.Get(cmd.Id)
+	if c.Status != CommandFailed || c.Attempts != 2 {
+		t.Fatalf("expected command to fail after 2 attempts, got %s/%d", c.Status, c.Attempts)
+	}
+}
+
+func TestCommandQueueSendsWithoutLock(t *testing.T) {
+	q, err := NewCommandQueue("", time.Minute, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "32010600213534"
+	server, device := net.Pipe()
+	defer server.Close()
+	StoreClient(id, server)
+	defer clients.Delete(id)
+
+	//nobody reads from the pile, so the write blocks
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		_, _ = q.Enqueue("92", []byte(`{"id":"`+id+`","control":1}`), 0, nil)
+	}()
+	listed := make(chan []*QueuedCommand)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		listed <- q.List(id)
+	}()
+	select {
+	case list := <-listed:
+		if len(list) != 1 || list[0].Status != CommandSent {
+			t.Fatalf("expected the command marked sent while it is written, got %+v", list)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queue locked while a command is written")
+	}
+	_, _ = device.Read(make([]byte, 64))
+	<-queued
+}
+
+func TestCommandQueueFlushedOnDeviceLogin(t *testing.T) {
+	q, err := NewCommandQueue("", time.Minute, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandQueue = q
+	defer func() { commandQueue = nil }()
+	imei := "861435073900846"
+	if _, err := q.Enqueue("83", []byte(`{"id":"`+imei+`","port":1,"orderNumber":1,"chargingMode":1}`), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer RemoveClient(server)
+	raw := deviceLoginFrame(imei)
+	go DeviceLoginRouter(&Options{}, raw, BytesToHex(raw), &Header{}, server)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	if n, err := client.Read(buf); err != nil || buf[4] != DeviceLogin {
+		t.Fatalf("login not answered: %v % x", err, buf[:n])
+	}
+	if n, err := client.Read(buf); err != nil || buf[4] != RemoteStart {
+		t.Fatalf("queued command not delivered after login: %v % x", err, buf[:n])
+	}
+}
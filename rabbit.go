@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RABBIT_ROUTING_KEY_PREFIX = "ykc"
+	rabbitConfirmTimeout      = 5 * time.Second
+	rabbitMaxReconnectDelay   = 30 * time.Second
+)
+
+var ErrRabbitNotConnected = errors.New("not connected to rabbitmq")
+
+// rabbitConnection and rabbitChannel are what the forwarder needs of amqp, so
+// tests can stand in for the broker.
+type rabbitConnection interface {
+	Channel() (rabbitChannel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type rabbitChannel interface {
+	Confirm(noWait bool) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	// PublishConfirmed publishes msg and waits for the broker to confirm it,
+	// ok is false if the broker rejected it.
+	PublishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) (ok bool, err error)
+}
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (rabbitChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return amqpChannel{ch}, nil
+}
+
+type amqpChannel struct {
+	*amqp.Channel
+}
+
+func (c amqpChannel) PublishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) (bool, error) {
+	dc, err := c.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return false, err
+	}
+	return dc.WaitContext(ctx)
+}
+
+func dialAmqp(server string, cfg amqp.Config) (rabbitConnection, error) {
+	conn, err := amqp.DialConfig(server, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// RabbitForwarder publishes device messages to a durable topic exchange with
+// routing key ykc.<frameType>.<pileId> and waits for the broker to confirm
+// each of them. Subscribed topics are bound to one durable command queue,
+// e.g. cmd.34 to ykc.cmd.34.#. The connection is re-established with back
+// off when it is lost.
+type RabbitForwarder struct {
+	Servers      []string
+	Username     string
+	Password     string
+	Exchange     string
+	CommandQueue string
+	Encoding     string
+
+	dial      func(server string, cfg amqp.Config) (rabbitConnection, error)
+	mu        sync.Mutex
+	conn      rabbitConnection
+	ch        rabbitChannel
+	consuming bool
+	handlers  map[string]func(message []byte)
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func (h *RabbitForwarder) Connect() error {
+	h.quit = make(chan struct{})
+	h.handlers = make(map[string]func(message []byte))
+	if h.dial == nil {
+		h.dial = dialAmqp
+	}
+	closed, err := h.connect()
+	if err != nil {
+		return err
+	}
+	h.wg.Add(1)
+	go h.watch(closed)
+	return nil
+}
+
+// connect dials the servers in turn and declares the exchange, and the
+// command queue if anything is subscribed.
+func (h *RabbitForwarder) connect() (chan *amqp.Error, error) {
+	cfg := amqp.Config{Heartbeat: 10 * time.Second}
+	if h.Username != "" {
+		cfg.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: h.Username, Password: h.Password}}
+	}
+	var conn rabbitConnection
+	var err error
+	for _, s := range h.Servers {
+		conn, err = h.dial(s, cfg)
+		if err == nil {
+			break
+		}
+		log.Warnf("can not connect to rabbitmq server %s: %v", s, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err == nil {
+		err = ch.ExchangeDeclare(h.Exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// a channel closed by the broker, e.g. on a publish error, is recovered
+	// through a reconnect
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err := <-chClosed; err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conn = conn
+	h.ch = ch
+	h.consuming = false
+	if len(h.handlers) > 0 {
+		if err := h.consume(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	log.WithFields(log.Fields{
+		"exchange": h.Exchange,
+	}).Info("connected to rabbitmq")
+	return conn.NotifyClose(make(chan *amqp.Error, 1)), nil
+}
+
+// watch reconnects whenever the connection is closed by anything but Close.
+func (h *RabbitForwarder) watch(closed chan *amqp.Error) {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-h.quit:
+			return
+		case err := <-closed:
+			select {
+			case <-h.quit:
+				return
+			default:
+			}
+			log.Warnf("rabbitmq connection lost: %v", err)
+		}
+		h.mu.Lock()
+		h.ch = nil
+		h.mu.Unlock()
+
+		delay := time.Second
+		for {
+			select {
+			case <-h.quit:
+				return
+			case <-time.After(delay):
+			}
+			c, err := h.connect()
+			if err == nil {
+				closed = c
+				break
+			}
+			log.Errorf("error reconnecting to rabbitmq: %v", err)
+			delay *= 2
+			if delay > rabbitMaxReconnectDelay {
+				delay = rabbitMaxReconnectDelay
+			}
+		}
+	}
+}
+
+func (h *RabbitForwarder) Publish(mid string, message []byte) error {
+	h.mu.Lock()
+	ch := h.ch
+	h.mu.Unlock()
+	if ch == nil {
+		return ErrRabbitNotConnected
+	}
+	key := rabbitRoutingKey(mid, MessageDeviceId(message))
+	body, headers, err := wireMessage(h.Encoding, mid, message, nil, "", "content-type")
+	if err != nil {
+		return err
+	}
+	contentType := headers["content-type"]
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rabbitConfirmTimeout)
+	defer cancel()
+	ok, err := ch.PublishConfirmed(ctx, h.Exchange, key, amqp.Publishing{
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		Type:         mid,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err == nil && !ok {
+		err = errors.New("message rejected by rabbitmq")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mid":         mid,
+			"routing_key": key,
+		}).Errorf("error forwarding message to rabbitmq: %v", err)
+	}
+	return err
+}
+
+// Subscribe binds the command queue to ykc.<topic>.#, so a command may be
+// published with or without the pile id appended to its routing key.
+func (h *RabbitForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers[topic] = handler
+	if h.ch == nil {
+		// bound on reconnect
+		return nil
+	}
+	if !h.consuming {
+		return h.consume()
+	}
+	return h.ch.QueueBind(h.CommandQueue, RABBIT_ROUTING_KEY_PREFIX+"."+topic+".#", h.Exchange, false, nil)
+}
+
+// consume must be called with h.mu held.
+func (h *RabbitForwarder) consume() error {
+	if _, err := h.ch.QueueDeclare(h.CommandQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	for topic := range h.handlers {
+		if err := h.ch.QueueBind(h.CommandQueue, RABBIT_ROUTING_KEY_PREFIX+"."+topic+".#", h.Exchange, false, nil); err != nil {
+			return err
+		}
+	}
+	deliveries, err := h.ch.Consume(h.CommandQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	h.consuming = true
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for d := range deliveries {
+			handler := h.handler(d.RoutingKey)
+			if handler == nil {
+				log.Warnf("no handler for rabbitmq command %s, dropping it", d.RoutingKey)
+				_ = d.Nack(false, false)
+				continue
+			}
+			handler(d.Body)
+			_ = d.Ack(false)
+		}
+	}()
+	return nil
+}
+
+func (h *RabbitForwarder) handler(routingKey string) func(message []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return rabbitHandler(h.handlers, routingKey)
+}
+
+func (h *RabbitForwarder) Close() error {
+	close(h.quit)
+	h.mu.Lock()
+	conn := h.conn
+	h.ch = nil
+	h.mu.Unlock()
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	h.wg.Wait()
+	if errors.Is(err, amqp.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+func rabbitRoutingKey(mid string, deviceId string) string {
+	if deviceId == "" {
+		deviceId = "unknown"
+	}
+	return RABBIT_ROUTING_KEY_PREFIX + "." + mid + "." + deviceId
+}
+
+// rabbitHandler finds the handler of the topic a routing key was published
+// to, matching both ykc.<topic> and ykc.<topic>.<pileId>.
+func rabbitHandler(handlers map[string]func(message []byte), routingKey string) func(message []byte) {
+	key := strings.TrimPrefix(routingKey, RABBIT_ROUTING_KEY_PREFIX+".")
+	for topic, handler := range handlers {
+		if key == topic || strings.HasPrefix(key, topic+".") {
+			return handler
+		}
+	}
+	return nil
+}
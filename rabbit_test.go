@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRabbitRouting(t *testing.T) {
+	if k := rabbitRoutingKey("13", "32010600213533"); k != "ykc.13.32010600213533" {
+		t.Errorf("got routing key %s", k)
+	}
+	if k := rabbitRoutingKey("security", ""); k != "ykc.security.unknown" {
+		t.Errorf("got routing key %s", k)
+	}
+
+	var called string
+	handlers := map[string]func(message []byte){
+		"cmd.34": func([]byte) { called = "34" },
+		"cmd.3":  func([]byte) { called = "3" },
+	}
+	cases := map[string]string{
+		"ykc.cmd.34":                "34",
+		"ykc.cmd.34.32010600213533": "34",
+		"ykc.cmd.3":                 "3",
+	}
+	for key, want := range cases {
+		called = ""
+		h := rabbitHandler(handlers, key)
+		if h == nil {
+			t.Errorf("%s: no handler", key)
+			continue
+		}
+		h(nil)
+		if called != want {
+			t.Errorf("%s: got handler %s, want %s", key, called, want)
+		}
+	}
+	if rabbitHandler(handlers, "ykc.cmd.99") != nil {
+		t.Error("unexpected handler for ykc.cmd.99")
+	}
+}
+
+type fakePublishing struct {
+	key string
+	msg amqp.Publishing
+}
+
+// fakeRabbit stands in for the broker, handing out a fakeRabbitConn, which is
+// its own channel too, per dial.
+type fakeRabbit struct {
+	mu        sync.Mutex
+	dials     int
+	reject    bool
+	published []fakePublishing
+	bindings  []string
+	acked     []uint64
+	nacked    []uint64
+	conns     []*fakeRabbitConn
+}
+
+func (r *fakeRabbit) dial(string, amqp.Config) (rabbitConnection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dials++
+	c := &fakeRabbitConn{r: r, deliveries: make(chan amqp.Delivery, 8)}
+	r.conns = append(r.conns, c)
+	return c, nil
+}
+
+func (r *fakeRabbit) conn() *fakeRabbitConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[len(r.conns)-1]
+}
+
+func (r *fakeRabbit) Ack(tag uint64, multiple bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acked = append(r.acked, tag)
+	return nil
+}
+
+func (r *fakeRabbit) Nack(tag uint64, multiple bool, requeue bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nacked = append(r.nacked, tag)
+	return nil
+}
+
+func (r *fakeRabbit) Reject(tag uint64, requeue bool) error {
+	return r.Nack(tag, false, requeue)
+}
+
+type fakeRabbitConn struct {
+	r          *fakeRabbit
+	mu         sync.Mutex
+	closed     bool
+	notify     []chan *amqp.Error
+	deliveries chan amqp.Delivery
+}
+
+func (c *fakeRabbitConn) Channel() (rabbitChannel, error) { return c, nil }
+func (c *fakeRabbitConn) Confirm(bool) error              { return nil }
+func (c *fakeRabbitConn) ExchangeDeclare(string, string, bool, bool, bool, bool, amqp.Table) error {
+	return nil
+}
+
+func (c *fakeRabbitConn) QueueDeclare(name string, _, _, _, _ bool, _ amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeRabbitConn) QueueBind(name, key, exchange string, _ bool, _ amqp.Table) error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.bindings = append(c.r.bindings, key)
+	return nil
+}
+
+func (c *fakeRabbitConn) Consume(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+	return c.deliveries, nil
+}
+
+func (c *fakeRabbitConn) PublishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) (bool, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.published = append(c.r.published, fakePublishing{key: key, msg: msg})
+	return !c.r.reject, nil
+}
+
+func (c *fakeRabbitConn) NotifyClose(ch chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = append(c.notify, ch)
+	return ch
+}
+
+// drop closes the connection as the broker would, with an error.
+func (c *fakeRabbitConn) drop() {
+	c.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restarted"})
+}
+
+func (c *fakeRabbitConn) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeRabbitConn) shutdown(err *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, ch := range c.notify {
+		if err != nil {
+			ch <- err
+		}
+		close(ch)
+	}
+	close(c.deliveries)
+}
+
+func newTestRabbitForwarder(r *fakeRabbit) *RabbitForwarder {
+	f := &RabbitForwarder{Servers: []string{"amqp://localhost"}, Exchange: "ykc", CommandQueue: "ykc-commands", dial: r.dial}
+	if err := f.Connect(); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestRabbitPublishConfirms(t *testing.T) {
+	r := &fakeRabbit{}
+	f := newTestRabbitForwarder(r)
+	defer f.Close()
+
+	if err := f.Publish("13", []byte(`{"id":"32010600213533"}`)); err != nil {
+		t.Fatal(err)
+	}
+	p := r.published[0]
+	if p.key != "ykc.13.32010600213533" || p.msg.DeliveryMode != amqp.Persistent || p.msg.Type != "13" || p.msg.ContentType != "application/json" {
+		t.Fatalf("unexpected publishing %s %+v", p.key, p.msg)
+	}
+	r.mu.Lock()
+	r.reject = true
+	r.mu.Unlock()
+	if err := f.Publish("13", []byte(`{"id":"32010600213533"}`)); err == nil {
+		t.Fatal("rejected message reported as published")
+	}
+}
+
+func TestRabbitCommandQueue(t *testing.T) {
+	r := &fakeRabbit{}
+	f := newTestRabbitForwarder(r)
+
+	got := make(chan []byte, 1)
+	if err := f.Subscribe("cmd.34", func(message []byte) { got <- message }); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Subscribe("cmd.36", func([]byte) {})
+	if len(r.bindings) != 2 || r.bindings[0] != "ykc.cmd.34.#" || r.bindings[1] != "ykc.cmd.36.#" {
+		t.Fatalf("unexpected bindings %v", r.bindings)
+	}
+
+	c := r.conn()
+	c.deliveries <- amqp.Delivery{Acknowledger: r, DeliveryTag: 1, RoutingKey: "ykc.cmd.99", Body: []byte(`{}`)}
+	c.deliveries <- amqp.Delivery{Acknowledger: r, DeliveryTag: 2, RoutingKey: "ykc.cmd.34.32010600213533", Body: []byte(`{"id":"32010600213533"}`)}
+	if m := <-got; MessageDeviceId(m) != "32010600213533" {
+		t.Fatalf("unexpected command %s", m)
+	}
+	//acked once handled
+	_ = f.Close()
+	if len(r.nacked) != 1 || r.nacked[0] != 1 || len(r.acked) != 1 || r.acked[0] != 2 {
+		t.Fatalf("acked %v, nacked %v", r.acked, r.nacked)
+	}
+}
+
+func TestRabbitReconnect(t *testing.T) {
+	r := &fakeRabbit{}
+	f := newTestRabbitForwarder(r)
+	defer f.Close()
+	_ = f.Subscribe("cmd.34", func([]byte) {})
+
+	r.conn().drop()
+	//the first attempt is made after a second
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		r.mu.Lock()
+		dials, bindings := r.dials, len(r.bindings)
+		r.mu.Unlock()
+		if dials == 2 && bindings == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected, %d dials and %d bindings", dials, bindings)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := f.Publish("13", []byte(`{"id":"32010600213533"}`)); err != nil {
+		t.Fatalf("publish after reconnect: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redisBlock      = 5 * time.Second
+	redisClaimIdle  = time.Minute
+	redisReadCount  = 10
+	redisDataField  = "data"
+	redisFrameField = "frameType"
+)
+
+// RedisForwarder adds device messages to one stream per frame type
+// (StreamPrefix.<frameType>), trimmed to about MaxLen entries. Next to the
+// message in field data every entry carries the frame type, the pile id and,
+// with CloudEvents in binary mode, the ce_ attributes.
+//
+// Commands are read from the streams StreamPrefix.cmd.<frameType> as member
+// Consumer of the consumer group Group, so gateway instances sharing the
+// group each get a part of them. An entry is acknowledged once it has been
+// handled; entries left pending by an instance that died are claimed by the
+// others after a minute.
+type RedisForwarder struct {
+	Servers      []string
+	Username     string
+	Password     string
+	StreamPrefix string
+	MaxLen       int64
+	Group        string
+	Consumer     string
+	Encoding     string
+
+	client redis.UniversalClient
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (h *RedisForwarder) Connect() error {
+	if h.client == nil {
+		h.client = redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:    h.Servers,
+			Username: h.Username,
+			Password: h.Password,
+		})
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if err := h.client.Ping(h.ctx).Err(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"servers": strings.Join(h.Servers, ","),
+		"stream":  h.StreamPrefix + ".<frameType>",
+	}).Info("redis forwarder ready")
+	return nil
+}
+
+func (h *RedisForwarder) Publish(mid string, message []byte) error {
+	return h.PublishEvent(mid, message, nil)
+}
+
+// PublishEvent carries CloudEvents attributes as ce_ fields.
+func (h *RedisForwarder) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	body, headers, err := wireMessage(h.Encoding, mid, message, attrs, "ce_", "content-type")
+	if err != nil {
+		return err
+	}
+	values := []interface{}{redisFrameField, mid, "id", MessageDeviceId(message)}
+	for k, v := range headers {
+		values = append(values, k, v)
+	}
+	values = append(values, redisDataField, body)
+	stream := h.StreamPrefix + "." + mid
+	err = h.client.XAdd(h.ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: h.MaxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mid":    mid,
+			"stream": stream,
+		}).Errorf("error forwarding message to redis: %v", err)
+	}
+	return err
+}
+
+// Subscribe consumes the stream of topic (relative to StreamPrefix), creating
+// the consumer group if needed. The command is taken from field data.
+func (h *RedisForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	stream := h.StreamPrefix + "." + topic
+	err := h.client.XGroupCreateMkStream(h.ctx, stream, h.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.consume(stream, handler)
+	}()
+	return nil
+}
+
+func (h *RedisForwarder) consume(stream string, handler func(message []byte)) {
+	// entries delivered to this consumer before a restart come first
+	start := "0"
+	for h.ctx.Err() == nil {
+		claimed, _, err := h.client.XAutoClaim(h.ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    h.Group,
+			Consumer: h.Consumer,
+			MinIdle:  redisClaimIdle,
+			Start:    "0-0",
+			Count:    redisReadCount,
+		}).Result()
+		if err == nil {
+			h.handle(stream, claimed, handler)
+		}
+
+		block := redisBlock
+		if start != ">" {
+			block = -1
+		}
+		res, err := h.client.XReadGroup(h.ctx, &redis.XReadGroupArgs{
+			Group:    h.Group,
+			Consumer: h.Consumer,
+			Streams:  []string{stream, start},
+			Count:    redisReadCount,
+			Block:    block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if h.ctx.Err() != nil {
+				return
+			}
+			log.Errorf("error consuming redis stream %s: %v", stream, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, s := range res {
+			if len(s.Messages) == 0 {
+				start = ">"
+			}
+			h.handle(stream, s.Messages, handler)
+		}
+	}
+}
+
+func (h *RedisForwarder) handle(stream string, messages []redis.XMessage, handler func(message []byte)) {
+	for _, m := range messages {
+		if data, ok := m.Values[redisDataField].(string); ok {
+			handler([]byte(data))
+		} else {
+			log.WithFields(log.Fields{
+				"stream": stream,
+				"entry":  m.ID,
+			}).Error("redis command without data field")
+		}
+		if err := h.client.XAck(h.ctx, stream, h.Group, m.ID).Err(); err != nil && h.ctx.Err() == nil {
+			log.Errorf("error acknowledging redis entry %s: %v", m.ID, err)
+		}
+	}
+}
+
+func (h *RedisForwarder) Close() error {
+	h.cancel()
+	h.wg.Wait()
+	return h.client.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisForwarder(t *testing.T) {
+	s := miniredis.RunT(t)
+	f := &RedisForwarder{
+		Servers:      []string{s.Addr()},
+		StreamPrefix: NATS_PUBLISH_SUBJECT_PREFIX,
+		MaxLen:       100,
+		Group:        "ykc-proxy-server",
+		Consumer:     "gw-1",
+	}
+	if err := f.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Publish("3b", []byte(`{"id":"32010600213533","tradeSeq":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.Stream(NATS_PUBLISH_SUBJECT_PREFIX + ".3b")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one entry, got %v, %v", entries, err)
+	}
+	values := map[string]string{}
+	for i := 0; i+1 < len(entries[0].Values); i += 2 {
+		values[entries[0].Values[i]] = entries[0].Values[i+1]
+	}
+	if values["id"] != "32010600213533" || values["frameType"] != "3b" || values["data"] == "" {
+		t.Fatalf("unexpected entry %v", values)
+	}
+
+	got := make(chan string, 1)
+	if err := f.Subscribe("cmd.92", func(message []byte) { got <- string(message) }); err != nil {
+		t.Fatal(err)
+	}
+	stream := NATS_PUBLISH_SUBJECT_PREFIX + ".cmd.92"
+	c := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer c.Close()
+	c.XAdd(context.Background(), &redis.XAddArgs{Stream: stream, Values: []string{"data", `{"id":"32010600213533"}`}})
+	select {
+	case m := <-got:
+		if m != `{"id":"32010600213533"}` {
+			t.Fatalf("unexpected command %s", m)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("command not consumed")
+	}
+	// acknowledged once handled
+	deadline := time.Now().Add(time.Second)
+	for {
+		p, _ := c.XPending(context.Background(), stream, "ykc-proxy-server").Result()
+		if p != nil && p.Count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command still pending: %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PolicyAccept = "accept"
+	PolicyReject = "reject"
+	PolicyDefer  = "defer"
+)
+
+// the registry file is checked for changes at most this often
+const registryCheckInterval = 10 * time.Second
+
+var deviceRegistry *DeviceRegistry
+
+// RegisteredDevice is an entry of the device registry. Sim and Imei are
+// optional bindings, a login reporting a different value is rejected.
+type RegisteredDevice struct {
+	Id     string `json:"id"`
+	Sim    string `json:"sim,omitempty"`
+	Imei   string `json:"imei,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// DeviceRegistry is the local list of piles allowed to log in. It is read
+// from a json file holding an array of RegisteredDevice, which is reloaded
+// when it changes.
+type DeviceRegistry struct {
+	File          string
+	UnknownPolicy string
+
+	mu        sync.Mutex
+	devices   map[string]*RegisteredDevice
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func NewDeviceRegistry(file string, unknownPolicy string) (*DeviceRegistry, error) {
+	switch unknownPolicy {
+	case PolicyAccept, PolicyReject, PolicyDefer:
+	default:
+		return nil, errors.New("unknown device policy must be accept, reject or defer")
+	}
+	r := &DeviceRegistry{
+		File:          file,
+		UnknownPolicy: unknownPolicy,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *DeviceRegistry) load() error {
+	fi, err := os.Stat(r.File)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(r.File)
+	if err != nil {
+		return err
+	}
+	var list []*RegisteredDevice
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	devices := make(map[string]*RegisteredDevice, len(list))
+	for _, d := range list {
+		devices[d.Id] = d
+	}
+	r.devices = devices
+	r.modTime = fi.ModTime()
+	r.checkedAt = time.Now()
+	log.WithFields(log.Fields{
+		"file":    r.File,
+		"devices": len(devices),
+	}).Info("device registry loaded")
+	return nil
+}
+
+// reloadIfChanged must be called with r.mu held.
+func (r *DeviceRegistry) reloadIfChanged() {
+	if time.Since(r.checkedAt) < registryCheckInterval {
+		return
+	}
+	r.checkedAt = time.Now()
+	fi, err := os.Stat(r.File)
+	if err != nil || fi.ModTime().Equal(r.modTime) {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Errorf("error reloading device registry, keeping the old one: %v", err)
+	}
+}
+
+// Lookup finds a device by id, or by its bound IMEI.
+func (r *DeviceRegistry) Lookup(id string) *RegisteredDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloadIfChanged()
+	if d, ok := r.devices[id]; ok {
+		return d
+	}
+	for _, d := range r.devices {
+		if d.Imei != "" && d.Imei == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// Decide applies the login policy to a pile reporting the given sim and
+// imei, either of which may be empty if the login frame does not carry it.
+// It returns the policy and, for rejections, the reason.
+func (r *DeviceRegistry) Decide(id string, sim string, imei string) (string, string) {
+	d := r.Lookup(id)
+	if d == nil {
+		if r.UnknownPolicy == PolicyReject {
+			return PolicyReject, "unknown device"
+		}
+		return r.UnknownPolicy, ""
+	}
+	if d.Sim != "" && sim != "" && !strings.EqualFold(d.Sim, sim) {
+		return PolicyReject, "sim does not match"
+	}
+	if d.Imei != "" && imei != "" && d.Imei != imei {
+		return PolicyReject, "imei does not match"
+	}
+	switch d.Policy {
+	case PolicyReject:
+		return PolicyReject, "device is blocked"
+	case PolicyDefer:
+		return PolicyDefer, ""
+	}
+	return PolicyAccept, ""
+}
+
+// SecurityEvent is published when a pile is refused.
+type SecurityEvent struct {
+	Type          string `json:"type" proto:"1"`
+	FrameType     string `json:"frameType" proto:"2"`
+	Id            string `json:"id" proto:"3"`
+	Reason        string `json:"reason" proto:"4"`
+	RemoteAddress string `json:"remoteAddress" proto:"5"`
+	Time          int64  `json:"time" proto:"6"`
+}
+
+// PublishSecurityEvent logs a refused login and forwards it under the
+// "security" subject.
+func PublishSecurityEvent(opt *Options, frameType string, id string, reason string, conn net.Conn) {
+	e := &SecurityEvent{
+		Type:          "login_rejected",
+		FrameType:     frameType,
+		Id:            id,
+		Reason:        reason,
+		RemoteAddress: conn.RemoteAddr().String(),
+		Time:          time.Now().UnixMilli(),
+	}
+	log.WithFields(log.Fields{
+		"id":         id,
+		"frame_type": frameType,
+		"reason":     reason,
+		"address":    e.RemoteAddress,
+	}).Warn("login rejected")
+	PublishUplink(conn, "security", e, nil)
+
+	//forward
+	if opt.MessageForwarder != nil {
+		b, _ := json.Marshal(e)
+		_ = opt.MessageForwarder.Publish("security", b)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeviceRegistryDecide(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	err := os.WriteFile(file, []byte(`[
+		{"id": "32010600213533", "sim": "89860"},
+		{"id": "32010600213534", "policy": "defer"},
+		{"id": "32010600213535", "policy": "reject"},
+		{"id": "pile-a", "imei": "861435073900843"}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDeviceRegistry(file, PolicyReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		id, sim, imei string
+		policy        string
+	}{
+		{"32010600213533", "89860", "", PolicyAccept},
+		{"32010600213533", "", "", PolicyAccept},
+		{"32010600213533", "12345", "", PolicyReject},
+		{"32010600213534", "", "", PolicyDefer},
+		{"32010600213535", "", "", PolicyReject},
+		{"861435073900843", "", "861435073900843", PolicyAccept},
+		{"99999999999999", "", "", PolicyReject},
+	}
+	for _, c := range cases {
+		if p, reason := r.Decide(c.id, c.sim, c.imei); p != c.policy {
+			t.Errorf("%s/%s: expected %s, got %s (%s)", c.id, c.sim, c.policy, p, reason)
+		}
+	}
+}
+
+// deviceLoginFrame builds an 81 frame of a Huaping pile, versions and CCID
+// zeroed.
+func deviceLoginFrame(imei string) []byte {
+	data := make([]byte, 56)
+	data[0] = 2
+	return PackHuapingFrame(DeviceLogin, imei, data)
+}
+
+func TestDeviceLoginPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	_ = os.WriteFile(file, []byte(`[
+		{"id": "861435073900843", "imei": "861435073900843"},
+		{"id": "861435073900844", "imei": "861435073900844", "policy": "defer"}
+	]`), 0600)
+	r, err := NewDeviceRegistry(file, PolicyReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceRegistry = r
+	defer func() { deviceRegistry = nil }()
+
+	for imei, answered := range map[string]bool{"861435073900843": true, "861435073900844": false} {
+		server, client := net.Pipe()
+		f := &flakyForwarder{}
+		raw := deviceLoginFrame(imei)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			DeviceLoginRouter(&Options{MessageForwarder: f}, raw, BytesToHex(raw), &Header{}, server)
+		}()
+		_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		<-done
+		if (err == nil) != answered || (answered && buf[4] != DeviceLogin) {
+			t.Errorf("%s: unexpected answer %v % x", imei, err, buf[:n])
+		}
+		if len(f.published) != 1 || f.published[0] != "81" {
+			t.Errorf("%s: login not forwarded %v", imei, f.published)
+		}
+		RemoveClient(server)
+		_ = client.Close()
+	}
+}
+
+func TestDeviceLoginAnswer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	_ = os.WriteFile(file, []byte(`[{"id": "861435073900844", "imei": "861435073900844", "policy": "defer"}]`), 0600)
+	r, err := NewDeviceRegistry(file, PolicyReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceRegistry = r
+	defer func() { deviceRegistry = nil }()
+
+	login := func(imei string) (net.Conn, net.Conn) {
+		server, client := net.Pipe()
+		raw := deviceLoginFrame(imei)
+		go DeviceLoginRouter(&Options{}, raw, BytesToHex(raw), &Header{}, server)
+		return server, client
+	}
+	read := func(client net.Conn) ([]byte, error) {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		return buf[:n], err
+	}
+
+	//the backend answers the deferred login
+	server, client := login("861435073900844")
+	defer RemoveClient(server)
+	deadline := time.Now().Add(time.Second)
+	for _, err := GetClient("861435073900844"); err != nil && time.Now().Before(deadline); _, err = GetClient("861435073900844") {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		if err := DispatchCommand("81", []byte(`{"id":"861435073900844","heartbeatPeriod":30}`), nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	got, err := read(client)
+	want := HexToBytes("5aa50c008100000000000000001e00ab")
+	if err != nil || string(got) != string(want) {
+		t.Fatalf("unexpected answer % x, %v", got, err)
+	}
+	_ = client.Close()
+
+	//an unknown pile is refused and disconnected
+	server, client = login("861435073900845")
+	defer RemoveClient(server)
+	if got, err := read(client); err != nil || got[len(got)-2] != DeviceLoginIllegal {
+		t.Fatalf("unexpected answer % x, %v", got, err)
+	}
+	if _, err := read(client); err != io.EOF {
+		t.Fatalf("connection left open: %v", err)
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -48,10 +51,40 @@ func VerificationRouter(opt *Options, buf []byte, hex []string, header *Header,
 		"sim":              msg.Sim,
 		"operator":         msg.Operator,
 	}).Debug("[01] Verification message")
+	PublishUplink(conn, "01", msg, hex)
+
+	//a pile with a client certificate may only log in as the pile it was issued to
+	if identity := ConnIdentity(conn); identity != "" && identity != msg.Id {
+		rejectVerification(opt, msg.Id, "id does not match client certificate "+identity, header, conn)
+		return
+	}
+
+	policy := PolicyDefer
+	if opt.AutoVerification {
+		policy = PolicyAccept
+	}
+	if deviceRegistry != nil {
+		p, reason := deviceRegistry.Decide(msg.Id, msg.Sim, "")
+		if p == PolicyReject {
+			rejectVerification(opt, msg.Id, reason, header, conn)
+			return
+		}
+		policy = p
+	}
 	StoreClient(msg.Id, conn)
+	sessions.Update(conn, func(s *DeviceSession) {
+		s.Id = msg.Id
+		s.Protocol = ProtocolYKC
+		s.ProtocolVersion = msg.ProtocolVersion
+		s.SoftwareVersion = msg.SoftwareVersion
+		s.Sim = msg.Sim
+		s.Guns = msg.Guns
+	})
+	sessions.Save(conn)
+	PublishDeviceStatus(opt, msg.Id, true)
 
 	//auto response
-	if opt.AutoVerification {
+	if policy == PolicyAccept {
 		m := &VerificationResponseMessage{
 			Header: &Header{
 				Seq:       0,
@@ -60,7 +93,7 @@ func VerificationRouter(opt *Options, buf []byte, hex []string, header *Header,
 			Id:     msg.Id,
 			Result: true,
 		}
-		_ = ResponseToVerification(m)
+		_ = ResponseToVerification(m, autoSource)
 		return
 	}
 
@@ -73,14 +106,54 @@ func VerificationRouter(opt *Options, buf []byte, hex []string, header *Header,
 
 }
 
+// rejectVerification answers a login verification with a failure straight on
+// the connection and disconnects the pile, which is never registered under
+// the id it claimed.
+func rejectVerification(opt *Options, id string, reason string, header *Header, conn net.Conn) {
+	m := &VerificationResponseMessage{
+		Header: &Header{
+			Seq:       header.Seq,
+			Encrypted: header.Encrypted,
+		},
+		Id:     id,
+		Result: false,
+	}
+	resp := PackVerificationResponseMessage(m)
+	if _, err := conn.Write(resp); err == nil {
+		PublishDownlink(conn, "02", m, resp, autoSource)
+	}
+	PublishSecurityEvent(opt, "01", id, reason, conn)
+	_ = conn.Close()
+}
+
+func DeviceLoginResponseRouter(c *gin.Context) {
+	var req DeviceLoginResponseMessage
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "81", &req) {
+		return
+	}
+	err := ResponseToDeviceLogin(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "done"})
+}
+
 func VerificationResponseRouter(c *gin.Context) {
 	var req VerificationResponseMessage
-	if c.ShouldBind(&req) == nil {
-		err := ResponseToVerification(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "02", &req) {
+		return
+	}
+	err := ResponseToVerification(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
@@ -110,10 +183,11 @@ func SendHeartbeatResponse(conn net.Conn, header *Header) error {
 		return err
 	}
 	log.Debug("Sent Heartbeat Response successfully")
+	PublishDownlink(conn, "82", header, resp.Bytes(), autoSource)
 	return nil
 }
 
-func HeartbeatRouter(buf []byte, header *Header, conn net.Conn) {
+func HeartbeatRouter(buf []byte, hex []string, header *Header, conn net.Conn) {
 	msg := PackHeartbeatMessage(buf, header)
 	if msg == nil {
 		log.Error("Failed to parse Heartbeat message")
@@ -127,17 +201,76 @@ func HeartbeatRouter(buf []byte, header *Header, conn net.Conn) {
 		"totalPortCount": msg.TotalPortCount,
 		"portStatus":     msg.PortStatus,
 	}).Debug("[82] Heartbeat message")
+	PublishUplink(conn, "82", msg, hex)
+	sessions.Update(conn, func(s *DeviceSession) {
+		now := time.Now()
+		s.LastHeartbeat = &now
+		s.Signal = msg.SignalValue
+		s.Temperature = msg.Temperature
+		s.Guns = msg.TotalPortCount
+		for i, status := range msg.PortStatus {
+			g := s.Gun(portGun(i + 1))
+			g.Status = status
+			g.UpdatedAt = now
+		}
+	})
+	sessions.Save(conn)
 
 	// Send Heartbeat Response
 	_ = SendHeartbeatResponse(conn, header)
 }
 
+// PileHeartbeatRouter keeps the last heartbeat of a YKC pile and answers it
+// with 04 if AutoHeartbeatResponse is set, else forwards it.
+func PileHeartbeatRouter(opt *Options, buf []byte, hex []string, header *Header, conn net.Conn) {
+	msg := PackPileHeartbeatMessage(buf, hex, header)
+	if msg == nil {
+		log.Error("Failed to parse Pile Heartbeat message")
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":     msg.Id,
+		"gun":    msg.Gun,
+		"status": msg.Status,
+	}).Debug("[03] Heartbeat message")
+	PublishUplink(conn, "03", msg, hex)
+	sessions.Update(conn, func(s *DeviceSession) {
+		now := time.Now()
+		s.LastHeartbeat = &now
+	})
+	sessions.Save(conn)
+
+	//auto response
+	if opt.AutoHeartbeatResponse {
+		m := &HeartbeatResponseMessage{
+			Header: &Header{
+				Seq:       header.Seq,
+				Encrypted: false,
+			},
+			Id:  msg.Id,
+			Gun: msg.Gun,
+		}
+		data := PackHeartbeatResponseMessage(m)
+		if sendMessage(conn, data) == nil {
+			PublishDownlink(conn, "04", m, data, autoSource)
+		}
+		return
+	}
+
+	//forward
+	if opt.MessageForwarder != nil {
+		b, _ := json.Marshal(msg)
+		_ = opt.MessageForwarder.Publish("03", b)
+	}
+}
+
 func BillingModelVerificationRouter(opt *Options, hex []string, header *Header, conn net.Conn) {
 	msg := PackBillingModelVerificationMessage(hex, header)
 	log.WithFields(log.Fields{
 		"id":                 msg.Id,
 		"billing_model_code": msg.BillingModelCode,
 	}).Debug("[05] BillingModelVerification message")
+	PublishUplink(conn, "05", msg, hex)
 
 	//auto response
 	if opt.AutoBillingModelVerify {
@@ -150,7 +283,7 @@ func BillingModelVerificationRouter(opt *Options, hex []string, header *Header,
 			BillingModelCode: msg.BillingModelCode,
 			Result:           true,
 		}
-		_ = ResponseToBillingModelVerification(m)
+		_ = ResponseToBillingModelVerification(m, autoSource)
 		return
 	}
 
@@ -167,6 +300,7 @@ func BillingModelRequestMessageRouter(opt *Options, hex []string, header *Header
 	log.WithFields(log.Fields{
 		"id": msg.Id,
 	}).Debug("[09] BillingModelRequest message")
+	PublishUplink(conn, "09", msg, hex)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -178,36 +312,48 @@ func BillingModelRequestMessageRouter(opt *Options, hex []string, header *Header
 
 func BillingModelResponseMessageRouter(c *gin.Context) {
 	var req BillingModelResponseMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendBillingModelResponseMessage(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "0a", &req) {
+		return
+	}
+	err := SendBillingModelResponseMessage(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
 
 func BillingModelVerificationResponseRouter(c *gin.Context) {
 	var req BillingModelVerificationResponseMessage
-	if c.ShouldBind(&req) == nil {
-		err := ResponseToBillingModelVerification(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "06", &req) {
+		return
+	}
+	err := ResponseToBillingModelVerification(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
 
 func RemoteBootstrapRequestRouter(c *gin.Context) {
 	var req RemoteBootstrapRequestMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendRemoteBootstrapRequest(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "34", &req) {
+		return
+	}
+	err := SendRemoteBootstrapRequest(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
@@ -221,6 +367,15 @@ func RemoteBootstrapResponseRouter(opt *Options, hex []string, header *Header) {
 		"result":                msg.Result,
 		"reason":                msg.Reason,
 	}).Debug("[33] RemoteBootstrapResponse message")
+	PublishUplink(nil, "33", msg, hex)
+	if msg.Result {
+		sessions.UpdateDevice(msg.Id, func(s *DeviceSession) {
+			g := s.Gun(msg.GunId)
+			g.TradeSeq = msg.TradeSeq
+			g.UpdatedAt = time.Now()
+		})
+	}
+	ResolveCommand(msg.Id, "33", msg)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -251,6 +406,18 @@ func OfflineDataReportMessageRouter(opt *Options, raw []byte, hex []string, head
 		"charged_amount":                   msg.ChargedAmount,
 		"hardware_failure":                 msg.HardwareFailure,
 	}).Debug("[13] OfflineDataReport message")
+	PublishUplink(nil, "13", msg, hex)
+	sessions.UpdateDevice(msg.Id, func(s *DeviceSession) {
+		g := s.Gun(msg.GunId)
+		g.Status = msg.Status
+		g.Plugged = msg.Plugged == 1
+		g.TradeSeq = ""
+		if msg.Status == GunStatusCharging {
+			g.TradeSeq = msg.TradeSeq
+		}
+		g.RealTime = msg
+		g.UpdatedAt = time.Now()
+	})
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -268,6 +435,8 @@ func RemoteShutdownResponseRouter(opt *Options, hex []string, header *Header) {
 		"result": msg.Result,
 		"reason": msg.Reason,
 	}).Debug("[35] RemoteShutdownResponse message")
+	PublishUplink(nil, "35", msg, hex)
+	ResolveCommand(msg.Id, "35", msg)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -279,24 +448,32 @@ func RemoteShutdownResponseRouter(opt *Options, hex []string, header *Header) {
 
 func RemoteShutdownRequestRouter(c *gin.Context) {
 	var req RemoteShutdownRequestMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendRemoteShutdownRequest(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "36", &req) {
+		return
+	}
+	err := SendRemoteShutdownRequest(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
 
 func TransactionRecordConfirmedRouter(c *gin.Context) {
 	var req TransactionRecordConfirmedMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendTransactionRecordConfirmed(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "40", &req) {
+		return
+	}
+	err := SendTransactionRecordConfirmed(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
@@ -307,7 +484,65 @@ func TransactionRecordMessageRouter(opt *Options, raw []byte, hex []string, head
 	log.WithFields(log.Fields{
 		"msg": string(msgJson),
 	}).Debug("[3b] TransactionRecord message")
+	PublishUplink(nil, "3b", msg, hex)
+	sessions.UpdateDevice(msg.Id, func(s *DeviceSession) {
+		if g := s.Gun(msg.GunId); g.TradeSeq == msg.TradeSeq {
+			g.TradeSeq = ""
+			g.UpdatedAt = time.Now()
+		}
+	})
 
+	//stored before anything else, an unstored record is not confirmed and
+	//the pile uploads it again
+	forwarded := false
+	if store != nil {
+		r, err := store.SaveTransaction(msg)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":       msg.Id,
+				"tradeSeq": msg.TradeSeq,
+			}).Errorf("error storing transaction record: %v", err)
+			return
+		}
+		if r.Uploads > 1 {
+			log.WithFields(log.Fields{
+				"id":       msg.Id,
+				"tradeSeq": msg.TradeSeq,
+				"uploads":  r.Uploads,
+			}).Info("duplicate transaction record")
+		}
+		//the pile missed the confirmation, it gets the same one again
+		if r.Confirmation != nil {
+			m := *r.Confirmation
+			m.Header = &Header{
+				Seq:       0,
+				Encrypted: false,
+			}
+			_ = SendTransactionRecordConfirmed(&m, autoSource)
+			return
+		}
+		forwarded = r.ForwardedAt != nil
+	}
+
+	//forward, only once per trade with a store
+	if opt.MessageForwarder != nil && !forwarded {
+		//convert msg to json string bytes
+		b, _ := json.Marshal(msg)
+		if err := opt.MessageForwarder.Publish("3b", b); err != nil {
+			//not confirmed, so the pile uploads the record again
+			return
+		}
+		if store != nil {
+			if err := store.ForwardTransaction(msg.TradeSeq, time.Now()); err != nil {
+				log.WithFields(log.Fields{
+					"id":       msg.Id,
+					"tradeSeq": msg.TradeSeq,
+				}).Errorf("error storing transaction record: %v", err)
+			}
+		}
+	}
+
+	//auto confirm once the record has been stored and forwarded
 	if opt.AutoTransactionRecordConfirm {
 		m := &TransactionRecordConfirmedMessage{
 			Header: &Header{
@@ -318,15 +553,7 @@ func TransactionRecordMessageRouter(opt *Options, raw []byte, hex []string, head
 			TradeSeq: msg.TradeSeq,
 			Result:   0,
 		}
-		_ = SendTransactionRecordConfirmed(m)
-		return
-	}
-
-	//forward
-	if opt.MessageForwarder != nil {
-		//convert msg to json string bytes
-		b, _ := json.Marshal(msg)
-		_ = opt.MessageForwarder.Publish("3b", b)
+		_ = SendTransactionRecordConfirmed(m, autoSource)
 	}
 }
 
@@ -336,6 +563,8 @@ func RemoteRebootResponseMessageRouter(opt *Options, hex []string, header *Heade
 		"id":     msg.Id,
 		"result": msg.Result,
 	}).Debug("[91] RemoteRebootResponse message")
+	PublishUplink(nil, "91", msg, hex)
+	ResolveCommand(msg.Id, "91", msg)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -347,24 +576,32 @@ func RemoteRebootResponseMessageRouter(opt *Options, hex []string, header *Heade
 
 func RemoteRebootRequestMessageRouter(c *gin.Context) {
 	var req RemoteRebootRequestMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendRemoteRebootRequest(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "92", &req) {
+		return
+	}
+	err := SendRemoteRebootRequest(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
 
 func SetBillingModelRequestRouter(c *gin.Context) {
 	var req SetBillingModelRequestMessage
-	if c.ShouldBind(&req) == nil {
-		err := SendSetBillingModelRequestMessage(&req)
-		if err != nil {
-			c.JSON(500, gin.H{"message": err})
-			return
-		}
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "58", &req) {
+		return
+	}
+	err := SendSetBillingModelRequestMessage(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
 	}
 	c.JSON(200, gin.H{"message": "done"})
 }
@@ -375,6 +612,8 @@ func SetBillingModelResponseMessageRouter(opt *Options, hex []string, header *He
 		"id":     msg.Id,
 		"result": msg.Result,
 	}).Debug("[57] SetBillingModelResponse message")
+	PublishUplink(nil, "57", msg, hex)
+	ResolveCommand(msg.Id, "57", msg)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -384,11 +623,78 @@ func SetBillingModelResponseMessageRouter(opt *Options, hex []string, header *He
 	}
 }
 
+func SetWorkingParamsResponseRouter(opt *Options, hex []string, header *Header) {
+	msg := PackSetWorkingParamsResponseMessage(hex, header)
+	log.WithFields(log.Fields{
+		"id":     msg.Id,
+		"result": msg.Result,
+	}).Debug("[51] SetWorkingParamsResponse message")
+	PublishUplink(nil, "51", msg, hex)
+	ResolveCommand(msg.Id, "51", msg)
+
+	//forward
+	if opt.MessageForwarder != nil {
+		//convert msg to json string bytes
+		b, _ := json.Marshal(msg)
+		_ = opt.MessageForwarder.Publish("51", b)
+	}
+}
+
+func SetWorkingParamsRequestRouter(c *gin.Context) {
+	var req SetWorkingParamsRequestMessage
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "52", &req) {
+		return
+	}
+	err := SendSetWorkingParamsRequest(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "done"})
+}
+
+func NtpResponseRouter(opt *Options, raw []byte, hex []string, header *Header) {
+	msg := PackNtpResponseMessage(raw, hex, header)
+	log.WithFields(log.Fields{
+		"id":   msg.Id,
+		"time": msg.Time,
+	}).Debug("[55] NtpResponse message")
+	PublishUplink(nil, "55", msg, hex)
+	ResolveCommand(msg.Id, "55", msg)
+
+	//forward
+	if opt.MessageForwarder != nil {
+		//convert msg to json string bytes
+		b, _ := json.Marshal(msg)
+		_ = opt.MessageForwarder.Publish("55", b)
+	}
+}
+
+func NtpRequestRouter(c *gin.Context) {
+	var req NtpRequestMessage
+	if !bindCommand(c, &req) {
+		return
+	}
+	if queueCommand(c, "56", &req) {
+		return
+	}
+	err := SendNtpRequest(&req, restSource(c))
+	if err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "done"})
+}
+
 func ChargingFinishedMessageRouter(opt *Options, hex []string, header *Header) {
 	msg := PackChargingFinishedMessage(hex, header)
 	log.WithFields(log.Fields{
 		"id": msg.Id,
 	}).Debug("[19] ChargingFinished message")
+	PublishUplink(nil, "19", msg, hex)
 
 	//forward
 	if opt.MessageForwarder != nil {
@@ -398,7 +704,7 @@ func ChargingFinishedMessageRouter(opt *Options, hex []string, header *Header) {
 	}
 }
 
-func DeviceLoginRouter(opt *Options, buf []byte, header *Header, conn net.Conn) {
+func DeviceLoginRouter(opt *Options, buf []byte, hex []string, header *Header, conn net.Conn) {
 	// Unpack Device Login Message
 	msg := PackDeviceLoginMessage(buf, header)
 
@@ -430,6 +736,35 @@ func DeviceLoginRouter(opt *Options, buf []byte, header *Header, conn net.Conn)
 		"signalValue":     msg.SignalValue,
 		"loginReason":     msg.LoginReason,
 	}).Debug("[81] Device Login message")
+	PublishUplink(conn, "81", msg, hex)
+
+	//like 01, a pile with a client certificate may only log in as its IMEI
+	if identity := ConnIdentity(conn); identity != "" && identity != msg.IMEI {
+		rejectDeviceLogin(opt, msg.IMEI, "imei does not match client certificate "+identity, header, conn)
+		return
+	}
+
+	policy := PolicyAccept
+	if deviceRegistry != nil {
+		p, reason := deviceRegistry.Decide(msg.IMEI, msg.CCID, msg.IMEI)
+		if p == PolicyReject {
+			rejectDeviceLogin(opt, msg.IMEI, reason, header, conn)
+			return
+		}
+		policy = p
+	}
+	StoreClient(msg.IMEI, conn)
+	sessions.Update(conn, func(s *DeviceSession) {
+		s.Id = msg.IMEI
+		s.Protocol = ProtocolHuaping
+		s.HardwareVersion = msg.HardwareVersion
+		s.SoftwareVersion = msg.SoftwareVersion
+		s.Sim = msg.CCID
+		s.Guns = msg.DevicePortCount
+		s.Signal = msg.SignalValue
+	})
+	sessions.Save(conn)
+	PublishDeviceStatus(opt, msg.IMEI, true)
 
 	// Auto response preparation
 	heartbeatPeriod := 30 // Default heartbeat interval (30 seconds)
@@ -465,9 +800,18 @@ func DeviceLoginRouter(opt *Options, buf []byte, header *Header, conn net.Conn)
 		0xF0, 0x7D, // Footer
 	}
 
-	PrintHexAndByte(message)
-	sendMessage(conn, message)
-	log.Debug("Sent Device Login response successfully")
+	//a deferred login is only forwarded, like a deferred verification
+	if policy == PolicyAccept {
+		PrintHexAndByte(message)
+		if sendMessage(conn, message) == nil {
+			PublishDownlink(conn, "81", nil, message, autoSource)
+		}
+		log.Debug("Sent Device Login response successfully")
+		//deliver commands queued while the device was offline
+		if commandQueue != nil {
+			go commandQueue.Flush(msg.IMEI)
+		}
+	}
 
 	// Forward the Device Login message to an external system (optional)
 	if opt.MessageForwarder != nil {
@@ -483,72 +827,75 @@ func DeviceLoginRouter(opt *Options, buf []byte, header *Header, conn net.Conn)
 	}
 }
 
-func RemoteStartRouter(buf []byte, header *Header, conn net.Conn) {
-	msg := PackRemoteStartMessage(buf, header)
+// rejectDeviceLogin answers a device login with an illegal module result and
+// disconnects the pile, which is never registered under the IMEI it claimed.
+func rejectDeviceLogin(opt *Options, imei string, reason string, header *Header, conn net.Conn) {
+	resp := &DeviceLoginResponseMessage{
+		Header:          header,
+		Id:              imei,
+		Time:            "00000000000000",
+		HeartbeatPeriod: 30,
+		Result:          DeviceLoginIllegal,
+	}
+	data := PackDeviceLoginResponseMessage(resp)
+	if sendMessage(conn, data) == nil {
+		PublishDownlink(conn, "81", resp, data, autoSource)
+	}
+	PublishSecurityEvent(opt, "81", imei, reason, conn)
+	_ = conn.Close()
+}
+
+// RemoteStartRouter handles the reply of a Huaping pile to a remote start
+// (83) sent by the proxy. Replies are not answered.
+func RemoteStartRouter(buf []byte, hex []string, header *Header, conn net.Conn) {
+	msg := PackPortCommandReplyMessage(buf, header)
 	if msg == nil {
-		log.Error("Failed to parse Remote Start message")
+		log.Error("Failed to parse Remote Start reply")
 		return
 	}
 
 	log.WithFields(log.Fields{
-		"port":            msg.Port,
-		"orderNumber":     msg.OrderNumber,
-		"startMethod":     msg.StartMethod,
-		"cardNumber":      msg.CardNumber,
-		"chargingMethod":  msg.ChargingMethod,
-		"chargingParam":   msg.ChargingParam,
-		"availableAmount": msg.AvailableAmount,
-	}).Debug("[83] Remote Start message")
-
-	// Auto Response
-	response := &RemoteStartResponseMessage{
-		Header:      header,
-		Port:        msg.Port,
-		OrderNumber: msg.OrderNumber,
-		StartMethod: msg.StartMethod,
-		Result:      0x00, // 0x00 for success
-	}
-
-	data := PackRemoteStartResponseMessage(response)
-	_, err := conn.Write(data)
-	if err != nil {
-		log.Errorf("Failed to send Remote Start response: %v", err)
-	} else {
-		log.Debug("Sent Remote Start response successfully")
+		"id":          msg.Id,
+		"port":        msg.Port,
+		"orderNumber": msg.OrderNumber,
+		"result":      msg.Result,
+	}).Debug("[83] Remote Start reply")
+	PublishUplink(conn, "83", msg, hex)
+	ResolveCommand(ConnDeviceId(conn), "83", msg)
+	if msg.Result == 0 {
+		sessions.Update(conn, func(s *DeviceSession) {
+			g := s.Gun(portGun(msg.Port))
+			g.TradeSeq = strconv.FormatUint(uint64(msg.OrderNumber), 10)
+			g.UpdatedAt = time.Now()
+		})
 	}
 }
 
-func RemoteStopRouter(buf []byte, header *Header, conn net.Conn) {
-	msg := PackRemoteStopMessage(buf, header)
+// RemoteStopRouter handles the reply of a Huaping pile to a remote stop
+// (84) sent by the proxy. The trade ends with the final status (85).
+func RemoteStopRouter(buf []byte, hex []string, header *Header, conn net.Conn) {
+	msg := PackPortCommandReplyMessage(buf, header)
 	if msg == nil {
-		log.Error("Failed to parse Remote Stop message")
+		log.Error("Failed to parse Remote Stop reply")
 		return
 	}
 
 	log.WithFields(log.Fields{
+		"id":          msg.Id,
 		"port":        msg.Port,
 		"orderNumber": msg.OrderNumber,
-	}).Debug("[84] Remote Stop message")
-
-	// Auto Response
-	response := &RemoteStopResponseMessage{
-		Header:      header,
-		Port:        msg.Port,
-		OrderNumber: msg.OrderNumber,
-		Result:      0x00, // 0x00 for success, other values for specific errors
-	}
-
-	data := PackRemoteStopResponseMessage(response)
-	_, err := conn.Write(data)
-	if err != nil {
-		log.Errorf("Failed to send Remote Stop response: %v", err)
-	} else {
-		log.Debug("Sent Remote Stop response successfully")
-	}
+		"result":      msg.Result,
+	}).Debug("[84] Remote Stop reply")
+	PublishUplink(conn, "84", msg, hex)
+	ResolveCommand(ConnDeviceId(conn), "84", msg)
 }
 
-func SubmitFinalStatusRouter(opt *Options, buf []byte, header *Header, conn net.Conn) {
+func SubmitFinalStatusRouter(opt *Options, buf []byte, hex []string, header *Header, conn net.Conn) {
 	msg := PackSubmitFinalStatusMessage(buf, header)
+	if msg == nil {
+		log.Error("Failed to parse Submit Final Status message")
+		return
+	}
 	log.WithFields(log.Fields{
 		"port":             msg.Port,
 		"orderNumber":      msg.OrderNumber,
@@ -561,6 +908,12 @@ func SubmitFinalStatusRouter(opt *Options, buf []byte, header *Header, conn net.
 		"segmentDurations": msg.SegmentDurations,
 		"segmentPrices":    msg.SegmentPrices,
 	}).Debug("[85] Submit Final Status message")
+	PublishUplink(conn, "85", msg, hex)
+	sessions.Update(conn, func(s *DeviceSession) {
+		g := s.Gun(portGun(int(msg.Port)))
+		g.TradeSeq = ""
+		g.UpdatedAt = time.Now()
+	})
 
 	// Auto Response
 	response := &SubmitFinalStatusResponse{
@@ -574,5 +927,142 @@ func SubmitFinalStatusRouter(opt *Options, buf []byte, header *Header, conn net.
 		log.Errorf("Failed to send Submit Final Status response: %v", err)
 	} else {
 		log.Debug("Sent Submit Final Status response successfully")
+		PublishDownlink(conn, "85", response, data, autoSource)
+	}
+}
+
+// queueCommand hands a downlink command to the command queue when it is
+// enabled and writes the response. It reports whether the command was taken
+// care of.
+func queueCommand(c *gin.Context, frameType string, req interface{}) bool {
+	if commandQueue == nil {
+		return false
+	}
+	var ttl time.Duration
+	if v := c.Query("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "invalid ttl: " + err.Error()})
+			return true
+		}
+		ttl = d
+	}
+	payload, _ := json.Marshal(req)
+	cmd, err := commandQueue.Enqueue(frameType, payload, ttl, restSource(c))
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return true
+	}
+	c.JSON(202, cmd)
+	return true
+}
+
+func ListCommandsRouter(c *gin.Context) {
+	caller := callerOf(c)
+	list := make([]*QueuedCommand, 0)
+	for _, cmd := range commandQueue.List(c.Query("deviceId")) {
+		if caller.CanAccess(cmd.DeviceId) {
+			list = append(list, cmd)
+		}
+	}
+	c.JSON(200, list)
+}
+
+func GetCommandRouter(c *gin.Context) {
+	cmd, err := commandQueue.Get(c.Param("id"))
+	if err == nil && !callerOf(c).CanAccess(cmd.DeviceId) {
+		err = ErrCommandNotFound
+	}
+	if err != nil {
+		c.JSON(404, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, cmd)
+}
+
+// bindCommand decodes the body of a command, answering 400 if that fails.
+// Like decodeCommand it makes sure the command carries a header.
+func bindCommand(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(400, ApiMessage{Message: "invalid command", Errors: []string{err.Error()}})
+		return false
+	}
+	if h := reflect.ValueOf(req).Elem().FieldByName("Header"); h.IsValid() && h.IsNil() {
+		h.Set(reflect.ValueOf(&Header{}))
+	}
+	return true
+}
+
+func ListSchemasRouter(c *gin.Context) {
+	c.JSON(200, JSONSchemas())
+}
+
+// GetSchemaRouter returns the JSON Schema of a frame type, or the protobuf
+// definition of all messages for ykc.proto.
+func GetSchemaRouter(c *gin.Context) {
+	if c.Param("frameType") == "ykc.proto" {
+		def, err := ProtoDefinition()
+		if err != nil {
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.String(200, def)
+		return
+	}
+	s, ok := lookupSchemaKey(c.Param("frameType"))
+	if !ok {
+		c.JSON(404, gin.H{"message": "no schema for frame type " + c.Param("frameType")})
+		return
+	}
+	c.JSON(200, s.JSONSchema())
+}
+
+func (s *Server) RemoteStartPortRouter(c *gin.Context) {
+	s.portCommand(c, "83")
+}
+
+func (s *Server) RemoteStopPortRouter(c *gin.Context) {
+	s.portCommand(c, "84")
+}
+
+// portCommand sends a command taking the pile and port from the path to a
+// Huaping pile and answers with the pile's reply.
+func (s *Server) portCommand(c *gin.Context, frameType string) {
+	body := make(map[string]interface{})
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "invalid json: " + err.Error()})
+		return
+	}
+	port, err := strconv.Atoi(c.Param("port"))
+	if err != nil {
+		c.JSON(400, gin.H{"message": "invalid port"})
+		return
+	}
+	body["id"] = c.Param("id")
+	body["port"] = port
+	payload, _ := json.Marshal(body)
+	if ms, ok := LookupCommandSchema(frameType); ok {
+		if errs := ms.Validate(payload); len(errs) > 0 {
+			c.JSON(400, gin.H{"message": "invalid command", "errors": errs})
+			return
+		}
+	}
+	r := ExecuteCommand(frameType, payload, s.Opt.CommandReplyTimeout, restSource(c))
+	c.JSON(commandStatusCode(r), r)
+}
+
+// commandStatusCode is the http status answering a command result.
+func commandStatusCode(r *CommandResult) int {
+	switch r.Status {
+	case ResultQueued:
+		return 202
+	case ResultTimeout:
+		return 504
+	case ResultFailed:
+		if r.Error == ErrClientNotFound.Error() {
+			return 404
+		}
+		return 500
 	}
+	return 200
 }
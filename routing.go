@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RouteSink is a forwarder messages can be routed to. Type is one of the
+// messagingServerType values or jetstream. If Commands is set, downlink
+// commands are taken from the sink as well.
+type RouteSink struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Servers  []string `json:"servers"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Commands bool     `json:"commands,omitempty"`
+}
+
+// RouteRule sends the messages it matches to Sinks. Every criterion that is
+// set must match, a list matches if any of its values does.
+type RouteRule struct {
+	FrameTypes []string `json:"frameTypes,omitempty"`
+	IdPrefixes []string `json:"idPrefixes,omitempty"`
+	Operators  []int    `json:"operators,omitempty"`
+	Sinks      []string `json:"sinks"`
+}
+
+// RoutingConfig is the json file read by -routes. Messages no rule matches
+// go to Default.
+type RoutingConfig struct {
+	Sinks   []RouteSink `json:"sinks"`
+	Rules   []RouteRule `json:"rules"`
+	Default []string    `json:"default,omitempty"`
+}
+
+// RoutingForwarder fans messages out to the sinks of every matching rule.
+// The sinks are published to concurrently and a failing sink does not keep
+// the message from the others. The operator of a pile is only part of its
+// login (01), so it is remembered for the pile's later messages.
+//
+// A transaction record some sinks failed is uploaded again by the pile, it
+// then only goes to the sinks that have not taken it yet.
+type RoutingForwarder struct {
+	config *RoutingConfig
+	sinks  map[string]MessageForwarder
+
+	mu        sync.Mutex
+	operators map[string]int
+	delivered map[string]*sinkDelivery
+}
+
+// sinkDelivery is the sinks that took a message others failed.
+type sinkDelivery struct {
+	sinks map[string]bool
+	at    time.Time
+}
+
+// how long the sinks that took a message are remembered for its retry
+const routingDeliveryWindow = 24 * time.Hour
+
+func NewRoutingForwarder(file string, opt *Options) (*RoutingForwarder, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg RoutingConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	sinks := make(map[string]MessageForwarder, len(cfg.Sinks))
+	for _, s := range cfg.Sinks {
+		if _, ok := sinks[s.Name]; ok || s.Name == "" {
+			return nil, fmt.Errorf("sink name %q is empty or not unique", s.Name)
+		}
+		f, err := NewForwarder(s.Type, s.Servers, s.Username, s.Password, opt)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", s.Name, err)
+		}
+		if s.Commands {
+			if err := SubscribeCommands(f, opt.CommandReplyTimeout); err != nil {
+				return nil, fmt.Errorf("sink %s: %w", s.Name, err)
+			}
+		}
+		if opt.Outbox {
+			f, err = WithOutbox(s.Name, f, opt)
+			if err != nil {
+				return nil, fmt.Errorf("sink %s: %w", s.Name, err)
+			}
+		}
+		sinks[s.Name] = f
+		log.WithFields(log.Fields{
+			"sink": s.Name,
+			"type": s.Type,
+		}).Info("message sink ready")
+	}
+	return newRoutingForwarder(&cfg, sinks)
+}
+
+func newRoutingForwarder(cfg *RoutingConfig, sinks map[string]MessageForwarder) (*RoutingForwarder, error) {
+	names := append([]string{}, cfg.Default...)
+	for _, r := range cfg.Rules {
+		names = append(names, r.Sinks...)
+	}
+	for _, name := range names {
+		if _, ok := sinks[name]; !ok {
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+	}
+	return &RoutingForwarder{
+		config:    cfg,
+		sinks:     sinks,
+		operators: make(map[string]int),
+		delivered: make(map[string]*sinkDelivery),
+	}, nil
+}
+
+func (h *RoutingForwarder) Connect() error {
+	return nil
+}
+
+// Publish returns an error naming the sinks that failed, if any.
+func (h *RoutingForwarder) Publish(mid string, message []byte) error {
+	return h.PublishEvent(mid, message, nil)
+}
+
+// PublishEvent passes CloudEvents attributes on to the sinks, as headers or
+// as structured envelope depending on what the sink supports.
+func (h *RoutingForwarder) PublishEvent(mid string, message []byte, attrs map[string]string) error {
+	id, operator, hasOperator := h.operator(message)
+	key := MessageDedupId(mid, message)
+	targets := h.undelivered(key, h.route(mid, id, operator, hasOperator))
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, name := range targets {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			if attrs != nil {
+				errs[i] = publishEvent(h.sinks[name], mid, message, attrs)
+			} else {
+				errs[i] = h.sinks[name].Publish(mid, message)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	var failed, took []string
+	for i, err := range errs {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"mid":  mid,
+				"sink": targets[i],
+			}).Errorf("error forwarding message: %v", err)
+			failed = append(failed, targets[i])
+		} else {
+			took = append(took, targets[i])
+		}
+	}
+	h.recordDelivery(key, took, len(failed) == 0)
+	if len(failed) > 0 {
+		return errors.New("forwarding failed for sinks " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// undelivered drops the sinks that already took the message with the key.
+func (h *RoutingForwarder) undelivered(key string, targets []string) []string {
+	if key == "" {
+		return targets
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.delivered[key]
+	if !ok {
+		return targets
+	}
+	var rest []string
+	for _, name := range targets {
+		if !d.sinks[name] {
+			rest = append(rest, name)
+		}
+	}
+	return rest
+}
+
+// recordDelivery remembers the sinks that took the message with the key
+// until every sink has it.
+func (h *RoutingForwarder) recordDelivery(key string, took []string, done bool) {
+	if key == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if done {
+		delete(h.delivered, key)
+		return
+	}
+	now := time.Now()
+	for k, d := range h.delivered {
+		if now.Sub(d.at) > routingDeliveryWindow {
+			delete(h.delivered, k)
+		}
+	}
+	d, ok := h.delivered[key]
+	if !ok {
+		d = &sinkDelivery{sinks: make(map[string]bool)}
+		h.delivered[key] = d
+	}
+	d.at = now
+	for _, name := range took {
+		d.sinks[name] = true
+	}
+}
+
+// operator returns the pile id of a message and the operator of the pile,
+// learning it from messages that carry it.
+func (h *RoutingForwarder) operator(message []byte) (string, int, bool) {
+	var v struct {
+		Id       string `json:"id"`
+		Operator *int   `json:"operator"`
+	}
+	_ = json.Unmarshal(MessageData(message), &v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v.Operator != nil && v.Id != "" {
+		h.operators[v.Id] = *v.Operator
+		return v.Id, *v.Operator, true
+	}
+	op, ok := h.operators[v.Id]
+	return v.Id, op, ok
+}
+
+// route returns the names of the sinks a message goes to, sorted.
+func (h *RoutingForwarder) route(mid string, id string, operator int, hasOperator bool) []string {
+	set := make(map[string]bool)
+	for _, r := range h.config.Rules {
+		if r.matches(mid, id, operator, hasOperator) {
+			for _, s := range r.Sinks {
+				set[s] = true
+			}
+		}
+	}
+	if len(set) == 0 {
+		for _, s := range h.config.Default {
+			set[s] = true
+		}
+	}
+	targets := make([]string, 0, len(set))
+	for s := range set {
+		targets = append(targets, s)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+func (r *RouteRule) matches(mid string, id string, operator int, hasOperator bool) bool {
+	if len(r.FrameTypes) > 0 {
+		ok := false
+		for _, ft := range r.FrameTypes {
+			ok = ok || strings.EqualFold(ft, mid)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.IdPrefixes) > 0 {
+		ok := false
+		for _, p := range r.IdPrefixes {
+			ok = ok || strings.HasPrefix(id, p)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Operators) > 0 {
+		ok := false
+		for _, op := range r.Operators {
+			ok = ok || (hasOperator && op == operator)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe is not supported, commands are taken from the sinks marked with
+// commands.
+func (h *RoutingForwarder) Subscribe(topic string, handler func(message []byte)) error {
+	return ErrSubscribeUnsupported
+}
+
+func (h *RoutingForwarder) PublishDeviceStatus(id string, online bool) error {
+	for _, f := range h.sinks {
+		if p, ok := f.(DeviceStatusPublisher); ok {
+			_ = p.PublishDeviceStatus(id, online)
+		}
+	}
+	return nil
+}
+
+func (h *RoutingForwarder) Close() error {
+	var err error
+	for name, f := range h.sinks {
+		if cerr := f.Close(); cerr != nil {
+			log.Errorf("error closing sink %s: %v", name, cerr)
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestRoutingForwarder(t *testing.T) {
+	js, kafka, mqtt, webhook, rest := &flakyForwarder{}, &flakyForwarder{failures: 1}, &flakyForwarder{}, &flakyForwarder{}, &flakyForwarder{}
+	cfg := &RoutingConfig{
+		Rules: []RouteRule{
+			{FrameTypes: []string{"3b"}, Sinks: []string{"js", "kafka"}},
+			{FrameTypes: []string{"03"}, Sinks: []string{"mqtt"}},
+			{FrameTypes: []string{"01"}, Sinks: []string{"webhook"}},
+			{IdPrefixes: []string{"3201"}, Operators: []int{7}, FrameTypes: []string{"13"}, Sinks: []string{"webhook"}},
+		},
+		Default: []string{"rest"},
+	}
+	r, err := newRoutingForwarder(cfg, map[string]MessageForwarder{
+		"js": js, "kafka": kafka, "mqtt": mqtt, "webhook": webhook, "rest": rest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the failing kafka sink does not keep the record from jetstream
+	record := []byte(`{"id":"32010600213533","tradeSeq":"32010600213533012301010000000001"}`)
+	if err := r.Publish("3b", record); err == nil {
+		t.Error("expected the kafka failure to be reported")
+	}
+	if len(js.published) != 1 || len(kafka.published) != 0 {
+		t.Errorf("expected record in jetstream only, got js %v kafka %v", js.published, kafka.published)
+	}
+	// the record uploaded again only goes to kafka
+	if err := r.Publish("3b", record); err != nil {
+		t.Error(err)
+	}
+	if len(js.published) != 1 || len(kafka.published) != 1 {
+		t.Errorf("expected the retry in kafka only, got js %v kafka %v", js.published, kafka.published)
+	}
+
+	_ = r.Publish("03", []byte(`{"id":"32010600213533"}`))
+	// real time data of operator 7 is only routed once its login told us the operator
+	_ = r.Publish("13", []byte(`{"id":"32010600213533"}`))
+	_ = r.Publish("01", []byte(`{"Id":"32010600213533","operator":7}`))
+	_ = r.Publish("13", []byte(`{"id":"32010600213533"}`))
+	_ = r.Publish("13", []byte(`{"id":"99990600213533"}`))
+
+	if len(mqtt.published) != 1 {
+		t.Errorf("expected heartbeat in mqtt, got %v", mqtt.published)
+	}
+	if len(webhook.published) != 2 || webhook.published[0] != "01" || webhook.published[1] != "13" {
+		t.Errorf("unexpected webhook messages %v", webhook.published)
+	}
+	if len(rest.published) != 2 {
+		t.Errorf("expected unmatched messages in the default sink, got %v", rest.published)
+	}
+
+	if _, err := newRoutingForwarder(&RoutingConfig{Default: []string{"nope"}}, nil); err == nil {
+		t.Error("expected unknown sink to be refused")
+	}
+}
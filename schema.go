@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SCHEMA_VERSION is bumped when a message changes incompatibly. Fields may be
+// added to a message without bumping it, with a protobuf field number not
+// used before in its proto tag.
+const (
+	SCHEMA_VERSION = "v1"
+	PROTO_PACKAGE  = "ykc." + SCHEMA_VERSION
+	SCHEMA_BASE_ID = "https://github.com/LLLLimbo/ykc-proxy-server/schema/" + SCHEMA_VERSION
+)
+
+// MessageSchema ties a frame type to the message forwarded for it (uplink)
+// or accepted as command for it (downlink). Rpc names the method of the
+// gRPC service sending a downlink command, Event the field number of an
+// uplink message in the Event of the gRPC service; frame types sharing a
+// message share the number.
+//
+// Fields are described by struct tags: json gives the name, proto the
+// protobuf field number, schema holds a comma separated list of constraints:
+//
+//	required  the field must be present
+//	hex=N     the field is a hex string of N digits
+//	min=N     the number must be at least N
+//	max=N     the number must be at most N
+type MessageSchema struct {
+	FrameType string
+	Downlink  bool
+	Type      reflect.Type
+	Rpc       string
+	Event     int
+}
+
+var messageSchemas = []MessageSchema{
+	{"01", false, reflect.TypeOf(VerificationMessage{}), "", 4},
+	{"05", false, reflect.TypeOf(BillingModelVerificationMessage{}), "", 5},
+	{"09", false, reflect.TypeOf(BillingModelRequestMessage{}), "", 6},
+	{"13", false, reflect.TypeOf(OfflineDataReportMessage{}), "", 7},
+	{"19", false, reflect.TypeOf(ChargingFinishedMessage{}), "", 8},
+	{"33", false, reflect.TypeOf(RemoteBootstrapResponseMessage{}), "", 9},
+	{"35", false, reflect.TypeOf(RemoteShutdownResponseMessage{}), "", 10},
+	{"3b", false, reflect.TypeOf(TransactionRecordMessage{}), "", 11},
+	{"57", false, reflect.TypeOf(SetBillingModelResponseMessage{}), "", 12},
+	{"81", false, reflect.TypeOf(DeviceLoginMessage{}), "", 13},
+	{"91", false, reflect.TypeOf(RemoteRebootResponseMessage{}), "", 14},
+	{"security", false, reflect.TypeOf(SecurityEvent{}), "", 15},
+	{"51", false, reflect.TypeOf(SetWorkingParamsResponseMessage{}), "", 16},
+	{"55", false, reflect.TypeOf(NtpResponseMessage{}), "", 17},
+	{"03", false, reflect.TypeOf(PileHeartbeatMessage{}), "", 18},
+	{"82", false, reflect.TypeOf(HeartbeatMessage{}), "", 19},
+	{"85", false, reflect.TypeOf(SubmitFinalStatusMessage{}), "", 21},
+	{"02", true, reflect.TypeOf(VerificationResponseMessage{}), "RespondVerification", 0},
+	{"06", true, reflect.TypeOf(BillingModelVerificationResponseMessage{}), "RespondBillingModelVerification", 0},
+	{"0a", true, reflect.TypeOf(BillingModelResponseMessage{}), "SendBillingModel", 0},
+	{"34", true, reflect.TypeOf(RemoteBootstrapRequestMessage{}), "RemoteStart", 0},
+	{"36", true, reflect.TypeOf(RemoteShutdownRequestMessage{}), "RemoteStop", 0},
+	{"40", true, reflect.TypeOf(TransactionRecordConfirmedMessage{}), "ConfirmTransactionRecord", 0},
+	{"58", true, reflect.TypeOf(SetBillingModelRequestMessage{}), "SetBillingModel", 0},
+	{"92", true, reflect.TypeOf(RemoteRebootRequestMessage{}), "RemoteReboot", 0},
+	{"52", true, reflect.TypeOf(SetWorkingParamsRequestMessage{}), "SetWorkingParams", 0},
+	{"56", true, reflect.TypeOf(NtpRequestMessage{}), "SyncClock", 0},
+	{"81", true, reflect.TypeOf(DeviceLoginResponseMessage{}), "RespondDeviceLogin", 0},
+	{"83", true, reflect.TypeOf(RemoteStartRequestMessage{}), "StartPort", 0},
+	{"84", true, reflect.TypeOf(RemoteStopRequestMessage{}), "StopPort", 0},
+	//the replies of Huaping piles to the commands above
+	{"83", false, reflect.TypeOf(PortCommandReplyMessage{}), "", 20},
+	{"84", false, reflect.TypeOf(PortCommandReplyMessage{}), "", 20},
+}
+
+// LookupMessageSchema returns the schema of the message forwarded for a frame
+// type, or of the command if the pile never sends that frame type. Huaping
+// piles use the same command both ways, see LookupCommandSchema.
+func LookupMessageSchema(frameType string) (*MessageSchema, bool) {
+	frameType = strings.ToLower(frameType)
+	var found *MessageSchema
+	for i := range messageSchemas {
+		if messageSchemas[i].FrameType != frameType {
+			continue
+		}
+		if !messageSchemas[i].Downlink {
+			return &messageSchemas[i], true
+		}
+		found = &messageSchemas[i]
+	}
+	return found, found != nil
+}
+
+// LookupCommandSchema returns the schema of the command of a frame type.
+func LookupCommandSchema(frameType string) (*MessageSchema, bool) {
+	frameType = strings.ToLower(frameType)
+	for i := range messageSchemas {
+		if messageSchemas[i].Downlink && messageSchemas[i].FrameType == frameType {
+			return &messageSchemas[i], true
+		}
+	}
+	return nil, false
+}
+
+// Key names the schema in JSONSchemas: the frame type, followed by the
+// direction for the second message of a frame type used both ways, e.g.
+// 81-downlink for the answer to the login of a Huaping pile.
+func (s *MessageSchema) Key() string {
+	for _, ms := range messageSchemas {
+		if ms.FrameType != s.FrameType {
+			continue
+		}
+		if ms.Downlink != s.Downlink {
+			return s.FrameType + "-" + s.direction()
+		}
+		break
+	}
+	return s.FrameType
+}
+
+func (s *MessageSchema) direction() string {
+	if s.Downlink {
+		return "downlink"
+	}
+	return "uplink"
+}
+
+// lookupSchemaKey returns the schema named key by Key.
+func lookupSchemaKey(key string) (*MessageSchema, bool) {
+	key = strings.ToLower(key)
+	for i := range messageSchemas {
+		if messageSchemas[i].Key() == key {
+			return &messageSchemas[i], true
+		}
+	}
+	return nil, false
+}
+
+// schemaField is a struct field as it appears on the wire.
+type schemaField struct {
+	Name     string
+	Proto    int
+	Type     reflect.Type
+	Required bool
+	Hex      int
+	Min      *int64
+	Max      *int64
+}
+
+func schemaFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if !sf.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := schemaField{Name: name, Type: sf.Type}
+		f.Proto, _ = strconv.Atoi(sf.Tag.Get("proto"))
+		for _, c := range strings.Split(sf.Tag.Get("schema"), ",") {
+			k, v, _ := strings.Cut(c, "=")
+			switch k {
+			case "required":
+				f.Required = true
+			case "hex":
+				f.Hex, _ = strconv.Atoi(v)
+			case "min":
+				n, _ := strconv.ParseInt(v, 10, 64)
+				f.Min = &n
+			case "max":
+				n, _ := strconv.ParseInt(v, 10, 64)
+				f.Max = &n
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// JSONSchema returns the JSON Schema (draft 2020-12) of a message.
+func (s *MessageSchema) JSONSchema() map[string]interface{} {
+	js := objectSchema(s.Type)
+	js["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	js["$id"] = SCHEMA_BASE_ID + "/" + s.Key() + ".json"
+	js["description"] = fmt.Sprintf("%s message, frame type %s", s.direction(), s.FrameType)
+	return js
+}
+
+// JSONSchemas returns the schemas of all messages keyed by frame type.
+func JSONSchemas() map[string]interface{} {
+	all := make(map[string]interface{}, len(messageSchemas))
+	for i := range messageSchemas {
+		all[messageSchemas[i].Key()] = messageSchemas[i].JSONSchema()
+	}
+	return map[string]interface{}{
+		"version":  SCHEMA_VERSION,
+		"messages": all,
+	}
+}
+
+func objectSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for _, f := range schemaFields(t) {
+		props[f.Name] = fieldSchema(f)
+		if f.Required {
+			required = append(required, f.Name)
+		}
+	}
+	js := map[string]interface{}{
+		"title":      t.Name(),
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		js["required"] = required
+	}
+	return js
+}
+
+func fieldSchema(f schemaField) map[string]interface{} {
+	js := typeSchema(f.Type)
+	if f.Hex > 0 {
+		js["pattern"] = fmt.Sprintf("^[0-9a-fA-F]{%d}$", f.Hex)
+	}
+	if f.Min != nil {
+		js["minimum"] = *f.Min
+	}
+	if f.Max != nil {
+		js["maximum"] = *f.Max
+	}
+	return js
+}
+
+// types of the http api that are not messages
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		js := typeSchema(t.Elem())
+		if typ, ok := js["type"]; ok {
+			js["type"] = []interface{}{typ, "null"}
+		}
+		return js
+	case reflect.Struct:
+		return objectSchema(t)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		js := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			js["maximum"] = uint64(1)<<t.Bits() - 1
+		}
+		return js
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]interface{}{
+			"type":    "integer",
+			"minimum": -(int64(1) << (t.Bits() - 1)),
+			"maximum": int64(1)<<(t.Bits()-1) - 1,
+		}
+	default:
+		return map[string]interface{}{"type": "integer"}
+	}
+}
+
+// Validate checks a json encoded message against the schema and returns what
+// is wrong with it. Property names are matched case insensitively, the same
+// way encoding/json decodes them, and unknown properties are ignored.
+func (s *MessageSchema) Validate(message []byte) []string {
+	d := json.NewDecoder(bytes.NewReader(message))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return []string{"invalid json: " + err.Error()}
+	}
+	var errs []string
+	validateValue(objectSchema(s.Type), v, "", &errs)
+	return errs
+}
+
+// hexPatterns are compiled up front, since validateValue runs concurrently
+var hexPatterns = make(map[string]*regexp.Regexp)
+
+func init() {
+	for i := range messageSchemas {
+		for _, f := range schemaFields(messageSchemas[i].Type) {
+			if f.Hex > 0 {
+				p := fmt.Sprintf("^[0-9a-fA-F]{%d}$", f.Hex)
+				hexPatterns[p] = regexp.MustCompile(p)
+			}
+		}
+	}
+}
+
+func validateValue(js map[string]interface{}, v interface{}, path string, errs *[]string) {
+	where := path
+	if where == "" {
+		where = "message"
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, where+": "+fmt.Sprintf(format, args...))
+	}
+	if !typeMatches(js["type"], v) {
+		fail("must be of type %s", typeName(js["type"]))
+		return
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := js["properties"].(map[string]interface{})
+		required, _ := js["required"].([]string)
+		for _, name := range required {
+			if value, ok := lookupProperty(v, name); !ok || value == nil {
+				*errs = append(*errs, joinPath(path, name)+": is required")
+			}
+		}
+		names := make([]string, 0, len(props))
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := lookupProperty(v, name); ok {
+				validateValue(props[name].(map[string]interface{}), value, joinPath(path, name), errs)
+			}
+		}
+	case []interface{}:
+		items, _ := js["items"].(map[string]interface{})
+		for i, item := range v {
+			validateValue(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case string:
+		if p, ok := js["pattern"].(string); ok {
+			re, ok := hexPatterns[p]
+			if !ok {
+				re = regexp.MustCompile(p)
+			}
+			if !re.MatchString(v) {
+				fail("must match %s", p)
+			}
+		}
+		if enum, ok := js["enum"].([]string); ok && !containsString(enum, v) {
+			fail("must be one of %s", strings.Join(enum, ", "))
+		}
+	case json.Number:
+		n, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			fail("invalid number")
+			return
+		}
+		if min, ok := js["minimum"]; ok && n < toFloat(min) {
+			fail("must be at least %v", min)
+		}
+		if max, ok := js["maximum"]; ok && n > toFloat(max) {
+			fail("must be at most %v", max)
+		}
+	}
+}
+
+func containsString(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupProperty(obj map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func typeMatches(t interface{}, v interface{}) bool {
+	if types, ok := t.([]interface{}); ok {
+		for _, t := range types {
+			if typeMatches(t, v) {
+				return true
+			}
+		}
+		return false
+	}
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		return ok && !strings.ContainsAny(n.String(), ".eE")
+	case "null":
+		return v == nil
+	}
+	return true
+}
+
+func typeName(t interface{}) string {
+	if types, ok := t.([]interface{}); ok {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = typeName(t)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// protoName turns a json name like gunId into the protobuf field name gun_id.
+func protoName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
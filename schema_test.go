@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(t *testing.T) {
+	s, _ := LookupMessageSchema("34")
+	if errs := s.Validate([]byte(`{"Id":"32010600213533","gunId":"01","tradeSeq":"32010600213533012301010000000001","balance":1000}`)); len(errs) > 0 {
+		t.Fatalf("valid command refused: %v", errs)
+	}
+	errs := s.Validate([]byte(`{"gunId":"1","tradeSeq":"32010600213533012301010000000001","balance":-1}`))
+	want := []string{"id: is required", "balance: must be at least 0", "gunId: must match ^[0-9a-fA-F]{2}$"}
+	if strings.Join(errs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected errors %q", errs)
+	}
+	if errs := s.Validate([]byte(`{"id":32010600213533}`)); len(errs) == 0 || !strings.Contains(errs[len(errs)-1], "id: must be of type string") {
+		t.Fatalf("wrong type not found: %v", errs)
+	}
+}
+
+func TestValidateCommandRouter(t *testing.T) {
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/proxy/36", strings.NewReader(`{"gunId":"01"}`)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "id: is required") {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	in := `{"header":{"seq":3},"id":"32010600213533","gunId":"01","tradeSeq":"32010600213533012301010000000001","balance":1000}`
+	b, ct, err := EncodeMessage(EncodingProtobuf, "34", []byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct != "application/protobuf; proto=ykc.v1.RemoteBootstrapRequestMessage" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	out, err := DecodeMessage("34", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want RemoteBootstrapRequestMessage
+	_ = json.Unmarshal([]byte(in), &want)
+	_ = json.Unmarshal(out, &got)
+	if *got.Header != *want.Header || got.Id != want.Id || got.TradeSeq != want.TradeSeq || got.Balance != want.Balance {
+		t.Fatalf("round trip changed message: %s", out)
+	}
+}
+
+func TestProtobufCloudEvent(t *testing.T) {
+	msg := []byte(`{"specversion":"1.0","id":"1","type":"charge.proxy.ykc.91","data":{"id":"32010600213533","result":1}}`)
+	b, ct, err := EncodeMessage(EncodingProtobuf, "91", msg)
+	if err != nil || ct != "" {
+		t.Fatalf("unexpected result %q, %v", ct, err)
+	}
+	var e map[string]interface{}
+	_ = json.Unmarshal(b, &e)
+	if e["data"] != nil || e["data_base64"] == "" || e["datacontenttype"] != ProtoContentType("91") {
+		t.Fatalf("unexpected envelope %s", b)
+	}
+}
+
+// Every frame type the routers forward or publish as uplink needs a schema,
+// or protobuf encoding fails for it.
+func TestForwardedMessagesEncode(t *testing.T) {
+	publish := regexp.MustCompile(`(?:Publish|PublishUplink\(conn,) ?\(?"([0-9a-z]+)"`)
+	files, _ := filepath.Glob("*.go")
+	mids := make(map[string]bool)
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		src, _ := os.ReadFile(name)
+		for _, m := range publish.FindAllStringSubmatch(string(src), -1) {
+			mids[m[1]] = true
+		}
+	}
+	if !mids["3b"] || !mids["03"] || !mids["85"] {
+		t.Fatalf("forwarded frame types not found: %v", mids)
+	}
+	for mid := range mids {
+		ms, ok := LookupMessageSchema(mid)
+		if !ok || ms.Downlink {
+			t.Errorf("%s: no uplink schema", mid)
+			continue
+		}
+		msg, _ := json.Marshal(reflect.New(ms.Type).Interface())
+		event := []byte(`{"specversion":"1.0","id":"1","type":"charge.proxy.ykc.` + mid + `","data":` + string(msg) + `}`)
+		for _, encoding := range []string{EncodingJSON, EncodingProtobuf} {
+			for _, m := range [][]byte{msg, event} {
+				if _, _, err := EncodeMessage(encoding, mid, m); err != nil {
+					t.Errorf("%s: %s encoding failed: %v", mid, encoding, err)
+				}
+			}
+		}
+	}
+}
+
+// The versioned definitions in schema/ are checked in for consumers; run
+// with UPDATE_SCHEMAS=1 to regenerate them after changing a message.
+func TestSchemaFilesUpToDate(t *testing.T) {
+	def, err := ProtoDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := json.MarshalIndent(JSONSchemas(), "", "  ")
+	files := map[string][]byte{
+		filepath.Join("schema", SCHEMA_VERSION, "ykc.proto"):       []byte(def),
+		filepath.Join("schema", SCHEMA_VERSION, "ykc.schema.json"): append(js, '\n'),
+	}
+	for name, want := range files {
+		if os.Getenv("UPDATE_SCHEMAS") != "" {
+			_ = os.MkdirAll(filepath.Dir(name), 0755)
+			if err := os.WriteFile(name, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(name)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("%s is out of date, run UPDATE_SCHEMAS=1 go test -run TestSchemaFilesUpToDate", name)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -21,6 +29,7 @@ type Options struct {
 	Host                         string
 	TcpPort                      int
 	HttpPort                     int
+	GrpcPort                     int
 	AutoVerification             bool
 	AutoHeartbeatResponse        bool
 	AutoBillingModelVerify       bool
@@ -31,6 +40,61 @@ type Options struct {
 	Password                     string
 	MessageForwarder             MessageForwarder
 	PublishSubjectPrefix         string
+	CommandQueue                 bool
+	CommandQueueFile             string
+	CommandTTL                   time.Duration
+	CommandReplyTimeout          time.Duration
+	CommandMaxAttempts           int
+	ShutdownTimeout              time.Duration
+	MaxConnections               int
+	MaxConnectionsPerIP          int
+	MaxFrameRate                 float64
+	FrameBurst                   int
+	MaxFrameSize                 int
+	TlsPort                      int
+	TlsOnly                      bool
+	TlsCert                      string
+	TlsKey                       string
+	TlsClientCA                  string
+	TlsRequireClientCert         bool
+	DeviceRegistry               string
+	UnknownDevicePolicy          string
+	KafkaTopic                   string
+	KafkaAcks                    string
+	KafkaCompression             string
+	KafkaGroupId                 string
+	RabbitExchange               string
+	RabbitCommandQueue           string
+	MqttClientId                 string
+	MqttQos                      int
+	MqttVersion                  int
+	RedisMaxLen                  int64
+	RedisGroup                   string
+	RedisConsumer                string
+	NatsJetStream                bool
+	NatsStream                   string
+	Outbox                       bool
+	OutboxDir                    string
+	OutboxMaxEntries             int
+	OutboxMaxBytes               int64
+	OutboxMaxAttempts            int
+	HttpHeaders                  map[string]string
+	HttpSecret                   string
+	HttpTimeout                  time.Duration
+	HttpRetries                  int
+	Routes                       string
+	CloudEvents                  string
+	CloudEventsSource            string
+	Encoding                     string
+	ApiKeys                      string
+	Jwks                         string
+	JwtIssuer                    string
+	JwtAudience                  string
+	AuditLog                     string
+	FrameHistoryDir              string
+	FrameHistoryRetention        time.Duration
+	FrameHistoryRetentionTypes   string
+	StoreFile                    string
 }
 
 type Server struct {
@@ -44,48 +108,228 @@ type Server struct {
 	GrWG      sync.WaitGroup
 	Done      chan bool
 	Shutdown  bool
+
+	Stats ConnectionStats
+
+	listeners     []net.Listener
+	listenerNames []string
+	conns         map[net.Conn]string
+	listenerConns map[string]int
+	ipConns       map[string]int
+	httpServer    *http.Server
+	grpcServer    *grpc.Server
 }
 
-func (s *Server) handleClient(conn net.Conn) {
-	defer conn.Close()
+// ConnectionStats counts connections and the offenders of the connection
+// limits.
+type ConnectionStats struct {
+	AcceptedConnections      int64
+	RejectedConnections      int64
+	RejectedConnectionsPerIP int64
+	RateLimitedConnections   int64
+	OversizedFrames          int64
+}
 
-	buffer := make([]byte, 1024)
-	for {
-		n, err := conn.Read(buffer)
-		if err != nil {
-			log.Errorf("Failed to read from client: %v", err)
-			return
+var (
+	ErrFrameTooLarge     = errors.New("frame too large")
+	ErrFrameRateExceeded = errors.New("frame rate exceeded")
+)
+
+func (s *Server) handleClient(conn net.Conn, listener string) {
+	ip := remoteIP(conn)
+	if reason := s.admit(conn, listener, ip); reason != "" {
+		log.WithFields(log.Fields{
+			"address":  conn.RemoteAddr().String(),
+			"listener": listener,
+			"reason":   reason,
+		}).Warn("client rejected")
+		_ = conn.Close()
+		return
+	}
+	defer func() {
+		s.Mu.Lock()
+		delete(s.conns, conn)
+		s.listenerConns[listener]--
+		if s.listenerConns[listener] <= 0 {
+			delete(s.listenerConns, listener)
+		}
+		key := listener + " " + ip
+		s.ipConns[key]--
+		if s.ipConns[key] <= 0 {
+			delete(s.ipConns, key)
+		}
+		s.Mu.Unlock()
+		sessions.Close(conn)
+		for _, id := range RemoveClient(conn) {
+			if id != conn.RemoteAddr().String() {
+				PublishDeviceStatus(s.Opt, id, false)
+			}
 		}
+		_ = conn.Close()
+	}()
 
-		if n > 0 {
-			data := buffer[:n]
-			log.Infof("Received data: %x", data)
+	if err := tlsHandshake(conn); err != nil {
+		log.WithFields(log.Fields{
+			"address": conn.RemoteAddr().String(),
+		}).Warnf("tls handshake failed: %v", err)
+		return
+	}
 
-			// Parse the command field
-			if len(data) < 5 {
-				log.Warn("Invalid data length")
-				continue
-			}
+	StoreClient(conn.RemoteAddr().String(), conn)
+	sessions.Open(conn)
+	identity := ConnIdentity(conn)
+	if identity != "" {
+		StoreClient(identity, conn)
+		sessions.Update(conn, func(s *DeviceSession) { s.Id = identity })
+	}
+	log.WithFields(log.Fields{
+		"address":  conn.RemoteAddr().String(),
+		"identity": identity,
+	}).Info("new client connected")
 
-			// Extract command byte (assuming it's the 4th byte in the message)
-			cmd := data[4]
-
-			// Route to the appropriate handler
-			header := &Header{Seq: 0, Encrypted: false} // Add actual header parsing if needed
-			//hexData := BytesToHex(data)
-			switch cmd {
-			case 0x81:
-				DeviceLoginRouter(s.Opt, data, header, conn)
-			default:
-				log.Warnf("Unsupported command: %x", cmd)
-			}
+	check := s.frameCheck(conn)
+	var connErr error
+	for connErr == nil && s.isRunning() {
+		connErr = drain(s.Opt, conn, check)
+	}
+}
+
+// admit registers a new connection of a listener unless it exceeds the
+// connection limits of that listener, in which case the reason is returned.
+// The plain and the tls listener are counted apart, so piles moving to tls
+// are not locked out by the ones still connecting in plain text.
+func (s *Server) admit(conn net.Conn, listener string, ip string) string {
+	o := s.Opt
+	key := listener + " " + ip
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if o.MaxConnections > 0 && s.listenerConns[listener] >= o.MaxConnections {
+		atomic.AddInt64(&s.Stats.RejectedConnections, 1)
+		return "too many connections"
+	}
+	if o.MaxConnectionsPerIP > 0 && s.ipConns[key] >= o.MaxConnectionsPerIP {
+		atomic.AddInt64(&s.Stats.RejectedConnectionsPerIP, 1)
+		return "too many connections from " + ip
+	}
+	s.conns[conn] = listener
+	s.listenerConns[listener]++
+	s.ipConns[key]++
+	atomic.AddInt64(&s.Stats.AcceptedConnections, 1)
+	return ""
+}
+
+// frameCheck returns the check drain applies to the data of a connection:
+// frames larger than MaxFrameSize or arriving faster than MaxFrameRate get
+// the connection dropped. A read may hold several frames, each of them is
+// counted against the rate.
+func (s *Server) frameCheck(conn net.Conn) func(data []byte) error {
+	o := s.Opt
+	var limiter *rate.Limiter
+	if o.MaxFrameRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(o.MaxFrameRate), o.FrameBurst)
+	}
+	return func(data []byte) error {
+		if size := frameSize(data); o.MaxFrameSize > 0 && size > o.MaxFrameSize {
+			atomic.AddInt64(&s.Stats.OversizedFrames, 1)
+			log.WithFields(log.Fields{
+				"address": conn.RemoteAddr().String(),
+				"size":    size,
+			}).Warn("frame too large, disconnecting client")
+			return ErrFrameTooLarge
+		}
+		if limiter != nil && !limiter.AllowN(time.Now(), frameCount(data)) {
+			atomic.AddInt64(&s.Stats.RateLimitedConnections, 1)
+			log.WithFields(log.Fields{
+				"address": conn.RemoteAddr().String(),
+			}).Warn("frame rate exceeded, disconnecting client")
+			return ErrFrameRateExceeded
 		}
+		return nil
 	}
 }
 
+// StatsRouter reports the current connection count and the connection
+// limit counters.
+func (s *Server) StatsRouter(c *gin.Context) {
+	s.Mu.RLock()
+	connections := len(s.conns)
+	ips := len(s.ipConns)
+	listeners := make(map[string]int, len(s.listenerConns))
+	for name, n := range s.listenerConns {
+		listeners[name] = n
+	}
+	s.Mu.RUnlock()
+	c.JSON(200, gin.H{
+		"connections":              connections,
+		"listenerConnections":      listeners,
+		"remoteAddresses":          ips,
+		"acceptedConnections":      atomic.LoadInt64(&s.Stats.AcceptedConnections),
+		"rejectedConnections":      atomic.LoadInt64(&s.Stats.RejectedConnections),
+		"rejectedConnectionsPerIp": atomic.LoadInt64(&s.Stats.RejectedConnectionsPerIP),
+		"rateLimitedConnections":   atomic.LoadInt64(&s.Stats.RateLimitedConnections),
+		"oversizedFrames":          atomic.LoadInt64(&s.Stats.OversizedFrames),
+	})
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// frameSize returns the total size of the frame at the start of data as
+// declared by its length field, or the size of data if the frame format is
+// unknown.
+func frameSize(data []byte) int {
+	switch {
+	case len(data) >= 2 && data[0] == StartFlag:
+		// start flag, length, then seq, encryption, frame type, body and crc
+		return int(data[1]) + 4
+	case len(data) >= 4 && data[0] == 0x5a && data[1] == 0xa5:
+		return (int(data[3])<<8 | int(data[2])) + 4
+	}
+	return len(data)
+}
+
+// frameCount returns the number of frames in data, following the declared
+// lengths from one frame to the next. Data after a frame that does not start
+// another 68 frame is counted with that frame: the length of the Huaping
+// frames leaves out the IMEI, so their boundaries cannot be told this way.
+func frameCount(data []byte) int {
+	count := 0
+	for len(data) > 0 {
+		count++
+		if data[0] != StartFlag {
+			break
+		}
+		size := frameSize(data)
+		if size >= len(data) || data[size] != StartFlag {
+			break
+		}
+		data = data[size:]
+	}
+	return count
+}
+
+// frameBufferSize is the size of the read buffer, large enough for the
+// biggest frame we accept.
+func frameBufferSize(opt *Options) int {
+	if opt.MaxFrameSize > 1024 {
+		return opt.MaxFrameSize
+	}
+	return 1024
+}
+
 func NewServer(opts *Options) (*Server, error) {
 	s := &Server{
-		Opt: opts,
+		Opt:           opts,
+		QuitCh:        make(chan struct{}),
+		Done:          make(chan bool, 2),
+		conns:         make(map[net.Conn]string),
+		listenerConns: make(map[string]int),
+		ipConns:       make(map[string]int),
 	}
 	return s, nil
 }
@@ -93,35 +337,181 @@ func NewServer(opts *Options) (*Server, error) {
 func (s *Server) Start() {
 	o := s.Opt
 
-	var hl net.Listener
-	var err error
-
-	port := o.TcpPort
-	if port == -1 {
-		port = 0
-	}
-	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
 	s.Mu.Lock()
 	if s.Shutdown {
 		s.Mu.Unlock()
 		return
 	}
-	hl, err = net.Listen("tcp", hp)
-	if err != nil {
-		s.Mu.Unlock()
-		log.Fatalf("Unable to listen for tcp connections: %v", err)
-		return
+
+	if !o.TlsOnly {
+		port := o.TcpPort
+		if port == -1 {
+			port = 0
+		}
+		hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+		hl, err := net.Listen("tcp", hp)
+		if err != nil {
+			s.Mu.Unlock()
+			log.Fatalf("Unable to listen for tcp connections: %v", err)
+			return
+		}
+		if port == 0 {
+			o.TcpPort = hl.Addr().(*net.TCPAddr).Port
+		}
+		log.Infof("Server listening on %s", hp)
+		s.listeners = append(s.listeners, hl)
+		s.listenerNames = append(s.listenerNames, "YKC")
 	}
-	if port == 0 {
-		o.TcpPort = hl.Addr().(*net.TCPAddr).Port
+
+	if o.TlsPort != 0 {
+		port := o.TlsPort
+		if port == -1 {
+			port = 0
+		}
+		cfg, err := newTlsConfig(o)
+		if err != nil {
+			s.Mu.Unlock()
+			log.Fatalf("Unable to load tls certificates: %v", err)
+			return
+		}
+		hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+		tl, err := tls.Listen("tcp", hp, cfg)
+		if err != nil {
+			s.Mu.Unlock()
+			log.Fatalf("Unable to listen for tls connections: %v", err)
+			return
+		}
+		if port == 0 {
+			o.TlsPort = tl.Addr().(*net.TCPAddr).Port
+		}
+		log.Infof("Server listening for tls on %s", hp)
+		s.listeners = append(s.listeners, tl)
+		s.listenerNames = append(s.listenerNames, "YKC-TLS")
 	}
-	log.Infof("Server listening on %s", hp)
+
+	s.Running = true
+	s.GrMu.Lock()
+	s.GrRunning = true
+	s.GrMu.Unlock()
 
 	// Accept connections
-	go s.acceptConnections(hl, "YKC", func(conn net.Conn) {
-		s.handleClient(conn) // Handle each client connection
-	}, nil)
+	for i, l := range s.listeners {
+		name := s.listenerNames[i]
+		go s.acceptConnections(l, name, func(conn net.Conn) {
+			s.handleClient(conn, name) // Handle each client connection
+		}, nil)
+	}
+	s.Mu.Unlock()
+}
+
+// StartHttp serves the REST API on the configured http port.
+func (s *Server) StartHttp() {
+	o := s.Opt
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(o.Host, strconv.Itoa(o.HttpPort)),
+		Handler: s.newHttpRouter(),
+	}
+	s.Mu.Lock()
+	s.httpServer = srv
+	s.Mu.Unlock()
+	log.Infof("Http server listening on %s", srv.Addr)
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Unable to listen for http connections: %v", err)
+		}
+	}()
+}
+
+// Stop shuts the server down gracefully: it stops accepting piles, closes
+// the connected ones once their current frame is handled, waits for the
+// handlers, flushes the message forwarder and finally stops the grpc and
+// http servers.
+// Whatever is still running when ctx is done is abandoned.
+func (s *Server) Stop(ctx context.Context) error {
+	s.Mu.Lock()
+	if s.Shutdown {
+		s.Mu.Unlock()
+		return nil
+	}
+	s.Shutdown = true
+	s.Running = false
+	close(s.QuitCh)
+	listeners := s.listeners
+	httpServer := s.httpServer
+	grpcServer := s.grpcServer
 	s.Mu.Unlock()
+
+	s.GrMu.Lock()
+	s.GrRunning = false
+	s.GrMu.Unlock()
+
+	//stop accepting
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	for range listeners {
+		select {
+		case <-s.Done:
+		case <-ctx.Done():
+		}
+	}
+
+	//interrupt pending reads, the handlers close their connections on the way out
+	s.Mu.RLock()
+	log.Infof("closing %d client connections", len(s.conns))
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.Mu.RUnlock()
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.GrWG.Wait()
+		close(handlersDone)
+	}()
+	var err error
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Warn("timed out waiting for client handlers, closing connections")
+		s.Mu.RLock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.Mu.RUnlock()
+	}
+
+	if commandQueue != nil {
+		_ = commandQueue.Close()
+	}
+	if s.Opt.MessageForwarder != nil {
+		if cerr := s.Opt.MessageForwarder.Close(); cerr != nil {
+			log.Errorf("error closing message forwarder: %v", cerr)
+		}
+	}
+	if grpcServer != nil {
+		stopGrpc(ctx, grpcServer)
+	}
+	if httpServer != nil {
+		if herr := httpServer.Shutdown(ctx); herr != nil {
+			log.Errorf("error shutting down http server: %v", herr)
+			if err == nil {
+				err = herr
+			}
+		}
+	}
+
+	//the apis read these, so they go last
+	if frameHistory != nil {
+		_ = frameHistory.Close()
+	}
+	if store != nil {
+		_ = store.Close()
+	}
+	log.Info("server stopped")
+	return err
 }
 
 // Protected check on running state
@@ -211,15 +601,80 @@ func parseOptions() *Options {
 	servers := flag.String("servers", "", "servers")
 	username := flag.String("username", "", "username")
 	password := flag.String("password", "", "password")
+	commandQueue := flag.Bool("commandQueue", false, "commandQueue")
+	commandQueueFile := flag.String("commandQueueFile", "commands.json", "commandQueueFile")
+	commandTTL := flag.Duration("commandTTL", 10*time.Minute, "commandTTL")
+	commandReplyTimeout := flag.Duration("commandReplyTimeout", 30*time.Second, "commandReplyTimeout")
+	commandMaxAttempts := flag.Int("commandMaxAttempts", 3, "commandMaxAttempts")
+	shutdownTimeout := flag.Duration("shutdownTimeout", 30*time.Second, "shutdownTimeout")
+	maxConnections := flag.Int("maxConnections", 0, "maxConnections")
+	maxConnectionsPerIP := flag.Int("maxConnectionsPerIP", 0, "maxConnectionsPerIP")
+	maxFrameRate := flag.Float64("maxFrameRate", 0, "maxFrameRate")
+	frameBurst := flag.Int("frameBurst", 20, "frameBurst")
+	maxFrameSize := flag.Int("maxFrameSize", 1024, "maxFrameSize")
+	grpcPort := flag.Int("grpcPort", 0, "grpcPort")
+	tlsPort := flag.Int("tlsPort", 0, "tlsPort")
+	tlsOnly := flag.Bool("tlsOnly", false, "tlsOnly")
+	tlsCert := flag.String("tlsCert", "", "tlsCert")
+	tlsKey := flag.String("tlsKey", "", "tlsKey")
+	tlsClientCA := flag.String("tlsClientCA", "", "tlsClientCA")
+	tlsRequireClientCert := flag.Bool("tlsRequireClientCert", false, "tlsRequireClientCert")
+	deviceRegistry := flag.String("deviceRegistry", "", "deviceRegistry")
+	unknownDevicePolicy := flag.String("unknownDevicePolicy", PolicyDefer, "unknownDevicePolicy")
+	kafkaTopic := flag.String("kafkaTopic", "", "kafkaTopic")
+	kafkaAcks := flag.String("kafkaAcks", "all", "kafkaAcks")
+	kafkaCompression := flag.String("kafkaCompression", "none", "kafkaCompression")
+	kafkaGroupId := flag.String("kafkaGroupId", "ykc-proxy-server", "kafkaGroupId")
+	rabbitExchange := flag.String("rabbitExchange", "ykc", "rabbitExchange")
+	rabbitCommandQueue := flag.String("rabbitCommandQueue", "ykc.commands", "rabbitCommandQueue")
+	mqttClientId := flag.String("mqttClientId", "ykc-proxy-server", "mqttClientId")
+	mqttQos := flag.Int("mqttQos", 1, "mqttQos")
+	mqttVersion := flag.Int("mqttVersion", 3, "mqttVersion")
+	redisMaxLen := flag.Int64("redisMaxLen", 100000, "redisMaxLen")
+	redisGroup := flag.String("redisGroup", "ykc-proxy-server", "redisGroup")
+	redisConsumer := flag.String("redisConsumer", hostname(), "redisConsumer")
+	natsJetStream := flag.Bool("natsJetStream", false, "natsJetStream")
+	natsStream := flag.String("natsStream", "YKC", "natsStream")
+	outbox := flag.Bool("outbox", false, "outbox")
+	outboxDir := flag.String("outboxDir", "outbox", "outboxDir")
+	outboxMaxEntries := flag.Int("outboxMaxEntries", 100000, "outboxMaxEntries")
+	outboxMaxBytes := flag.Int64("outboxMaxBytes", 256<<20, "outboxMaxBytes")
+	outboxMaxAttempts := flag.Int("outboxMaxAttempts", 20, "outboxMaxAttempts")
+	httpHeaders := flag.String("httpHeaders", "", "httpHeaders")
+	httpSecret := flag.String("httpSecret", "", "httpSecret")
+	httpTimeout := flag.Duration("httpTimeout", 3*time.Second, "httpTimeout")
+	httpRetries := flag.Int("httpRetries", 3, "httpRetries")
+	routes := flag.String("routes", "", "routes")
+	cloudEvents := flag.String("cloudEvents", "", "cloudEvents")
+	cloudEventsSource := flag.String("cloudEventsSource", DefaultCloudEventsSource(), "cloudEventsSource")
+	encoding := flag.String("encoding", EncodingJSON, "encoding")
+	apiKeys := flag.String("apiKeys", "", "apiKeys")
+	jwks := flag.String("jwks", "", "jwks")
+	jwtIssuer := flag.String("jwtIssuer", "", "jwtIssuer")
+	jwtAudience := flag.String("jwtAudience", "", "jwtAudience")
+	auditLog := flag.String("auditLog", "", "auditLog")
+	frameHistoryDir := flag.String("frameHistoryDir", "", "frameHistoryDir")
+	frameHistoryRetention := flag.Duration("frameHistoryRetention", 30*24*time.Hour, "frameHistoryRetention")
+	frameHistoryRetentionTypes := flag.String("frameHistoryRetentionTypes", "", "frameHistoryRetentionTypes")
+	storeFile := flag.String("storeFile", "", "storeFile")
 	flag.Parse()
 
 	//splitting servers with comma
 	serversArr := strings.Split(*servers, ",")
 
+	//headers as "Name: value" pairs separated by comma
+	headers := make(map[string]string)
+	for _, h := range strings.Split(*httpHeaders, ",") {
+		if name, value, ok := strings.Cut(h, ":"); ok {
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
 	opt := &Options{
 		Host:                         *host,
 		TcpPort:                      *tcpPort,
 		HttpPort:                     *httpPort,
+		GrpcPort:                     *grpcPort,
 		AutoVerification:             *autoVerification,
 		AutoHeartbeatResponse:        *autoHeartbeatResponse,
 		AutoBillingModelVerify:       *autoBillingModelVerify,
@@ -228,6 +683,61 @@ func parseOptions() *Options {
 		Servers:                      serversArr,
 		Username:                     *username,
 		Password:                     *password,
+		CommandQueue:                 *commandQueue,
+		CommandQueueFile:             *commandQueueFile,
+		CommandTTL:                   *commandTTL,
+		CommandReplyTimeout:          *commandReplyTimeout,
+		CommandMaxAttempts:           *commandMaxAttempts,
+		ShutdownTimeout:              *shutdownTimeout,
+		MaxConnections:               *maxConnections,
+		MaxConnectionsPerIP:          *maxConnectionsPerIP,
+		MaxFrameRate:                 *maxFrameRate,
+		FrameBurst:                   *frameBurst,
+		MaxFrameSize:                 *maxFrameSize,
+		TlsPort:                      *tlsPort,
+		TlsOnly:                      *tlsOnly,
+		TlsCert:                      *tlsCert,
+		TlsKey:                       *tlsKey,
+		TlsClientCA:                  *tlsClientCA,
+		TlsRequireClientCert:         *tlsRequireClientCert,
+		DeviceRegistry:               *deviceRegistry,
+		UnknownDevicePolicy:          *unknownDevicePolicy,
+		KafkaTopic:                   *kafkaTopic,
+		KafkaAcks:                    *kafkaAcks,
+		KafkaCompression:             *kafkaCompression,
+		KafkaGroupId:                 *kafkaGroupId,
+		RabbitExchange:               *rabbitExchange,
+		RabbitCommandQueue:           *rabbitCommandQueue,
+		MqttClientId:                 *mqttClientId,
+		MqttQos:                      *mqttQos,
+		MqttVersion:                  *mqttVersion,
+		RedisMaxLen:                  *redisMaxLen,
+		RedisGroup:                   *redisGroup,
+		RedisConsumer:                *redisConsumer,
+		NatsJetStream:                *natsJetStream,
+		NatsStream:                   *natsStream,
+		Outbox:                       *outbox,
+		OutboxDir:                    *outboxDir,
+		OutboxMaxEntries:             *outboxMaxEntries,
+		OutboxMaxBytes:               *outboxMaxBytes,
+		OutboxMaxAttempts:            *outboxMaxAttempts,
+		HttpHeaders:                  headers,
+		HttpSecret:                   *httpSecret,
+		HttpTimeout:                  *httpTimeout,
+		HttpRetries:                  *httpRetries,
+		Routes:                       *routes,
+		CloudEvents:                  *cloudEvents,
+		CloudEventsSource:            *cloudEventsSource,
+		Encoding:                     *encoding,
+		ApiKeys:                      *apiKeys,
+		Jwks:                         *jwks,
+		JwtIssuer:                    *jwtIssuer,
+		JwtAudience:                  *jwtAudience,
+		AuditLog:                     *auditLog,
+		FrameHistoryDir:              *frameHistoryDir,
+		FrameHistoryRetention:        *frameHistoryRetention,
+		FrameHistoryRetentionTypes:   *frameHistoryRetentionTypes,
+		StoreFile:                    *storeFile,
 	}
 	return opt
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerAdmitLimits(t *testing.T) {
+	s, _ := NewServer(&Options{MaxConnections: 2, MaxConnectionsPerIP: 1})
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	c, _ := net.Pipe()
+	if reason := s.admit(a, "YKC", "10.0.0.1"); reason != "" {
+		t.Fatalf("expected first connection to be admitted, got %q", reason)
+	}
+	if reason := s.admit(b, "YKC", "10.0.0.1"); reason == "" {
+		t.Fatal("expected second connection from the same ip to be rejected")
+	}
+	if reason := s.admit(b, "YKC", "10.0.0.2"); reason != "" {
+		t.Fatalf("expected connection from another ip to be admitted, got %q", reason)
+	}
+	if reason := s.admit(c, "YKC", "10.0.0.3"); reason == "" {
+		t.Fatal("expected connection above the global limit to be rejected")
+	}
+	//the tls listener has limits of its own
+	if reason := s.admit(c, "YKC-TLS", "10.0.0.1"); reason != "" {
+		t.Fatalf("expected tls connection to be admitted, got %q", reason)
+	}
+	if s.Stats.RejectedConnections != 1 || s.Stats.RejectedConnectionsPerIP != 1 {
+		t.Fatalf("unexpected stats %+v", s.Stats)
+	}
+}
+
+func TestServerFrameCheck(t *testing.T) {
+	s, _ := NewServer(&Options{MaxFrameSize: 64, MaxFrameRate: 1, FrameBurst: 2})
+	conn, _ := net.Pipe()
+	check := s.frameCheck(conn)
+
+	// 68 declaring a 0x40 byte body is 0x44 bytes in total
+	if err := check([]byte{StartFlag, 0x40, 0x00, 0x00, 0x00, 0x01}); err != ErrFrameTooLarge {
+		t.Fatalf("expected oversized frame to be rejected, got %v", err)
+	}
+	heartbeat := []byte{0x5a, 0xa5, 0x04, 0x00, 0x82, 0x00, 0x86}
+	for i := 0; i < 2; i++ {
+		if err := check(heartbeat); err != nil {
+			t.Fatalf("expected frame %d to pass, got %v", i, err)
+		}
+	}
+	if err := check(heartbeat); err != ErrFrameRateExceeded {
+		t.Fatalf("expected burst to be exhausted, got %v", err)
+	}
+}
+
+func TestServerFrameCheckCountsFrames(t *testing.T) {
+	s, _ := NewServer(&Options{MaxFrameSize: 64, MaxFrameRate: 1, FrameBurst: 2})
+	conn, _ := net.Pipe()
+	check := s.frameCheck(conn)
+
+	heartbeat := []byte{StartFlag, 0x0d, 0x00, 0x00, 0x00, Heartbeat, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if n := frameCount(append(append([]byte{}, heartbeat...), heartbeat...)); n != 2 {
+		t.Fatalf("expected 2 frames, got %d", n)
+	}
+	if n := frameCount(append(append([]byte{}, heartbeat...), 0x00)); n != 1 {
+		t.Fatalf("expected trailing bytes to be counted with the frame, got %d", n)
+	}
+	if err := check(append(append([]byte{}, heartbeat...), heartbeat...)); err != nil {
+		t.Fatalf("expected two frames to fit the burst, got %v", err)
+	}
+	if err := check(heartbeat); err != ErrFrameRateExceeded {
+		t.Fatalf("expected burst to be exhausted by the frames of one read, got %v", err)
+	}
+}
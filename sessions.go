@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// piles speaking the YKC protocol, framed with 0x68
+	ProtocolYKC = "ykc"
+	// piles speaking the Huaping Power protocol, framed with 5A A5
+	ProtocolHuaping = "huaping"
+)
+
+// DeviceSession is what is known about a connected pile, gathered from its
+// login, heartbeats and real time data. DisconnectedAt is set on the
+// sessions of piles no longer connected, kept with -storeFile.
+type DeviceSession struct {
+	Id              string      `json:"id"`
+	Protocol        string      `json:"protocol"`
+	ProtocolVersion int         `json:"protocolVersion,omitempty"`
+	SoftwareVersion string      `json:"softwareVersion,omitempty"`
+	HardwareVersion string      `json:"hardwareVersion,omitempty"`
+	Sim             string      `json:"sim,omitempty"`
+	Guns            int         `json:"guns"`
+	Signal          int         `json:"signal"`
+	Temperature     int         `json:"temperature"`
+	LastHeartbeat   *time.Time  `json:"lastHeartbeat,omitempty"`
+	RemoteAddress   string      `json:"remoteAddress"`
+	ConnectedSince  time.Time   `json:"connectedSince"`
+	DisconnectedAt  *time.Time  `json:"disconnectedAt,omitempty"`
+	GunStates       []*GunState `json:"gunStates,omitempty"`
+}
+
+// GunState is the last known state of a gun (a port, for Huaping piles).
+// TradeSeq is the trade in progress, if any.
+type GunState struct {
+	Gun       string                    `json:"gun"`
+	Status    int                       `json:"status"`
+	Plugged   bool                      `json:"plugged"`
+	TradeSeq  string                    `json:"tradeSeq,omitempty"`
+	RealTime  *OfflineDataReportMessage `json:"realTime,omitempty"`
+	UpdatedAt time.Time                 `json:"updatedAt"`
+}
+
+// status of a gun in real time data (13)
+const GunStatusCharging = 3
+
+// SessionRegistry keeps a session per connection, next to the id registry
+// in clients.
+type SessionRegistry struct {
+	mu     sync.RWMutex
+	byConn map[net.Conn]*DeviceSession
+}
+
+var sessions = &SessionRegistry{byConn: make(map[net.Conn]*DeviceSession)}
+
+func (r *SessionRegistry) Open(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byConn[conn] = &DeviceSession{
+		RemoteAddress:  conn.RemoteAddr().String(),
+		ConnectedSince: time.Now(),
+	}
+}
+
+// Close ends the session of a connection, the store keeps it as the last
+// one of the pile.
+func (r *SessionRegistry) Close(conn net.Conn) {
+	r.mu.Lock()
+	s, ok := r.byConn[conn]
+	delete(r.byConn, conn)
+	r.mu.Unlock()
+	if ok && s.Id != "" {
+		now := time.Now()
+		s.DisconnectedAt = &now
+		storeSession(s)
+	}
+}
+
+// Save keeps a copy of the session of a connection in the store.
+func (r *SessionRegistry) Save(conn net.Conn) {
+	if store == nil {
+		return
+	}
+	r.mu.RLock()
+	s, ok := r.byConn[conn]
+	if ok {
+		s = s.copy()
+	}
+	r.mu.RUnlock()
+	if ok {
+		storeSession(s)
+	}
+}
+
+// Update changes the session of a connection, if it has one.
+func (r *SessionRegistry) Update(conn net.Conn, f func(s *DeviceSession)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.byConn[conn]; ok {
+		f(s)
+	}
+}
+
+// UpdateDevice changes the session of the pile connected under id.
+func (r *SessionRegistry) UpdateDevice(id string, f func(s *DeviceSession)) {
+	if conn, err := GetClient(id); err == nil {
+		r.Update(conn, f)
+	}
+}
+
+// Id returns the id the pile on a connection logged in with.
+func (r *SessionRegistry) Id(conn net.Conn) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.byConn[conn]; ok {
+		return s.Id
+	}
+	return ""
+}
+
+// Get returns a copy of the session of the pile connected under id.
+func (r *SessionRegistry) Get(id string) (*DeviceSession, bool) {
+	conn, err := GetClient(id)
+	if err != nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.byConn[conn]
+	if !ok || s.Id == "" {
+		return nil, false
+	}
+	return s.copy(), true
+}
+
+// List returns copies of the sessions of the piles that have logged in,
+// ordered by id.
+func (r *SessionRegistry) List() []*DeviceSession {
+	r.mu.RLock()
+	list := make([]*DeviceSession, 0, len(r.byConn))
+	for _, s := range r.byConn {
+		if s.Id != "" {
+			list = append(list, s.copy())
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+func (s *DeviceSession) copy() *DeviceSession {
+	c := *s
+	c.GunStates = make([]*GunState, len(s.GunStates))
+	for i, g := range s.GunStates {
+		gc := *g
+		c.GunStates[i] = &gc
+	}
+	return &c
+}
+
+// Gun returns the state of a gun, creating it on first use. gun is the gun
+// id as hex, e.g. 01.
+func (s *DeviceSession) Gun(gun string) *GunState {
+	for _, g := range s.GunStates {
+		if g.Gun == gun {
+			return g
+		}
+	}
+	g := &GunState{Gun: gun}
+	s.GunStates = append(s.GunStates, g)
+	sort.Slice(s.GunStates, func(i, j int) bool { return s.GunStates[i].Gun < s.GunStates[j].Gun })
+	return g
+}
+
+// portGun names a Huaping port like a YKC gun.
+func portGun(port int) string {
+	return fmt.Sprintf("%02x", port)
+}
+
+// ListDevicesRouter lists the connected piles in the caller's scope. With
+// offline=true the last session of the piles not connected is added, from
+// the store.
+func ListDevicesRouter(c *gin.Context) {
+	caller := callerOf(c)
+	list := make([]*DeviceSession, 0)
+	for _, s := range sessions.List() {
+		if caller.CanAccess(s.Id) {
+			list = append(list, s)
+		}
+	}
+	if store != nil && c.Query("offline") == "true" {
+		stored, err := store.Devices()
+		if err != nil {
+			c.JSON(500, ApiMessage{Message: err.Error()})
+			return
+		}
+		for _, s := range stored {
+			if _, online := sessions.Get(s.Id); !online && caller.CanAccess(s.Id) {
+				list = append(list, s)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	}
+	c.JSON(200, list)
+}
+
+// GetDeviceRouter returns the session of a pile, the last one from the
+// store if it is not connected.
+func GetDeviceRouter(c *gin.Context) {
+	s, ok := sessions.Get(c.Param("id"))
+	if !ok && store != nil {
+		var err error
+		s, ok, err = store.Device(c.Param("id"))
+		if err != nil {
+			c.JSON(500, ApiMessage{Message: err.Error()})
+			return
+		}
+	}
+	if !ok {
+		c.JSON(404, gin.H{"message": "device not connected"})
+		return
+	}
+	c.JSON(200, s)
+}
+
+func GetGunRouter(c *gin.Context) {
+	s, ok := sessions.Get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"message": "device not connected"})
+		return
+	}
+	for _, g := range s.GunStates {
+		if g.Gun == c.Param("gun") {
+			c.JSON(200, g)
+			return
+		}
+	}
+	c.JSON(404, gin.H{"message": "no state reported for gun"})
+}
+
+// CloseConnectionRouter drops the connection of a pile, which usually logs in
+// again right away.
+func CloseConnectionRouter(c *gin.Context) {
+	conn, err := GetClient(c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"message": err.Error()})
+		return
+	}
+	if err := conn.Close(); err != nil {
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "done"})
+}
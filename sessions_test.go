@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeviceInventory(t *testing.T) {
+	id := "32010600213540"
+	server, client := net.Pipe()
+	defer client.Close()
+	StoreClient(id, server)
+	sessions.Open(server)
+	defer func() {
+		sessions.Close(server)
+		RemoveClient(server)
+	}()
+	sessions.Update(server, func(s *DeviceSession) {
+		s.Id = id
+		s.Protocol = ProtocolYKC
+		s.Guns = 2
+	})
+	sessions.UpdateDevice(id, func(s *DeviceSession) {
+		g := s.Gun("02")
+		g.Status = GunStatusCharging
+		g.TradeSeq = "32010600213540022301010000000001"
+	})
+
+	s, _ := NewServer(&Options{})
+	r := s.newHttpRouter()
+	get := func(path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		_ = json.Unmarshal(w.Body.Bytes(), v)
+		return w.Code
+	}
+
+	var list []DeviceSession
+	if get("/devices", &list) != 200 || len(list) != 1 || list[0].Id != id || list[0].RemoteAddress != "pipe" {
+		t.Fatalf("unexpected devices %+v", list)
+	}
+	var gun GunState
+	if get("/devices/"+id+"/guns/02", &gun) != 200 || gun.TradeSeq != "32010600213540022301010000000001" {
+		t.Fatalf("unexpected gun %+v", gun)
+	}
+	if code := get("/devices/"+id+"/guns/01", &gun); code != 404 {
+		t.Fatalf("unknown gun answered with %d", code)
+	}
+	if code := get("/devices/32010600213599", &list); code != 404 {
+		t.Fatalf("unknown device answered with %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/devices/"+id+"/connection", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open")
+	}
+}
+
+func TestPileHeartbeat(t *testing.T) {
+	id := "32010600213541"
+	server, client := net.Pipe()
+	defer client.Close()
+	StoreClient(id, server)
+	sessions.Open(server)
+	defer func() {
+		sessions.Close(server)
+		RemoveClient(server)
+	}()
+	sessions.Update(server, func(s *DeviceSession) {
+		s.Id = id
+		s.Protocol = ProtocolYKC
+	})
+
+	//68, length, seq, not encrypted, 03, pile id, gun 01, status normal
+	frame := append([]byte{0x68, 0x0d, 0x05, 0x00, 0x00, PileHeartbeat}, HexToBytes(id)...)
+	frame = append(frame, 0x01, 0x00)
+	frame = append(frame, ModbusCRC(frame[2:])...)
+	go func() { _, _ = client.Write(frame) }()
+	done := make(chan error, 1)
+	go func() { done <- drain(&Options{AutoHeartbeatResponse: true}, server, nil) }()
+
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil || n < 16 || buf[5] != HeartbeatResponse || buf[2] != 0x05 {
+		t.Fatalf("heartbeat not answered: %v % x", err, buf[:n])
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := sessions.Get(id); !ok || s.LastHeartbeat == nil {
+		t.Fatalf("last heartbeat not kept %+v", s)
+	}
+}
+
+// ykcFrame builds a YKC frame of a frame type and size for a pile, the rest
+// zeroed.
+func ykcFrame(frameType byte, size int, id string) []byte {
+	raw := make([]byte, size)
+	raw[0] = StartFlag
+	raw[1] = byte(size - 4)
+	raw[5] = frameType
+	copy(raw[6:13], HexToBytes(id))
+	return raw
+}
+
+func TestDrainRoutesByFrameType(t *testing.T) {
+	id := "32010600213541"
+	f := &flakyForwarder{}
+	opt := &Options{MessageForwarder: f}
+	server, client := net.Pipe()
+	defer client.Close()
+	defer RemoveClient(server)
+
+	offline := ykcFrame(OfflineDataReport, 68, id)
+	copy(offline[22:29], HexToBytes(id))
+	record := transactionRecordFrame("32010600213541012301010000000001", id)
+	record[0], record[5] = StartFlag, TransactionRecord
+	frames := [][]byte{
+		ykcFrame(Verification, 39, id),
+		ykcFrame(BillingModelVerification, 17, id),
+		offline,
+		record,
+		//too short to be a heartbeat (03) or a port command reply (83)
+		ykcFrame(PileHeartbeat, 13, id),
+		{0x5a, 0xa5, 0x08, 0x00, RemoteStart, 0x00, 0x01},
+	}
+	//the encryption flag must not be taken for the frame type
+	frames[1][4] = 0x01
+	for _, frame := range frames {
+		go func(frame []byte) { _, _ = client.Write(frame) }(frame)
+		if err := drain(opt, server, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(f.published, " "); got != "01 05 13 3b" {
+		t.Fatalf("unexpected forwarded frames %s", got)
+	}
+}
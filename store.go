@@ -0,0 +1,653 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket         = []byte("meta")
+	devicesBucket      = []byte("devices")
+	sessionsBucket     = []byte("sessions")
+	transactionsBucket = []byte("transactions")
+	deviceTradesBucket = []byte("transactionsByDevice")
+	billingBucket      = []byte("billingModels")
+	commandsBucket     = []byte("commands")
+	unconfirmedBucket  = []byte("unconfirmedTransactions")
+
+	schemaVersionKey = []byte("schemaVersion")
+)
+
+const (
+	defaultStoreLimit = 100
+	maxStoreLimit     = 10000
+)
+
+// storeMigrations bring the store from one schema version to the next, the
+// schema version is the number of migrations applied. Migrations are only
+// ever appended.
+var storeMigrations = []func(tx *bolt.Tx) error{
+	//1: a bucket per kind of record, transactions indexed by pile
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{devicesBucket, sessionsBucket, transactionsBucket, deviceTradesBucket, billingBucket, commandsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	//2: transactions not confirmed yet indexed
+	func(tx *bolt.Tx) error {
+		unconfirmed, err := tx.CreateBucketIfNotExists(unconfirmedBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(transactionsBucket).ForEach(func(k, v []byte) error {
+			var r StoredTransaction
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.ConfirmedAt != nil {
+				return nil
+			}
+			return unconfirmed.Put(k, []byte{})
+		})
+	},
+}
+
+// Store keeps what the proxy learns about its piles in a bbolt file: the
+// last session of every pile and the sessions before, transaction records,
+// billing models sent and the commands sent to piles. Every write is synced
+// to disk before it returns.
+type Store struct {
+	db *bolt.DB
+}
+
+var store *Store
+
+var ErrStoreSchemaTooNew = errors.New("store schema is newer than this build")
+
+// StoredTransaction is a transaction record (3b) as last received. Uploads
+// counts how often the pile sent it, ForwardedAt is set once it has been
+// forwarded and ConfirmedAt once it has been confirmed to the pile, with
+// Confirmation (40).
+type StoredTransaction struct {
+	TradeSeq     string                             `json:"tradeSeq"`
+	Id           string                             `json:"id"`
+	ReceivedAt   time.Time                          `json:"receivedAt"`
+	Uploads      int                                `json:"uploads"`
+	ForwardedAt  *time.Time                         `json:"forwardedAt,omitempty"`
+	ConfirmedAt  *time.Time                         `json:"confirmedAt,omitempty"`
+	Confirmation *TransactionRecordConfirmedMessage `json:"confirmation,omitempty"`
+	Record       *TransactionRecordMessage          `json:"record"`
+}
+
+// BillingModelRecord is the billing model last sent to a pile, as answer to
+// its request (0a) or set by the platform (58). AcceptedAt is set once the
+// pile has accepted a model set (57).
+type BillingModelRecord struct {
+	Id               string          `json:"id"`
+	BillingModelCode string          `json:"billingModelCode"`
+	FrameType        string          `json:"frameType"`
+	Model            json.RawMessage `json:"model"`
+	Source           *CommandSource  `json:"source,omitempty"`
+	SentAt           time.Time       `json:"sentAt"`
+	AcceptedAt       *time.Time      `json:"acceptedAt,omitempty"`
+}
+
+// TransactionFilter selects the transaction records of a pile received
+// between From and To, an empty Id matches every pile. Unconfirmed leaves
+// out the records confirmed to the pile.
+type TransactionFilter struct {
+	Id          string
+	From        time.Time
+	To          time.Time
+	Unconfirmed bool
+	Limit       int
+}
+
+// OpenStore opens the store file, creating it if needed, and migrates it to
+// the schema of this build.
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations not applied yet in one transaction, so a
+// failing migration leaves the store as it was.
+func (s *Store) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(schemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		if version > len(storeMigrations) {
+			return fmt.Errorf("%w: version %d, known %d", ErrStoreSchemaTooNew, version, len(storeMigrations))
+		}
+		for i := version; i < len(storeMigrations); i++ {
+			if err := storeMigrations[i](tx); err != nil {
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+			log.WithFields(log.Fields{
+				"version": i + 1,
+			}).Info("store migrated")
+		}
+		return meta.Put(schemaVersionKey, uint64Key(uint64(len(storeMigrations))))
+	})
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SchemaVersion returns the number of migrations applied to the store.
+func (s *Store) SchemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(schemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return version, err
+}
+
+func uint64Key(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func timeKey(t time.Time) []byte {
+	return uint64Key(uint64(t.UnixNano()))
+}
+
+// SaveSession keeps a session of a pile as its last one and in its session
+// history, keyed by when it connected. Sessions without an id are dropped.
+func (s *Store) SaveSession(session *DeviceSession) error {
+	if session.Id == "" {
+		return nil
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	//heartbeats of many piles are written together
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(devicesBucket).Put([]byte(session.Id), b); err != nil {
+			return err
+		}
+		history, err := tx.Bucket(sessionsBucket).CreateBucketIfNotExists([]byte(session.Id))
+		if err != nil {
+			return err
+		}
+		return history.Put(timeKey(session.ConnectedSince), b)
+	})
+}
+
+// Device returns the last session of a pile.
+func (s *Store) Device(id string) (*DeviceSession, bool, error) {
+	var session *DeviceSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(devicesBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		session = &DeviceSession{}
+		return json.Unmarshal(v, session)
+	})
+	return session, session != nil, err
+}
+
+// Devices returns the last session of every pile ever seen, by id.
+func (s *Store) Devices() ([]*DeviceSession, error) {
+	list := make([]*DeviceSession, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(devicesBucket).ForEach(func(k, v []byte) error {
+			var session DeviceSession
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			list = append(list, &session)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Sessions returns the last limit sessions of a pile, newest first.
+func (s *Store) Sessions(id string, limit int) ([]*DeviceSession, error) {
+	list := make([]*DeviceSession, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(sessionsBucket).Bucket([]byte(id))
+		if history == nil {
+			return nil
+		}
+		c := history.Cursor()
+		for k, v := c.Last(); k != nil && len(list) < limit; k, v = c.Prev() {
+			var session DeviceSession
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			list = append(list, &session)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// SaveTransaction keeps a transaction record and returns what is stored
+// about the trade. A record uploaded again keeps when it was first received
+// and whether it was forwarded and confirmed.
+func (s *Store) SaveTransaction(msg *TransactionRecordMessage) (*StoredTransaction, error) {
+	var r *StoredTransaction
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		r, err = getTransaction(tx, msg.TradeSeq)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			r = &StoredTransaction{
+				TradeSeq:   msg.TradeSeq,
+				Id:         msg.Id,
+				ReceivedAt: time.Now(),
+			}
+			if err := tx.Bucket(unconfirmedBucket).Put([]byte(msg.TradeSeq), []byte{}); err != nil {
+				return err
+			}
+		}
+		r.Record = msg
+		r.Uploads++
+		if err := putTransaction(tx, r); err != nil {
+			return err
+		}
+		trades, err := tx.Bucket(deviceTradesBucket).CreateBucketIfNotExists([]byte(msg.Id))
+		if err != nil {
+			return err
+		}
+		return trades.Put([]byte(msg.TradeSeq), []byte{})
+	})
+	return r, err
+}
+
+// ForwardTransaction notes that a transaction record has been forwarded.
+func (s *Store) ForwardTransaction(tradeSeq string, at time.Time) error {
+	return s.updateTransaction(tradeSeq, func(tx *bolt.Tx, r *StoredTransaction) error {
+		r.ForwardedAt = &at
+		return nil
+	})
+}
+
+// ConfirmTransaction keeps the confirmation (40) sent for a transaction
+// record, it is sent again when the pile uploads the record again. Unknown
+// trades are ignored.
+func (s *Store) ConfirmTransaction(m *TransactionRecordConfirmedMessage, at time.Time) error {
+	return s.updateTransaction(m.TradeSeq, func(tx *bolt.Tx, r *StoredTransaction) error {
+		if r.ConfirmedAt == nil {
+			r.ConfirmedAt = &at
+		}
+		r.Confirmation = m
+		return tx.Bucket(unconfirmedBucket).Delete([]byte(m.TradeSeq))
+	})
+}
+
+// updateTransaction changes the stored record of a trade, if there is one.
+func (s *Store) updateTransaction(tradeSeq string, f func(tx *bolt.Tx, r *StoredTransaction) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		r, err := getTransaction(tx, tradeSeq)
+		if err != nil || r == nil {
+			return err
+		}
+		if err := f(tx, r); err != nil {
+			return err
+		}
+		return putTransaction(tx, r)
+	})
+}
+
+func getTransaction(tx *bolt.Tx, tradeSeq string) (*StoredTransaction, error) {
+	v := tx.Bucket(transactionsBucket).Get([]byte(tradeSeq))
+	if v == nil {
+		return nil, nil
+	}
+	r := &StoredTransaction{}
+	return r, json.Unmarshal(v, r)
+}
+
+func putTransaction(tx *bolt.Tx, r *StoredTransaction) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(transactionsBucket).Put([]byte(r.TradeSeq), v)
+}
+
+// Transaction returns the transaction record of a trade.
+func (s *Store) Transaction(tradeSeq string) (*StoredTransaction, bool, error) {
+	var r *StoredTransaction
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = getTransaction(tx, tradeSeq)
+		return err
+	})
+	return r, r != nil, err
+}
+
+// Transactions returns the transaction records matching filter, oldest
+// first, and at most filter.Limit of them.
+func (s *Store) Transactions(filter TransactionFilter) ([]*StoredTransaction, error) {
+	list := make([]*StoredTransaction, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(transactionsBucket)
+		add := func(v []byte) error {
+			var r StoredTransaction
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if (filter.Id == "" || filter.Id == r.Id) && !r.ReceivedAt.Before(filter.From) && !r.ReceivedAt.After(filter.To) {
+				list = append(list, &r)
+			}
+			return nil
+		}
+		if filter.Unconfirmed {
+			return tx.Bucket(unconfirmedBucket).ForEach(func(k, _ []byte) error {
+				if v := b.Get(k); v != nil {
+					return add(v)
+				}
+				return nil
+			})
+		}
+		if filter.Id == "" {
+			return b.ForEach(func(k, v []byte) error { return add(v) })
+		}
+		trades := tx.Bucket(deviceTradesBucket).Bucket([]byte(filter.Id))
+		if trades == nil {
+			return nil
+		}
+		return trades.ForEach(func(k, _ []byte) error {
+			if v := b.Get(k); v != nil {
+				return add(v)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].ReceivedAt.Before(list[j].ReceivedAt) })
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, err
+}
+
+// SaveBillingModel keeps the billing model last sent to a pile.
+func (s *Store) SaveBillingModel(r *BillingModelRecord) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(billingBucket).Put([]byte(r.Id), v)
+	})
+}
+
+// AcceptBillingModel notes that a pile has accepted the billing model last
+// set.
+func (s *Store) AcceptBillingModel(id string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(billingBucket)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var r BillingModelRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		r.AcceptedAt = &at
+		v, err := json.Marshal(&r)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), v)
+	})
+}
+
+// BillingModel returns the billing model last sent to a pile.
+func (s *Store) BillingModel(id string) (*BillingModelRecord, bool, error) {
+	var r *BillingModelRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(billingBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		r = &BillingModelRecord{}
+		return json.Unmarshal(v, r)
+	})
+	return r, r != nil, err
+}
+
+// RecordCommand keeps a command sent to a pile in its command history.
+func (s *Store) RecordCommand(r *FrameRecord) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		history, err := tx.Bucket(commandsBucket).CreateBucketIfNotExists([]byte(r.Id))
+		if err != nil {
+			return err
+		}
+		seq, err := history.NextSequence()
+		if err != nil {
+			return err
+		}
+		return history.Put(uint64Key(seq), v)
+	})
+}
+
+// Commands returns the last limit commands sent to a pile, newest first.
+func (s *Store) Commands(id string, limit int) ([]*FrameRecord, error) {
+	list := make([]*FrameRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(commandsBucket).Bucket([]byte(id))
+		if history == nil {
+			return nil
+		}
+		c := history.Cursor()
+		for k, v := c.Last(); k != nil && len(list) < limit; k, v = c.Prev() {
+			var r FrameRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			list = append(list, &r)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// storeFrame keeps what a frame tells about a pile in the store, if there
+// is one: commands sent to it, billing models and confirmed transaction
+// records.
+func storeFrame(direction string, id string, frameType string, msg json.RawMessage, src *CommandSource) {
+	if store == nil || id == "" {
+		return
+	}
+	var err error
+	now := time.Now()
+	switch direction {
+	case DirectionDownlink:
+		if src != autoSource {
+			err = store.RecordCommand(&FrameRecord{
+				Time:      now,
+				Direction: direction,
+				FrameType: frameType,
+				Id:        id,
+				Source:    src,
+				Message:   msg,
+			})
+		}
+		switch frameType {
+		case "0a", "58":
+			var m struct {
+				BillingModelCode string `json:"billingModelCode"`
+			}
+			_ = json.Unmarshal(msg, &m)
+			if serr := store.SaveBillingModel(&BillingModelRecord{
+				Id:               id,
+				BillingModelCode: m.BillingModelCode,
+				FrameType:        frameType,
+				Model:            msg,
+				Source:           src,
+				SentAt:           now,
+			}); serr != nil {
+				err = serr
+			}
+		case "40":
+			var m TransactionRecordConfirmedMessage
+			if json.Unmarshal(msg, &m) == nil && m.TradeSeq != "" {
+				if serr := store.ConfirmTransaction(&m, now); serr != nil {
+					err = serr
+				}
+			}
+		}
+	case DirectionUplink:
+		if frameType == "57" {
+			var m SetBillingModelResponseMessage
+			if json.Unmarshal(msg, &m) == nil && m.Result == 1 {
+				err = store.AcceptBillingModel(id, now)
+			}
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":        id,
+			"frameType": frameType,
+		}).Errorf("error storing frame: %v", err)
+	}
+}
+
+// storeSession keeps a copy of a session in the store, if there is one.
+func storeSession(s *DeviceSession) {
+	if store == nil {
+		return
+	}
+	if err := store.SaveSession(s); err != nil {
+		log.WithFields(log.Fields{
+			"id": s.Id,
+		}).Errorf("error storing session: %v", err)
+	}
+}
+
+// storeLimit reads the limit query of the store routes.
+func storeLimit(c *gin.Context) int {
+	limit := defaultStoreLimit
+	if v := c.Query("limit"); v != "" {
+		//checked against the document already
+		limit, _ = strconv.Atoi(v)
+	}
+	return limit
+}
+
+// ListSessionsRouter returns the sessions of a pile, newest first.
+func ListSessionsRouter(c *gin.Context) {
+	list, err := store.Sessions(c.Param("id"), storeLimit(c))
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	c.JSON(200, list)
+}
+
+// ListDeviceCommandsRouter returns the commands sent to a pile, newest
+// first.
+func ListDeviceCommandsRouter(c *gin.Context) {
+	list, err := store.Commands(c.Param("id"), storeLimit(c))
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	c.JSON(200, list)
+}
+
+func GetBillingModelRouter(c *gin.Context) {
+	r, ok, err := store.BillingModel(c.Param("id"))
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(404, ApiMessage{Message: "no billing model sent"})
+		return
+	}
+	c.JSON(200, r)
+}
+
+// ListTransactionsRouter returns the transaction records received between
+// from and to, of the piles in the caller's scope. unconfirmed=true returns
+// the records not confirmed yet, by default however old they are.
+func ListTransactionsRouter(c *gin.Context) {
+	from, to, ok := timeRangeQuery(c)
+	if !ok {
+		return
+	}
+	filter := TransactionFilter{Id: c.Query("id"), From: from, To: to, Unconfirmed: c.Query("unconfirmed") == "true"}
+	if filter.Unconfirmed && c.Query("from") == "" {
+		filter.From = time.Time{}
+	}
+	caller := callerOf(c)
+	if filter.Id != "" && !caller.CanAccess(filter.Id) {
+		c.JSON(403, ApiMessage{Message: "no access to device " + filter.Id})
+		return
+	}
+	list, err := store.Transactions(filter)
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	scoped := make([]*StoredTransaction, 0, len(list))
+	for _, r := range list {
+		if caller.CanAccess(r.Id) {
+			scoped = append(scoped, r)
+		}
+	}
+	if limit := storeLimit(c); len(scoped) > limit {
+		scoped = scoped[:limit]
+	}
+	c.JSON(200, scoped)
+}
+
+func GetTransactionRouter(c *gin.Context) {
+	r, ok, err := store.Transaction(c.Param("tradeSeq"))
+	if err != nil {
+		c.JSON(500, ApiMessage{Message: err.Error()})
+		return
+	}
+	//out of scope looks like unknown, so trade numbers are not given away
+	if !ok || !callerOf(c).CanAccess(r.Id) {
+		c.JSON(404, ApiMessage{Message: "transaction record not found"})
+		return
+	}
+	c.JSON(200, r)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStoreMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.SchemaVersion(); v != len(storeMigrations) {
+		t.Fatalf("unexpected schema version %d", v)
+	}
+	_ = s.Close()
+
+	//a migration added later runs once, on the next open
+	runs := 0
+	migrations := storeMigrations
+	storeMigrations = append(migrations[:len(migrations):len(migrations)], func(tx *bolt.Tx) error {
+		runs++
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		s, err = OpenStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+	}
+	storeMigrations = migrations
+	if runs != 1 {
+		t.Fatalf("migration ran %d times", runs)
+	}
+
+	if _, err := OpenStore(path); !errors.Is(err, ErrStoreSchemaTooNew) {
+		t.Fatalf("store of a newer build opened: %v", err)
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	first := time.Now().Add(-time.Hour)
+	for _, since := range []time.Time{first, first.Add(time.Minute)} {
+		if err := s.SaveSession(&DeviceSession{Id: "32010600213540", ConnectedSince: since, Signal: 20}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, _ := s.Sessions("32010600213540", 10)
+	if len(list) != 2 || !list[0].ConnectedSince.After(list[1].ConnectedSince) {
+		t.Fatalf("unexpected sessions %+v", list)
+	}
+	if d, ok, _ := s.Device("32010600213540"); !ok || !d.ConnectedSince.Equal(list[0].ConnectedSince) {
+		t.Fatalf("unexpected device %+v", d)
+	}
+}
+
+// transactionRecordFrame builds a 3b frame of a trade, the rest zeroed.
+func transactionRecordFrame(tradeSeq string, id string) []byte {
+	raw := make([]byte, 166)
+	copy(raw[6:22], HexToBytes(tradeSeq))
+	copy(raw[22:29], HexToBytes(id))
+	raw[29] = 0x01
+	return raw
+}
+
+// routeRecord routes a 3b frame, the returned channel is closed once it is
+// done.
+func routeRecord(opt *Options, raw []byte) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		TransactionRecordMessageRouter(opt, raw, BytesToHex(raw), &Header{})
+	}()
+	return done
+}
+
+func TestTransactionStoredBeforeConfirm(t *testing.T) {
+	id := "32010600213541"
+	tradeSeq := "32010600213541012301010000000001"
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	defer func() { store = nil }()
+	server, client := net.Pipe()
+	defer client.Close()
+	StoreClient(id, server)
+	defer RemoveClient(server)
+
+	opt := &Options{AutoTransactionRecordConfirm: true}
+	raw := transactionRecordFrame(tradeSeq, id)
+	done := routeRecord(opt, raw)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	<-done
+	if err != nil || buf[5] != 0x40 {
+		t.Fatalf("record not confirmed: %v % x", err, buf[:n])
+	}
+	if r, ok, _ := s.Transaction(tradeSeq); !ok || r.ConfirmedAt == nil || r.Record.Id != id {
+		t.Fatalf("confirmation not stored %+v", r)
+	}
+	if list, _ := s.Transactions(TransactionFilter{Id: id, From: time.Now().Add(-time.Hour), To: time.Now()}); len(list) != 1 {
+		t.Fatalf("unexpected transactions %+v", list)
+	}
+
+	srv, _ := NewServer(&Options{})
+	w := httptest.NewRecorder()
+	srv.newHttpRouter().ServeHTTP(w, httptest.NewRequest("GET", "/transactions/"+tradeSeq, nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"confirmedAt"`) {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	//a record that can not be stored is not confirmed
+	_ = s.Close()
+	done = routeRecord(opt, raw)
+	_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = client.Read(buf)
+	<-done
+	if err == nil {
+		t.Fatal("unstored record confirmed")
+	}
+}
+
+func TestTransactionDeduplication(t *testing.T) {
+	id := "32010600213542"
+	tradeSeq := "32010600213542012301010000000001"
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store = s
+	defer func() { store = nil }()
+	server, client := net.Pipe()
+	defer client.Close()
+	StoreClient(id, server)
+	defer RemoveClient(server)
+
+	//a slow backend: the pile uploads again before it is confirmed
+	f := &flakyForwarder{}
+	opt := &Options{MessageForwarder: f}
+	raw := transactionRecordFrame(tradeSeq, id)
+	for i := 0; i < 3; i++ {
+		TransactionRecordMessageRouter(opt, raw, BytesToHex(raw), &Header{})
+	}
+	if len(f.published) != 1 {
+		t.Fatalf("record forwarded %d times", len(f.published))
+	}
+	srv, _ := NewServer(&Options{})
+	r := srv.newHttpRouter()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/transactions?unconfirmed=true", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), tradeSeq) || !strings.Contains(w.Body.String(), `"uploads":3`) {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	//the backend confirms, the pile misses it and uploads again
+	confirm := &TransactionRecordConfirmedMessage{Header: &Header{}, Id: id, TradeSeq: tradeSeq, Result: 1}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		_ = SendTransactionRecordConfirmed(confirm, nil)
+	}()
+	buf := make([]byte, 64)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	<-sent
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := append([]byte{}, buf[:n]...)
+	done := routeRecord(opt, raw)
+	n, err = client.Read(buf)
+	<-done
+	if err != nil || buf[5] != 0x40 {
+		t.Fatalf("confirmation not sent again: %v % x", err, buf[:n])
+	}
+	//trade sequence and result as in the confirmation of the backend
+	if !bytes.Equal(buf[6:22], HexToBytes(tradeSeq)) || !bytes.Equal(buf[6:23], first[6:23]) {
+		t.Fatalf("unexpected confirmation % x, sent % x", buf[:n], first)
+	}
+	if len(f.published) != 1 {
+		t.Fatalf("confirmed record forwarded again")
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/transactions?unconfirmed=true", nil))
+	if w.Body.String() != "[]" {
+		t.Fatalf("confirmed record listed as unconfirmed %s", w.Body.String())
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// certificate files are checked for changes at most this often
+	certCheckInterval   = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// certReloader serves the server certificate and client CA pool from disk
+// and reloads them whenever the files change, so certificates can be
+// rotated without restarting the gateway.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		modTimes:     make(map[string]time.Time),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load must be called with r.mu held, except from the constructor.
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + r.clientCAFile)
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = pool
+	for _, f := range r.files() {
+		if fi, err := os.Stat(f); err == nil {
+			r.modTimes[f] = fi.ModTime()
+		}
+	}
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// reloadIfChanged keeps serving the old certificates if the new ones can not
+// be loaded, e.g. because only one of the files has been replaced so far.
+func (r *certReloader) reloadIfChanged() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return
+	}
+	r.checkedAt = time.Now()
+	changed := false
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err == nil && !fi.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Errorf("error reloading tls certificates, keeping the old ones: %v", err)
+		return
+	}
+	log.Info("tls certificates reloaded")
+}
+
+func (r *certReloader) config(requireClientCert bool) *tls.Config {
+	r.reloadIfChanged()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCAs != nil {
+		cfg.ClientCAs = r.clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg
+}
+
+// newTlsConfig builds the listener config from the options. Every handshake
+// asks the reloader for the current certificates.
+func newTlsConfig(opt *Options) (*tls.Config, error) {
+	r, err := newCertReloader(opt.TlsCert, opt.TlsKey, opt.TlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config(opt.TlsRequireClientCert), nil
+		},
+	}, nil
+}
+
+// tlsHandshake completes the handshake of a tls connection so the client
+// certificate is known before the first frame is read.
+func tlsHandshake(conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	_ = tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+// ConnIdentity returns the pile id a connection has proven by its verified
+// client certificate, which is the common name of the certificate, or an
+// empty string for plain connections and tls connections without one.
+func ConnIdentity(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert issues a certificate for cn, signed by parent or else self signed
+// as a CA, and writes it and its key as <name>.pem and <name>.key.
+func writeCert(t *testing.T, dir string, name string, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	_ = os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func verificationFrame(id string) []byte {
+	raw := make([]byte, 39)
+	raw[5] = Verification
+	copy(raw[6:13], HexToBytes(id))
+	return raw
+}
+
+func TestTlsLoginIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", "ykc test ca", nil, nil)
+	writeCert(t, dir, "server", "127.0.0.1", ca, caKey)
+	opt := &Options{
+		TlsCert:              filepath.Join(dir, "server.pem"),
+		TlsKey:               filepath.Join(dir, "server.key"),
+		TlsClientCA:          filepath.Join(dir, "ca.pem"),
+		TlsRequireClientCert: true,
+		AutoVerification:     true,
+	}
+	cfg, err := newTlsConfig(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for _, tc := range []struct {
+		name, cn, id string
+		route        func(raw []byte, conn net.Conn)
+		raw          []byte
+	}{
+		{"01 matching", "32010600213533", "32010600213533", func(raw []byte, conn net.Conn) {
+			VerificationRouter(opt, raw, BytesToHex(raw), &Header{}, conn)
+		}, verificationFrame("32010600213533")},
+		{"01 mismatched", "32010600213533", "32010600213534", func(raw []byte, conn net.Conn) {
+			VerificationRouter(opt, raw, BytesToHex(raw), &Header{}, conn)
+		}, verificationFrame("32010600213534")},
+		{"81 matching", "861435073900843", "861435073900843", func(raw []byte, conn net.Conn) {
+			DeviceLoginRouter(opt, raw, BytesToHex(raw), &Header{}, conn)
+		}, deviceLoginFrame("861435073900843")},
+		{"81 mismatched", "861435073900843", "861435073900844", func(raw []byte, conn net.Conn) {
+			DeviceLoginRouter(opt, raw, BytesToHex(raw), &Header{}, conn)
+		}, deviceLoginFrame("861435073900844")},
+	} {
+		writeCert(t, dir, "client", tc.cn, ca, caKey)
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil && tlsHandshake(conn) != nil {
+				_ = conn.Close()
+				conn = nil
+			}
+			accepted <- conn
+		}()
+		client, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := <-accepted
+		if conn == nil {
+			t.Fatalf("%s: handshake failed", tc.name)
+		}
+		if id := ConnIdentity(conn); id != tc.cn {
+			t.Fatalf("%s: unexpected identity %q", tc.name, id)
+		}
+
+		tc.route(tc.raw, conn)
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		if _, err := client.Read(buf); err != nil {
+			t.Errorf("%s: login not answered: %v", tc.name, err)
+		}
+		_, stored := clients.Load(tc.id)
+		if stored != (tc.cn == tc.id) {
+			t.Errorf("%s: pile stored %v", tc.name, stored)
+		}
+		RemoveClient(conn)
+		_ = conn.Close()
+		_ = client.Close()
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", "ykc test ca", nil, nil)
+	first, _ := writeCert(t, dir, "server", "127.0.0.1", ca, caKey)
+	r, err := newCertReloader(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() []byte {
+		r.mu.Lock()
+		r.checkedAt = time.Time{}
+		r.mu.Unlock()
+		return r.config(false).Certificates[0].Certificate[0]
+	}
+	touch := func(name string) {
+		later := time.Now().Add(time.Minute)
+		_ = os.Chtimes(filepath.Join(dir, name), later, later)
+	}
+
+	//only the certificate replaced so far: the old pair is kept
+	key, _ := os.ReadFile(filepath.Join(dir, "server.key"))
+	second, _ := writeCert(t, dir, "server", "127.0.0.1", ca, caKey)
+	newKey, _ := os.ReadFile(filepath.Join(dir, "server.key"))
+	_ = os.WriteFile(filepath.Join(dir, "server.key"), key, 0600)
+	touch("server.pem")
+	if !bytes.Equal(served(), first.Raw) {
+		t.Fatal("half replaced certificate served")
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "server.key"), newKey, 0600)
+	touch("server.key")
+	if !bytes.Equal(served(), second.Raw) {
+		t.Fatal("new certificate not served")
+	}
+	if cfg := r.config(true); cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Fatalf("client certificates not required %v", cfg.ClientAuth)
+	}
+}
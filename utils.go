@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -189,6 +191,20 @@ func Cp56time2aToUnixMilliseconds(cp56time2a []byte) int64 {
 	return t.UnixNano() / int64(time.Millisecond)
 }
 
+// UnixMillisecondsToCp56time2a encodes a time the way
+// Cp56time2aToUnixMilliseconds decodes it, in UTC.
+func UnixMillisecondsToCp56time2a(ms int64) []byte {
+	t := time.UnixMilli(ms).UTC()
+	b := make([]byte, 7)
+	binary.LittleEndian.PutUint16(b[0:2], uint16(t.Second()*1000+t.Nanosecond()/int(time.Millisecond)))
+	b[2] = byte(t.Minute())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Day())
+	b[5] = byte(t.Month())
+	b[6] = byte(t.Year() - 2000)
+	return b
+}
+
 func IntToBIN(v int, l int) []byte {
 	value := uint32(v)
 	var b []byte
@@ -213,3 +229,16 @@ func BINToInt(b []byte) int {
 	value := binary.LittleEndian.Uint32(b)
 	return int(value)
 }
+
+// NewId returns a random 16 byte hex identifier.
+func NewId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hostname names this gateway instance by default.
+func hostname() string {
+	host, _ := os.Hostname()
+	return host
+}